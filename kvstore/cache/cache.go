@@ -0,0 +1,293 @@
+// Package cache provides a read-through cache around any store.Store
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+const (
+	// DefaultSize is the number of entries cached when Options.Size is not positive
+	DefaultSize = 1024
+	// DefaultTTL is how long an entry is cached when Options.TTL is not positive
+	DefaultTTL = time.Minute
+
+	// rewatchDelay is the delay before watching again a directory whose watch stopped
+	rewatchDelay = time.Second
+)
+
+// Options of a Cache
+type Options struct {
+	// Size is the max number of cached results of Get and List, the least recently used are evicted
+	Size int
+	// TTL is how long a result is cached, it bounds the staleness of the keys which are not watched
+	TTL time.Duration
+	// Directories are watched through WatchTree, the cached results under them are
+	// invalidated as soon as a change is pushed
+	Directories []string
+}
+
+// Cache implements store.Store around another store, the results of Get, Exists and List
+// are cached locally, missing keys included. The writes through the cache invalidate the
+// results they affect, the writes of the other clients are seen once pushed by the watch
+// of Options.Directories or once the cached result expires
+type Cache struct {
+	store.Store
+	ttl time.Duration
+
+	mu  sync.Mutex
+	lru *lru
+	gen uint64 // incremented on every invalidation, the reads in flight meanwhile are not cached
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// New creates a cache around s, the watches of options.Directories run until Close
+func New(s store.Store, options *Options) *Cache {
+	if options == nil {
+		options = &Options{}
+	}
+	size := options.Size
+	if size <= 0 {
+		size = DefaultSize
+	}
+	ttl := options.TTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	c := &Cache{
+		Store: s,
+		ttl:   ttl,
+		lru:   newLRU(size),
+		done:  make(chan struct{}),
+	}
+	for _, dir := range options.Directories {
+		c.wg.Add(1)
+		go c.watch(dir)
+	}
+	return c
+}
+
+// cache keys of the results of Get and List
+const (
+	keyPrefix = "k"
+	dirPrefix = "d"
+)
+
+// normalize the key so that the keys returned by any backend match the requested ones
+func normalize(key string) string {
+	return strings.TrimLeft(store.Normalize(key), "/")
+}
+
+// lookup returns the cached result of key and the generation to pass to add on a miss
+func (c *Cache) lookup(key string) (interface{}, bool, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	value, ok := c.lru.get(key, time.Now())
+	return value, ok, c.gen
+}
+
+// add caches the result of key unless an invalidation happened since gen
+func (c *Cache) add(key string, value interface{}, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gen == gen {
+		c.lru.add(key, value, time.Now().Add(c.ttl))
+	}
+}
+
+// Get a value given its key, from the cache if possible
+func (c *Cache) Get(key string) (*store.KVPair, error) {
+	cacheKey := keyPrefix + normalize(key)
+	value, ok, gen := c.lookup(cacheKey)
+	if !ok {
+		pair, err := c.Store.Get(key)
+		if err != nil && err != store.ErrKeyNotFound {
+			return nil, err
+		}
+		c.add(cacheKey, pair, gen)
+		value = pair
+	}
+
+	pair := value.(*store.KVPair)
+	if pair == nil {
+		return nil, store.ErrKeyNotFound
+	}
+	return copyPair(pair), nil
+}
+
+// Exists verifies if a key exists in the store, from the cache if possible
+func (c *Cache) Exists(key string) (bool, error) {
+	if value, ok, _ := c.lookup(keyPrefix + normalize(key)); ok {
+		return value.(*store.KVPair) != nil, nil
+	}
+	return c.Store.Exists(key)
+}
+
+// List the content of a given directory, from the cache if possible
+func (c *Cache) List(directory string) ([]*store.KVPair, error) {
+	cacheKey := dirPrefix + normalize(directory)
+	value, ok, gen := c.lookup(cacheKey)
+	if !ok {
+		pairs, err := c.Store.List(directory)
+		if err != nil && err != store.ErrKeyNotFound {
+			return nil, err
+		}
+		if err == store.ErrKeyNotFound {
+			pairs = nil
+		} else if pairs == nil {
+			pairs = []*store.KVPair{}
+		}
+		c.add(cacheKey, pairs, gen)
+		value = pairs
+	}
+
+	pairs := value.([]*store.KVPair)
+	if pairs == nil {
+		return nil, store.ErrKeyNotFound
+	}
+	copied := make([]*store.KVPair, len(pairs))
+	for i, pair := range pairs {
+		copied[i] = copyPair(pair)
+	}
+	return copied, nil
+}
+
+// Put a value at the specified key
+func (c *Cache) Put(key string, value []byte, options *store.WriteOptions) error {
+	defer c.invalidate(key)
+	return c.Store.Put(key, value, options)
+}
+
+// Delete the value at the specified key
+func (c *Cache) Delete(key string) error {
+	defer c.invalidate(key)
+	return c.Store.Delete(key)
+}
+
+// DeleteTree deletes a range of keys under a given directory
+func (c *Cache) DeleteTree(directory string) error {
+	defer c.invalidateTree(directory)
+	return c.Store.DeleteTree(directory)
+}
+
+// AtomicPut is a CAS operation on a single value,
+// pass previous = nil to create a new key
+func (c *Cache) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	defer c.invalidate(key)
+	return c.Store.AtomicPut(key, value, previous, options)
+}
+
+// AtomicDelete deletes a single value only if it's not modified since previous
+func (c *Cache) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	defer c.invalidate(key)
+	return c.Store.AtomicDelete(key, previous)
+}
+
+// Txn applies ops atomically, see store.Store. The keys written by ops are invalidated
+func (c *Cache) Txn(ops []*store.TxnOp) ([]*store.KVPair, error) {
+	defer func() {
+		for _, op := range ops {
+			if op.Type != store.TxnCheckIndex {
+				c.invalidate(op.Key)
+			}
+		}
+	}()
+	return c.Store.Txn(ops)
+}
+
+// invalidate drops the cached results which may contain key
+func (c *Cache) invalidate(key string) {
+	key = normalize(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.lru.remove(keyPrefix + key)
+	for cacheKey := range c.lru.items {
+		if strings.HasPrefix(cacheKey, dirPrefix) && strings.HasPrefix(key, cacheKey[len(dirPrefix):]) {
+			c.lru.remove(cacheKey)
+		}
+	}
+}
+
+// invalidateTree drops the cached results which may contain a key under directory
+func (c *Cache) invalidateTree(directory string) {
+	directory = normalize(directory)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	c.lru.removePrefix(keyPrefix + directory)
+	for cacheKey := range c.lru.items {
+		if !strings.HasPrefix(cacheKey, dirPrefix) {
+			continue
+		}
+		dir := cacheKey[len(dirPrefix):]
+		if strings.HasPrefix(dir, directory) || strings.HasPrefix(directory, dir) {
+			c.lru.remove(cacheKey)
+		}
+	}
+}
+
+// watch invalidates the keys changed under directory until Close.
+// The changes missed while the watch is down are accounted for by dropping
+// the whole directory every time the watch starts
+func (c *Cache) watch(directory string) {
+	defer c.wg.Done()
+
+	for {
+		pairsCh, err := c.Store.WatchTree(directory, c.done)
+		if err == nil {
+			var prev []*store.KVPair
+			first := true
+			for pairs := range pairsCh {
+				if first {
+					c.invalidateTree(directory)
+					first = false
+				} else {
+					for _, event := range store.DiffEvents(prev, pairs) {
+						c.invalidate(event.Pair.Key)
+					}
+				}
+				prev = pairs
+			}
+		}
+
+		// nothing under directory can be trusted until it's watched again
+		c.invalidateTree(directory)
+		select {
+		case <-c.done:
+			return
+		case <-time.After(rewatchDelay):
+		}
+	}
+}
+
+// Close stops the watches and closes the underlying store
+func (c *Cache) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.Store.Close()
+		c.wg.Wait()
+	})
+}
+
+func copyPair(pair *store.KVPair) *store.KVPair {
+	copied := *pair
+	if pair.Value != nil {
+		copied.Value = make([]byte, len(pair.Value))
+		copy(copied.Value, pair.Value)
+	}
+	return &copied
+}
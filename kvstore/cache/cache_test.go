@@ -0,0 +1,182 @@
+package cache
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/store/memory"
+	"github.com/beyondyyh/libs/kvstore/testutils"
+)
+
+// run all: go test -v github.com/beyondyyh/libs/kvstore/cache
+
+// countingStore counts the reads reaching the underlying store
+type countingStore struct {
+	store.Store
+	gets  int32
+	lists int32
+}
+
+func (s *countingStore) Get(key string) (*store.KVPair, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.Store.Get(key)
+}
+
+func (s *countingStore) List(directory string) ([]*store.KVPair, error) {
+	atomic.AddInt32(&s.lists, 1)
+	return s.Store.List(directory)
+}
+
+func makeCountingStore(t *testing.T) *countingStore {
+	kv, err := memory.New(nil, nil)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	return &countingStore{Store: kv}
+}
+
+// go test -v -run TestCacheStore github.com/beyondyyh/libs/kvstore/cache
+func TestCacheStore(t *testing.T) {
+	kv := New(makeCountingStore(t), &Options{Directories: []string{""}})
+	defer kv.Close()
+	defer testutils.RunCleanup(t, kv)
+
+	testutils.RunTestCommon(t, kv)
+	testutils.RunTestAtomic(t, kv)
+	testutils.RunTestTxn(t, kv)
+	testutils.RunTestLock(t, kv)
+	testutils.RunTestWatch(t, kv)
+}
+
+// go test -v -run TestCacheReadThrough github.com/beyondyyh/libs/kvstore/cache
+func TestCacheReadThrough(t *testing.T) {
+	assert := assert.New(t)
+	s := makeCountingStore(t)
+	kv := New(s, nil)
+	defer kv.Close()
+
+	assert.NoError(kv.Put("testCache/key", []byte("foo"), nil))
+	for i := 0; i < 3; i++ {
+		pair, err := kv.Get("testCache/key")
+		assert.NoError(err)
+		assert.Equal([]byte("foo"), pair.Value)
+		pair.Value[0] = 'x' // the cached value is not shared
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&s.gets))
+
+	// the missing keys are cached too
+	for i := 0; i < 3; i++ {
+		_, err := kv.Get("testCache/missing")
+		assert.Equal(store.ErrKeyNotFound, err)
+		exists, err := kv.Exists("testCache/missing")
+		assert.NoError(err)
+		assert.False(exists)
+	}
+	assert.Equal(int32(2), atomic.LoadInt32(&s.gets))
+
+	pairs, err := kv.List("testCache")
+	assert.NoError(err)
+	assert.Equal(1, len(pairs))
+	_, err = kv.List("testCache")
+	assert.NoError(err)
+	assert.Equal(int32(1), atomic.LoadInt32(&s.lists))
+
+	// the writes through the cache invalidate the key and the lists containing it
+	assert.NoError(kv.Put("testCache/other", []byte("bar"), nil))
+	pairs, err = kv.List("testCache")
+	assert.NoError(err)
+	assert.Equal(2, len(pairs))
+	assert.NoError(kv.Put("testCache/key", []byte("bar"), nil))
+	pair, err := kv.Get("testCache/key")
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), pair.Value)
+	assert.NoError(kv.DeleteTree("testCache"))
+	_, err = kv.Get("testCache/key")
+	assert.Equal(store.ErrKeyNotFound, err)
+	_, err = kv.List("testCache")
+	assert.Equal(store.ErrKeyNotFound, err)
+}
+
+// go test -v -run TestCacheTxn github.com/beyondyyh/libs/kvstore/cache
+func TestCacheTxn(t *testing.T) {
+	assert := assert.New(t)
+	kv := New(makeCountingStore(t), nil)
+	defer kv.Close()
+
+	assert.NoError(kv.Put("testCacheTxn/key", []byte("foo"), nil))
+	pair, err := kv.Get("testCacheTxn/key")
+	assert.NoError(err)
+	_, err = kv.List("testCacheTxn")
+	assert.NoError(err)
+
+	// the cached results of the written keys are dropped
+	_, err = kv.Txn([]*store.TxnOp{
+		store.CheckIndexOp("testCacheTxn/key", pair.LastIndex),
+		store.PutOp("testCacheTxn/key", []byte("bar"), nil),
+		store.PutOp("testCacheTxn/new", []byte("foo"), nil),
+	})
+	assert.NoError(err)
+	pair, err = kv.Get("testCacheTxn/key")
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), pair.Value)
+	pairs, err := kv.List("testCacheTxn")
+	assert.NoError(err)
+	assert.Equal(2, len(pairs))
+}
+
+// go test -v -run TestCacheWatchInvalidation github.com/beyondyyh/libs/kvstore/cache
+func TestCacheWatchInvalidation(t *testing.T) {
+	assert := assert.New(t)
+	s := makeCountingStore(t)
+	kv := New(s, &Options{Directories: []string{"testWatched"}, TTL: time.Second})
+	defer kv.Close()
+
+	assert.NoError(s.Put("testWatched/key", []byte("foo"), nil))
+	assert.NoError(s.Put("testUnwatched/key", []byte("foo"), nil))
+	time.Sleep(50 * time.Millisecond)
+	for _, key := range []string{"testWatched/key", "testUnwatched/key"} {
+		_, err := kv.Get(key)
+		assert.NoError(err)
+	}
+
+	// the writes of the other clients are pushed under the watched directories
+	assert.NoError(s.Put("testWatched/key", []byte("bar"), nil))
+	assert.NoError(s.Put("testUnwatched/key", []byte("bar"), nil))
+	assert.Eventually(func() bool {
+		pair, err := kv.Get("testWatched/key")
+		return err == nil && string(pair.Value) == "bar"
+	}, time.Second, 10*time.Millisecond)
+
+	// and seen once expired elsewhere
+	pair, err := kv.Get("testUnwatched/key")
+	assert.NoError(err)
+	assert.Equal([]byte("foo"), pair.Value)
+	time.Sleep(time.Second)
+	pair, err = kv.Get("testUnwatched/key")
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), pair.Value)
+}
+
+// go test -v -run TestCacheLRU github.com/beyondyyh/libs/kvstore/cache
+func TestCacheLRU(t *testing.T) {
+	assert := assert.New(t)
+	s := makeCountingStore(t)
+	kv := New(s, &Options{Size: 2})
+	defer kv.Close()
+
+	for _, key := range []string{"testLRU/a", "testLRU/b", "testLRU/a", "testLRU/c"} {
+		kv.Get(key)
+	}
+	assert.Equal(int32(3), atomic.LoadInt32(&s.gets))
+	assert.Equal(2, kv.lru.len())
+
+	// b is the least recently used, it's evicted by c
+	kv.Get("testLRU/a")
+	assert.Equal(int32(3), atomic.LoadInt32(&s.gets))
+	kv.Get("testLRU/b")
+	assert.Equal(int32(4), atomic.LoadInt32(&s.gets))
+}
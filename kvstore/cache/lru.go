@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"time"
+)
+
+// lru is a size bounded cache evicting the least recently used entries,
+// it's not safe for concurrent use
+type lru struct {
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type item struct {
+	key    string
+	value  interface{}
+	expire time.Time
+}
+
+func newLRU(size int) *lru {
+	return &lru{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// get returns the value of key unless it's missing or expired
+func (c *lru) get(key string, now time.Time) (interface{}, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	it := el.Value.(*item)
+	if !now.Before(it.expire) {
+		c.removeElement(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return it.value, true
+}
+
+// add sets the value of key until expire, the oldest entry is evicted once the cache is full
+func (c *lru) add(key string, value interface{}, expire time.Time) {
+	if el, ok := c.items[key]; ok {
+		it := el.Value.(*item)
+		it.value, it.expire = value, expire
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&item{key: key, value: value, expire: expire})
+	if c.ll.Len() > c.size {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *lru) remove(key string) {
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// removePrefix removes the keys starting with prefix
+func (c *lru) removePrefix(prefix string) {
+	for key, el := range c.items {
+		if strings.HasPrefix(key, prefix) {
+			c.removeElement(el)
+		}
+	}
+}
+
+func (c *lru) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*item).key)
+}
+
+func (c *lru) len() int {
+	return c.ll.Len()
+}
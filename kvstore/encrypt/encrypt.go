@@ -0,0 +1,323 @@
+// Package encrypt provides a client-side encryption wrapper around any store.Store
+package encrypt
+
+import (
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/openssl"
+)
+
+// An encrypted value is laid out as:
+//
+//     | version byte | key id length byte | key id | nonce | ciphertext and tag |
+//
+// The normalized key of the pair is the additional data of AES-GCM,
+// so a value can't be copied under another key without being rejected
+const version = 1
+
+var (
+	// ErrMalformedValue is returned when a value is not laid out by this package
+	ErrMalformedValue = errors.New("encrypt: malformed value")
+	// ErrDecrypt is returned when a value fails the authentication,
+	// it's been tampered with or moved from another key
+	ErrDecrypt = errors.New("encrypt: cannot decrypt value")
+)
+
+// UnknownKeyError is returned when a value is encrypted with a key which is not known
+type UnknownKeyError struct {
+	ID string
+}
+
+func (e *UnknownKeyError) Error() string {
+	return fmt.Sprintf("encrypt: unknown key id %q", e.ID)
+}
+
+// Key is an AES key, 16, 24 or 32 bytes long, identified by ID in the encrypted values
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Encrypted implements store.Store around another store, the values are encrypted with
+// the primary key before being written and decrypted with the key they name when read.
+// A key is rotated by creating the wrapper with the new primary key and the old ones,
+// then calling Rotate to rewrite the values.
+//
+// The values pushed by Watch and WatchTree which can't be decrypted are dropped
+type Encrypted struct {
+	store.Store
+	primary string
+	keys    map[string][]byte
+}
+
+// New creates the wrapper around s, the values are encrypted with primary
+// and decrypted with primary or any of others
+func New(s store.Store, primary Key, others ...Key) (*Encrypted, error) {
+	e := &Encrypted{
+		Store:   s,
+		primary: primary.ID,
+		keys:    make(map[string][]byte, 1+len(others)),
+	}
+	for _, key := range append([]Key{primary}, others...) {
+		if key.ID == "" || len(key.ID) > 255 {
+			return nil, fmt.Errorf("encrypt: invalid key id %q", key.ID)
+		}
+		if _, err := aes.NewCipher(key.Secret); err != nil {
+			return nil, fmt.Errorf("encrypt: key %q: %v", key.ID, err)
+		}
+		if _, ok := e.keys[key.ID]; ok {
+			return nil, fmt.Errorf("encrypt: duplicate key id %q", key.ID)
+		}
+		e.keys[key.ID] = key.Secret
+	}
+	return e, nil
+}
+
+// additionalData binds the ciphertext to the key of the pair whatever its form
+func additionalData(key string) []byte {
+	return []byte(strings.TrimLeft(store.Normalize(key), "/"))
+}
+
+// encrypt seals value with the primary key
+func (e *Encrypted) encrypt(key string, value []byte) ([]byte, error) {
+	sealed, err := openssl.AesGCMEncrypt(value, e.keys[e.primary], additionalData(key))
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, 2+len(e.primary)+len(sealed))
+	data = append(data, version, byte(len(e.primary)))
+	data = append(data, e.primary...)
+	return append(data, sealed...), nil
+}
+
+// keyID returns the id of the key which encrypted data
+func keyID(data []byte) (string, []byte, error) {
+	if len(data) < 2 || data[0] != version || len(data) < 2+int(data[1]) {
+		return "", nil, ErrMalformedValue
+	}
+	return string(data[2 : 2+data[1]]), data[2+data[1]:], nil
+}
+
+// decrypt opens data written under key
+func (e *Encrypted) decrypt(key string, data []byte) ([]byte, error) {
+	id, sealed, err := keyID(data)
+	if err != nil {
+		return nil, err
+	}
+	secret, ok := e.keys[id]
+	if !ok {
+		return nil, &UnknownKeyError{ID: id}
+	}
+	value, err := openssl.AesGCMDecrypt(sealed, secret, additionalData(key))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, nil
+}
+
+// decryptPair returns a copy of pair with the decrypted value
+func (e *Encrypted) decryptPair(pair *store.KVPair) (*store.KVPair, error) {
+	value, err := e.decrypt(pair.Key, pair.Value)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := *pair
+	decrypted.Value = value
+	return &decrypted, nil
+}
+
+// Put encrypts the value at the specified key
+func (e *Encrypted) Put(key string, value []byte, options *store.WriteOptions) error {
+	data, err := e.encrypt(key, value)
+	if err != nil {
+		return err
+	}
+	return e.Store.Put(key, data, options)
+}
+
+// Get decrypts the value of key
+func (e *Encrypted) Get(key string) (*store.KVPair, error) {
+	pair, err := e.Store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return e.decryptPair(pair)
+}
+
+// List decrypts the content of a given directory, it fails if any value can't be decrypted
+func (e *Encrypted) List(directory string) ([]*store.KVPair, error) {
+	pairs, err := e.Store.List(directory)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]*store.KVPair, 0, len(pairs))
+	for _, pair := range pairs {
+		pair, err := e.decryptPair(pair)
+		if err != nil {
+			return nil, err
+		}
+		decrypted = append(decrypted, pair)
+	}
+	return decrypted, nil
+}
+
+// Watch for changes on a key, the values which can't be decrypted are dropped
+func (e *Encrypted) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	watchCh, err := e.Store.Watch(key, stopCh)
+	if err != nil {
+		return nil, err
+	}
+
+	decryptedCh := make(chan *store.KVPair)
+	go func() {
+		defer close(decryptedCh)
+		for pair := range watchCh {
+			// the empty pair pushed on deletion has nothing to decrypt
+			if pair.Key != "" || len(pair.Value) != 0 {
+				var err error
+				if pair, err = e.decryptPair(pair); err != nil {
+					continue
+				}
+			}
+			select {
+			case decryptedCh <- pair:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return decryptedCh, nil
+}
+
+// WatchTree watches for changes on child nodes under a given directory,
+// the values which can't be decrypted are dropped from the pushed pairs
+func (e *Encrypted) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	watchCh, err := e.Store.WatchTree(directory, stopCh)
+	if err != nil {
+		return nil, err
+	}
+
+	decryptedCh := make(chan []*store.KVPair)
+	go func() {
+		defer close(decryptedCh)
+		for pairs := range watchCh {
+			decrypted := make([]*store.KVPair, 0, len(pairs))
+			for _, pair := range pairs {
+				if pair, err := e.decryptPair(pair); err == nil {
+					decrypted = append(decrypted, pair)
+				}
+			}
+			select {
+			case decryptedCh <- decrypted:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return decryptedCh, nil
+}
+
+// AtomicPut encrypts the value, it's a CAS operation on a single value,
+// pass previous = nil to create a new key
+func (e *Encrypted) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	data, err := e.encrypt(key, value)
+	if err != nil {
+		return false, nil, err
+	}
+	ok, pair, err := e.Store.AtomicPut(key, data, previous, options)
+	if pair != nil {
+		written := *pair
+		written.Value = append([]byte{}, value...)
+		pair = &written
+	}
+	return ok, pair, err
+}
+
+// Txn encrypts the values of the TxnPut ops and applies ops atomically, see store.Store.
+// The returned pairs hold the plain values
+func (e *Encrypted) Txn(ops []*store.TxnOp) ([]*store.KVPair, error) {
+	encrypted := make([]*store.TxnOp, len(ops))
+	for i, op := range ops {
+		o := *op
+		if op.Type == store.TxnPut {
+			data, err := e.encrypt(op.Key, op.Value)
+			if err != nil {
+				return nil, err
+			}
+			o.Value = data
+		}
+		encrypted[i] = &o
+	}
+
+	pairs, err := e.Store.Txn(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	for i, pair := range pairs {
+		if pair != nil {
+			written := *pair
+			written.Value = append([]byte{}, ops[i].Value...)
+			pairs[i] = &written
+		}
+	}
+	return pairs, nil
+}
+
+// NewLock creates a lock for a given key, the value of the lock is encrypted
+func (e *Encrypted) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	encrypted := store.LockOptions{}
+	if options != nil {
+		encrypted = *options
+	}
+	data, err := e.encrypt(key, encrypted.Value)
+	if err != nil {
+		return nil, err
+	}
+	encrypted.Value = data
+	return e.Store.NewLock(key, &encrypted)
+}
+
+// Rotate rewrites the values under directory which are not encrypted with the primary key,
+// it returns the number of rewritten values. The values modified meanwhile are left alone
+// since they are written with the primary key already, the TTLs are not kept
+func (e *Encrypted) Rotate(directory string) (int, error) {
+	pairs, err := e.Store.List(directory)
+	if err == store.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, pair := range pairs {
+		id, _, err := keyID(pair.Value)
+		if err != nil {
+			return rotated, err
+		}
+		if id == e.primary {
+			continue
+		}
+		value, err := e.decrypt(pair.Key, pair.Value)
+		if err != nil {
+			return rotated, err
+		}
+		_, _, err = e.AtomicPut(pair.Key, value, pair, nil)
+		if err == store.ErrKeyModified || err == store.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return rotated, err
+		}
+		rotated++
+	}
+	return rotated, nil
+}
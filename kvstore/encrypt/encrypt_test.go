@@ -0,0 +1,139 @@
+package encrypt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/store/memory"
+	"github.com/beyondyyh/libs/kvstore/testutils"
+)
+
+// run all: go test -v github.com/beyondyyh/libs/kvstore/encrypt
+
+var (
+	key1 = Key{ID: "k1", Secret: []byte("0123456789abcdef")}
+	key2 = Key{ID: "k2", Secret: []byte("0123456789abcdef0123456789abcdef")}
+)
+
+func makeMemoryClient(t *testing.T) store.Store {
+	kv, err := memory.New(nil, nil)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	return kv
+}
+
+// go test -v -run TestEncryptedStore github.com/beyondyyh/libs/kvstore/encrypt
+func TestEncryptedStore(t *testing.T) {
+	kv, err := New(makeMemoryClient(t), key1)
+	assert.NoError(t, err)
+	defer kv.Close()
+	defer testutils.RunCleanup(t, kv)
+
+	testutils.RunTestCommon(t, kv)
+	testutils.RunTestAtomic(t, kv)
+	testutils.RunTestTxn(t, kv)
+	testutils.RunTestLock(t, kv)
+	testutils.RunTestWatch(t, kv)
+}
+
+// go test -v -run TestEncryptedTxn github.com/beyondyyh/libs/kvstore/encrypt
+func TestEncryptedTxn(t *testing.T) {
+	assert := assert.New(t)
+	s := makeMemoryClient(t)
+	kv, err := New(s, key1)
+	assert.NoError(err)
+	defer kv.Close()
+
+	secret := []byte("my secret password")
+	pairs, err := kv.Txn([]*store.TxnOp{
+		store.CheckIndexOp("testSecretTxn", 0),
+		store.PutOp("testSecretTxn", secret, nil),
+	})
+	assert.NoError(err)
+	assert.Equal(secret, pairs[1].Value)
+
+	// the value of the put is encrypted at rest
+	raw, err := s.Get("testSecretTxn")
+	assert.NoError(err)
+	assert.False(bytes.Contains(raw.Value, secret))
+	pair, err := kv.Get("testSecretTxn")
+	assert.NoError(err)
+	assert.Equal(secret, pair.Value)
+}
+
+// go test -v -run TestEncryptedAtRest github.com/beyondyyh/libs/kvstore/encrypt
+func TestEncryptedAtRest(t *testing.T) {
+	assert := assert.New(t)
+	s := makeMemoryClient(t)
+	kv, err := New(s, key1)
+	assert.NoError(err)
+	defer kv.Close()
+
+	secret := []byte("my secret password")
+	assert.NoError(kv.Put("testSecret/a", secret, nil))
+
+	raw, err := s.Get("testSecret/a")
+	assert.NoError(err)
+	assert.False(bytes.Contains(raw.Value, secret))
+	id, _, err := keyID(raw.Value)
+	assert.NoError(err)
+	assert.Equal("k1", id)
+
+	// a value copied under another key is rejected
+	assert.NoError(s.Put("testSecret/b", raw.Value, nil))
+	_, err = kv.Get("testSecret/b")
+	assert.Equal(ErrDecrypt, err)
+	_, err = kv.List("testSecret")
+	assert.Equal(ErrDecrypt, err)
+
+	// so is a value which is not encrypted
+	assert.NoError(s.Put("testSecret/c", secret, nil))
+	_, err = kv.Get("testSecret/c")
+	assert.Equal(ErrMalformedValue, err)
+
+	_, err = New(s, Key{ID: "short", Secret: []byte("123")})
+	assert.Error(err)
+	_, err = New(s, key1, key1)
+	assert.Error(err)
+}
+
+// go test -v -run TestEncryptedRotate github.com/beyondyyh/libs/kvstore/encrypt
+func TestEncryptedRotate(t *testing.T) {
+	assert := assert.New(t)
+	s := makeMemoryClient(t)
+	defer s.Close()
+
+	old, err := New(s, key1)
+	assert.NoError(err)
+	assert.NoError(old.Put("testRotate/a", []byte("a"), nil))
+	assert.NoError(old.Put("testRotate/b", []byte("b"), nil))
+
+	// the new primary key writes, the old one still reads
+	rotating, err := New(s, key2, key1)
+	assert.NoError(err)
+	assert.NoError(rotating.Put("testRotate/c", []byte("c"), nil))
+	pairs, err := rotating.List("testRotate")
+	assert.NoError(err)
+	assert.Equal(3, len(pairs))
+
+	rotated, err := rotating.Rotate("testRotate")
+	assert.NoError(err)
+	assert.Equal(2, rotated)
+	rotated, err = rotating.Rotate("testRotate")
+	assert.NoError(err)
+	assert.Equal(0, rotated)
+
+	// the old key can be dropped once every value is rotated
+	current, err := New(s, key2)
+	assert.NoError(err)
+	pair, err := current.Get("testRotate/a")
+	assert.NoError(err)
+	assert.Equal([]byte("a"), pair.Value)
+
+	_, err = old.Get("testRotate/a")
+	assert.Equal(&UnknownKeyError{ID: "k2"}, err)
+}
@@ -38,6 +38,16 @@ func NewStore(backend store.Backend, addrs []string, config *store.Config) (stor
 	return nil, fmt.Errorf("%s %s", store.ErrBackendNotSupported.Error(), supportedBackend)
 }
 
+// NewContextStore 创建一个context-aware的store实例，
+// 不支持context的后端仅在每次调用前检查ctx
+func NewContextStore(backend store.Backend, addrs []string, config *store.Config) (store.ContextStore, error) {
+	s, err := NewStore(backend, addrs, config)
+	if err != nil {
+		return nil, err
+	}
+	return store.WithContext(s), nil
+}
+
 // AddStore adds a new store backend to kvstore
 func AddStore(backend store.Backend, init Initialize) {
 	initializers[backend] = init
@@ -0,0 +1,160 @@
+package leadership
+
+import (
+	"sync"
+	"time"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// Candidate runs the leader election algorithm asynchronously
+// by holding a lock on key through any store.Store
+type Candidate struct {
+	sync.Mutex
+	client  store.Store
+	key     string
+	node    string
+	lockTTL time.Duration
+
+	leader    bool
+	electedCh chan bool
+	errCh     chan error
+	resignCh  chan struct{}
+	stopCh    chan struct{}
+	stopOnce  sync.Once
+	runOnce   sync.Once
+}
+
+// NewCandidate creates a new Candidate campaigning for key,
+// node is the value stored at key while the candidate is the leader
+// and ttl is the ttl of the underlying lock, 0 means the backend default
+func NewCandidate(client store.Store, key, node string, ttl time.Duration) *Candidate {
+	return &Candidate{
+		client:    client,
+		key:       key,
+		node:      node,
+		lockTTL:   ttl,
+		electedCh: make(chan bool),
+		errCh:     make(chan error, 1),
+		resignCh:  make(chan struct{}),
+		stopCh:    make(chan struct{}),
+	}
+}
+
+// IsLeader returns true if the candidate is currently a leader
+func (c *Candidate) IsLeader() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.leader
+}
+
+// ElectedCh delivers signals on acquiring or losing leadership,
+// it sends true if we become the leader, and false if we lose it.
+// The channel is closed once the candidate stops campaigning
+func (c *Candidate) ElectedCh() <-chan bool {
+	return c.electedCh
+}
+
+// ErrCh delivers the error which stopped the campaign,
+// it is closed once the candidate stops campaigning
+func (c *Candidate) ErrCh() <-chan error {
+	return c.errCh
+}
+
+// RunForElection starts the leader election algorithm,
+// updates in status are pushed through ElectedCh
+func (c *Candidate) RunForElection() {
+	c.runOnce.Do(func() {
+		go c.campaign()
+	})
+}
+
+// Stop running for election, the leadership is given up if held
+func (c *Candidate) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopCh)
+	})
+}
+
+// Resign forces the candidate to step-down and try again.
+// If the candidate is not a leader, it doesn't have any effect.
+// Candidate will retry immediately to acquire the leadership. If no-one else
+// took it, then the Candidate will end up being a leader again.
+func (c *Candidate) Resign() {
+	if !c.IsLeader() {
+		return
+	}
+	select {
+	case c.resignCh <- struct{}{}:
+	case <-c.stopCh:
+	}
+}
+
+// update records the status and pushes it, returns false if stopped
+func (c *Candidate) update(status bool) bool {
+	c.Lock()
+	c.leader = status
+	c.Unlock()
+
+	select {
+	case c.electedCh <- status:
+		return true
+	case <-c.stopCh:
+		return false
+	}
+}
+
+func (c *Candidate) campaign() {
+	defer close(c.electedCh)
+	defer close(c.errCh)
+
+	lock, err := c.client.NewLock(c.key, &store.LockOptions{
+		Value: []byte(c.node),
+		TTL:   c.lockTTL,
+	})
+	if err != nil {
+		c.errCh <- err
+		return
+	}
+
+	for {
+		// Start as a follower
+		if !c.update(false) {
+			return
+		}
+
+		lostCh, err := lock.Lock(c.stopCh)
+		if err != nil {
+			c.errCh <- err
+			return
+		}
+		// Stopped while waiting for the lock
+		if lostCh == nil {
+			return
+		}
+
+		// Hooray! We acquired the lock therefore we are the new leader
+		if !c.update(true) {
+			lock.Unlock()
+			return
+		}
+
+		select {
+		case <-c.resignCh:
+			// We were asked to resign, give up the lock and go back campaigning
+			lock.Unlock()
+		case <-c.stopCh:
+			// Give up the leadership and quit
+			lock.Unlock()
+			c.Lock()
+			c.leader = false
+			c.Unlock()
+			return
+		case <-lostCh:
+			// We lost the lock. Someone else is the leader, try again.
+			// Unlock resets the locker so that it can be acquired again
+			lock.Unlock()
+		}
+	}
+}
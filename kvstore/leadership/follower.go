@@ -0,0 +1,111 @@
+package leadership
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// ErrWatchClosed is thrown when the watch on the leader key is closed by the store
+var ErrWatchClosed = errors.New("leadership: watch leader channel closed, the store may be unavailable")
+
+// Follower can follow an election in real-time and push notifications
+// whenever there is a change in leadership
+type Follower struct {
+	sync.Mutex
+	client store.Store
+	key    string
+
+	leader   string
+	leaderCh chan string
+	errCh    chan error
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	runOnce  sync.Once
+}
+
+// NewFollower creates a new follower watching key
+func NewFollower(client store.Store, key string) *Follower {
+	return &Follower{
+		client:   client,
+		key:      key,
+		leaderCh: make(chan string),
+		errCh:    make(chan error, 1),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+// Leader returns the current leader, empty if there is no leader
+func (f *Follower) Leader() string {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.leader
+}
+
+// LeaderCh delivers the new leader whenever the leadership changes,
+// an empty string means there is no leader at the moment
+func (f *Follower) LeaderCh() <-chan string {
+	return f.leaderCh
+}
+
+// ErrCh delivers the error which stopped the follower,
+// it is closed once the follower stops
+func (f *Follower) ErrCh() <-chan error {
+	return f.errCh
+}
+
+// FollowElection starts monitoring the election,
+// changes are pushed through LeaderCh
+func (f *Follower) FollowElection() {
+	f.runOnce.Do(func() {
+		go f.follow()
+	})
+}
+
+// Stop stops monitoring an election
+func (f *Follower) Stop() {
+	f.stopOnce.Do(func() {
+		close(f.stopCh)
+	})
+}
+
+func (f *Follower) follow() {
+	defer close(f.leaderCh)
+	defer close(f.errCh)
+
+	ch, err := f.client.Watch(f.key, f.stopCh)
+	if err != nil {
+		f.errCh <- err
+		return
+	}
+
+	for kv := range ch {
+		if kv == nil {
+			continue
+		}
+
+		curr := string(kv.Value)
+		f.Lock()
+		changed := curr != f.leader
+		f.leader = curr
+		f.Unlock()
+		if !changed {
+			continue
+		}
+
+		select {
+		case f.leaderCh <- curr:
+		case <-f.stopCh:
+			return
+		}
+	}
+
+	// Channel closed while not stopped, the store may be unreachable
+	select {
+	case <-f.stopCh:
+	default:
+		f.errCh <- ErrWatchClosed
+	}
+}
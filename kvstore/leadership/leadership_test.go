@@ -0,0 +1,86 @@
+package leadership
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore/store/memory"
+)
+
+// run all: go test -v github.com/beyondyyh/libs/kvstore/leadership
+
+func waitElected(t *testing.T, ch <-chan bool, want bool) {
+	t.Helper()
+	select {
+	case elected := <-ch:
+		assert.Equal(t, want, elected)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout reached")
+	}
+}
+
+func waitLeader(t *testing.T, ch <-chan string, want string) {
+	t.Helper()
+	select {
+	case leader := <-ch:
+		assert.Equal(t, want, leader)
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout reached")
+	}
+}
+
+// go test -v -run TestCandidate github.com/beyondyyh/libs/kvstore/leadership
+func TestCandidate(t *testing.T) {
+	assert := assert.New(t)
+	kv, _ := memory.New(nil, nil)
+	defer kv.Close()
+
+	key := "service/scheduler/leader"
+	candidate1 := NewCandidate(kv, key, "node1", time.Second)
+	candidate2 := NewCandidate(kv, key, "node2", time.Second)
+
+	follower := NewFollower(kv, key)
+	follower.FollowElection()
+	defer follower.Stop()
+
+	// candidate1 starts as a follower then gets elected
+	candidate1.RunForElection()
+	waitElected(t, candidate1.ElectedCh(), false)
+	waitElected(t, candidate1.ElectedCh(), true)
+	assert.True(candidate1.IsLeader())
+	waitLeader(t, follower.LeaderCh(), "node1")
+	assert.Equal("node1", follower.Leader())
+
+	// candidate1 resigns, no one else is running so it's elected again
+	go candidate1.Resign()
+	waitElected(t, candidate1.ElectedCh(), false)
+	waitElected(t, candidate1.ElectedCh(), true)
+
+	// candidate2 can't be elected while candidate1 is the leader
+	candidate2.RunForElection()
+	waitElected(t, candidate2.ElectedCh(), false)
+	assert.False(candidate2.IsLeader())
+
+	// once candidate1 stops, candidate2 takes over
+	candidate1.Stop()
+	waitElected(t, candidate2.ElectedCh(), true)
+	assert.True(candidate2.IsLeader())
+	assert.False(candidate1.IsLeader())
+	_, ok := <-candidate1.ElectedCh()
+	assert.False(ok)
+	_, ok = <-candidate1.ErrCh()
+	assert.False(ok)
+
+	// the follower may skip the transient empty leader
+	for leader := follower.Leader(); leader != "node2"; {
+		select {
+		case leader = <-follower.LeaderCh():
+		case <-time.After(3 * time.Second):
+			t.Fatal("Timeout reached")
+		}
+	}
+
+	candidate2.Stop()
+}
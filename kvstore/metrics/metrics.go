@@ -0,0 +1,394 @@
+// Package metrics provides an instrumented store.Store decorator
+package metrics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// operation names
+const (
+	OpPut          = "put"
+	OpGet          = "get"
+	OpDelete       = "delete"
+	OpExists       = "exists"
+	OpWatch        = "watch"
+	OpWatchTree    = "watch_tree"
+	OpList         = "list"
+	OpListPage     = "list_page"
+	OpWatchEvents  = "watch_events"
+	OpDeleteTree   = "delete_tree"
+	OpAtomicPut    = "atomic_put"
+	OpAtomicDelete = "atomic_delete"
+	OpNewLock      = "new_lock"
+	OpLock         = "lock"
+	OpUnlock       = "unlock"
+	OpGetMany      = "get_many"
+	OpPutMany      = "put_many"
+	OpDeleteMany   = "delete_many"
+	OpTxn          = "txn"
+)
+
+// Recorder receives the measures of the operations, it's implemented by Registry
+// and may be implemented on top of any metrics library
+type Recorder interface {
+	// ObserveOperation records an operation which took duration,
+	// kind is "" on success, see ErrorKind
+	ObserveOperation(backend, op string, duration time.Duration, kind string)
+	// AddWatches adds delta to the number of active watches
+	AddWatches(backend, op string, delta int)
+}
+
+// SpanHook is called when an operation starts, the returned function,
+// if not nil, is called with the error of the operation once it ends
+type SpanHook func(op, key string) func(err error)
+
+// Options of an Instrumented store
+type Options struct {
+	// Backend is the value of the backend label, such as "consul" or "redis"
+	Backend string
+	// Recorder receives the measures, DefaultRegistry by default
+	Recorder Recorder
+	// Span is called around every operation, nil to disable
+	Span SpanHook
+}
+
+// ErrorKind returns the label of err, the sentinel errors of store have their own
+// kind and the others are "other". It's "" for nil
+func ErrorKind(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, store.ErrKeyNotFound):
+		return "key_not_found"
+	case errors.Is(err, store.ErrKeyModified):
+		return "key_modified"
+	case errors.Is(err, store.ErrKeyExists):
+		return "key_exists"
+	case errors.Is(err, store.ErrPreviousNotSpecified):
+		return "previous_not_specified"
+	case errors.Is(err, store.ErrNotReachable):
+		return "not_reachable"
+	case errors.Is(err, store.ErrCannotLock):
+		return "cannot_lock"
+	case errors.Is(err, store.ErrLockNotHeld):
+		return "lock_not_held"
+	case errors.Is(err, store.ErrCallNotSupported):
+		return "call_not_supported"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline_exceeded"
+	}
+	return "other"
+}
+
+// Instrumented implements store.Store around another store, recording the latency
+// and the errors of every operation and the number of active watches.
+//
+// The optional interfaces of the store package are implemented on top of the ones of the
+// wrapped store: ListPage and the batches fall back like their store helpers, the others
+// return store.ErrCallNotSupported when the wrapped store does not implement them.
+// The batches and the transactions are observed once with their first key
+type Instrumented struct {
+	store.Store
+	backend  string
+	recorder Recorder
+	span     SpanHook
+}
+
+var (
+	_ store.ListPager    = (*Instrumented)(nil)
+	_ store.ErrorWatcher = (*Instrumented)(nil)
+	_ store.EventWatcher = (*Instrumented)(nil)
+	_ store.TreeDeleter  = (*Instrumented)(nil)
+	_ store.BatchStore   = (*Instrumented)(nil)
+)
+
+// New creates the decorator around s
+func New(s store.Store, options *Options) *Instrumented {
+	if options == nil {
+		options = &Options{}
+	}
+	recorder := options.Recorder
+	if recorder == nil {
+		recorder = DefaultRegistry
+	}
+	return &Instrumented{
+		Store:    s,
+		backend:  options.Backend,
+		recorder: recorder,
+		span:     options.Span,
+	}
+}
+
+// observe starts measuring op, the returned function records its outcome
+func (m *Instrumented) observe(op, key string) func(err error) {
+	var end func(error)
+	if m.span != nil {
+		end = m.span(op, key)
+	}
+	start := time.Now()
+	return func(err error) {
+		m.recorder.ObserveOperation(m.backend, op, time.Since(start), ErrorKind(err))
+		if end != nil {
+			end(err)
+		}
+	}
+}
+
+func (m *Instrumented) Put(key string, value []byte, options *store.WriteOptions) (err error) {
+	done := m.observe(OpPut, key)
+	defer func() { done(err) }()
+	return m.Store.Put(key, value, options)
+}
+
+func (m *Instrumented) Get(key string) (pair *store.KVPair, err error) {
+	done := m.observe(OpGet, key)
+	defer func() { done(err) }()
+	return m.Store.Get(key)
+}
+
+func (m *Instrumented) Delete(key string) (err error) {
+	done := m.observe(OpDelete, key)
+	defer func() { done(err) }()
+	return m.Store.Delete(key)
+}
+
+func (m *Instrumented) Exists(key string) (ok bool, err error) {
+	done := m.observe(OpExists, key)
+	defer func() { done(err) }()
+	return m.Store.Exists(key)
+}
+
+func (m *Instrumented) List(directory string) (pairs []*store.KVPair, err error) {
+	done := m.observe(OpList, directory)
+	defer func() { done(err) }()
+	return m.Store.List(directory)
+}
+
+// ListPage lists a page of directory, see store.ListPage
+func (m *Instrumented) ListPage(directory, cursor string, limit int) (pairs []*store.KVPair, next string, err error) {
+	done := m.observe(OpListPage, directory)
+	defer func() { done(err) }()
+	return store.ListPage(m.Store, directory, cursor, limit)
+}
+
+func (m *Instrumented) DeleteTree(directory string) (err error) {
+	done := m.observe(OpDeleteTree, directory)
+	defer func() { done(err) }()
+	return m.Store.DeleteTree(directory)
+}
+
+func (m *Instrumented) DeleteTreeWithOptions(directory string, options *store.DeleteTreeOptions) (n int, err error) {
+	d, ok := m.Store.(store.TreeDeleter)
+	if !ok {
+		return 0, store.ErrCallNotSupported
+	}
+	done := m.observe(OpDeleteTree, directory)
+	defer func() { done(err) }()
+	return d.DeleteTreeWithOptions(directory, options)
+}
+
+// Txn applies ops atomically, see store.Store
+func (m *Instrumented) Txn(ops []*store.TxnOp) (pairs []*store.KVPair, err error) {
+	key := ""
+	if len(ops) > 0 {
+		key = ops[0].Key
+	}
+	done := m.observe(OpTxn, key)
+	defer func() { done(err) }()
+	return m.Store.Txn(ops)
+}
+
+func (m *Instrumented) GetMany(keys []string) (results []*store.KeyResult, err error) {
+	done := m.observe(OpGetMany, firstKey(keys))
+	defer func() { done(err) }()
+	return store.GetMany(m.Store, keys)
+}
+
+func (m *Instrumented) PutMany(pairs []*store.KVPair, options *store.WriteOptions) (results []*store.KeyResult, err error) {
+	key := ""
+	if len(pairs) > 0 {
+		key = pairs[0].Key
+	}
+	done := m.observe(OpPutMany, key)
+	defer func() { done(err) }()
+	return store.PutMany(m.Store, pairs, options)
+}
+
+func (m *Instrumented) DeleteMany(keys []string) (results []*store.KeyResult, err error) {
+	done := m.observe(OpDeleteMany, firstKey(keys))
+	defer func() { done(err) }()
+	return store.DeleteMany(m.Store, keys)
+}
+
+func firstKey(keys []string) string {
+	if len(keys) == 0 {
+		return ""
+	}
+	return keys[0]
+}
+
+func (m *Instrumented) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (ok bool, pair *store.KVPair, err error) {
+	done := m.observe(OpAtomicPut, key)
+	defer func() { done(err) }()
+	return m.Store.AtomicPut(key, value, previous, options)
+}
+
+func (m *Instrumented) AtomicDelete(key string, previous *store.KVPair) (ok bool, err error) {
+	done := m.observe(OpAtomicDelete, key)
+	defer func() { done(err) }()
+	return m.Store.AtomicDelete(key, previous)
+}
+
+// Watch for changes on a key, the watch is active until its channel is closed
+func (m *Instrumented) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	done := m.observe(OpWatch, key)
+	watchCh, err := m.Store.Watch(key, stopCh)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+	return m.forwardWatch(watchCh, stopCh), nil
+}
+
+// WatchWithErrors watches for changes on a key, the watch is active until its channel is closed
+func (m *Instrumented) WatchWithErrors(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, <-chan error, error) {
+	w, ok := m.Store.(store.ErrorWatcher)
+	if !ok {
+		return nil, nil, store.ErrCallNotSupported
+	}
+	done := m.observe(OpWatch, key)
+	watchCh, errCh, err := w.WatchWithErrors(key, stopCh)
+	done(err)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m.forwardWatch(watchCh, stopCh), errCh, nil
+}
+
+// forwardWatch counts the watch as active until watchCh is closed or stopCh is closed
+func (m *Instrumented) forwardWatch(watchCh <-chan *store.KVPair, stopCh <-chan struct{}) <-chan *store.KVPair {
+	m.recorder.AddWatches(m.backend, OpWatch, 1)
+	forwardCh := make(chan *store.KVPair)
+	go func() {
+		defer m.recorder.AddWatches(m.backend, OpWatch, -1)
+		defer close(forwardCh)
+		for pair := range watchCh {
+			select {
+			case forwardCh <- pair:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return forwardCh
+}
+
+// WatchTree watches for changes on child nodes under a given directory,
+// the watch is active until its channel is closed
+func (m *Instrumented) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	done := m.observe(OpWatchTree, directory)
+	watchCh, err := m.Store.WatchTree(directory, stopCh)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+	return m.forwardWatchTree(watchCh, stopCh), nil
+}
+
+// WatchTreeWithErrors watches for changes on child nodes under a given directory,
+// the watch is active until its channel is closed
+func (m *Instrumented) WatchTreeWithErrors(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, <-chan error, error) {
+	w, ok := m.Store.(store.ErrorWatcher)
+	if !ok {
+		return nil, nil, store.ErrCallNotSupported
+	}
+	done := m.observe(OpWatchTree, directory)
+	watchCh, errCh, err := w.WatchTreeWithErrors(directory, stopCh)
+	done(err)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m.forwardWatchTree(watchCh, stopCh), errCh, nil
+}
+
+func (m *Instrumented) forwardWatchTree(watchCh <-chan []*store.KVPair, stopCh <-chan struct{}) <-chan []*store.KVPair {
+	m.recorder.AddWatches(m.backend, OpWatchTree, 1)
+	forwardCh := make(chan []*store.KVPair)
+	go func() {
+		defer m.recorder.AddWatches(m.backend, OpWatchTree, -1)
+		defer close(forwardCh)
+		for pairs := range watchCh {
+			select {
+			case forwardCh <- pairs:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return forwardCh
+}
+
+// WatchEvents watches for changes on child nodes under a given directory,
+// the watch is active until its channel is closed
+func (m *Instrumented) WatchEvents(directory string, stopCh <-chan struct{}) (<-chan *store.Event, error) {
+	w, ok := m.Store.(store.EventWatcher)
+	if !ok {
+		return nil, store.ErrCallNotSupported
+	}
+	done := m.observe(OpWatchEvents, directory)
+	eventCh, err := w.WatchEvents(directory, stopCh)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+
+	m.recorder.AddWatches(m.backend, OpWatchEvents, 1)
+	forwardCh := make(chan *store.Event)
+	go func() {
+		defer m.recorder.AddWatches(m.backend, OpWatchEvents, -1)
+		defer close(forwardCh)
+		for event := range eventCh {
+			select {
+			case forwardCh <- event:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return forwardCh, nil
+}
+
+// NewLock creates a lock for a given key, Lock and Unlock are instrumented as well
+func (m *Instrumented) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	done := m.observe(OpNewLock, key)
+	locker, err := m.Store.NewLock(key, options)
+	done(err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedLock{Locker: locker, m: m, key: key}, nil
+}
+
+type instrumentedLock struct {
+	store.Locker
+	m   *Instrumented
+	key string
+}
+
+func (l *instrumentedLock) Lock(stopCh <-chan struct{}) (lockCh <-chan struct{}, err error) {
+	done := l.m.observe(OpLock, l.key)
+	defer func() { done(err) }()
+	return l.Locker.Lock(stopCh)
+}
+
+func (l *instrumentedLock) Unlock() (err error) {
+	done := l.m.observe(OpUnlock, l.key)
+	defer func() { done(err) }()
+	return l.Locker.Unlock()
+}
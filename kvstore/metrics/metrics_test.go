@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/store/memory"
+	"github.com/beyondyyh/libs/kvstore/testutils"
+)
+
+// run all: go test -v github.com/beyondyyh/libs/kvstore/metrics
+
+func makeMemoryClient(t *testing.T) store.Store {
+	kv, err := memory.New(nil, nil)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	return kv
+}
+
+// go test -v -run TestInstrumentedStore github.com/beyondyyh/libs/kvstore/metrics
+func TestInstrumentedStore(t *testing.T) {
+	registry := NewRegistry(nil)
+	kv := New(makeMemoryClient(t), &Options{Backend: "memory", Recorder: registry})
+	defer kv.Close()
+	defer testutils.RunCleanup(t, kv)
+
+	testutils.RunTestCommon(t, kv)
+	testutils.RunTestAtomic(t, kv)
+	testutils.RunTestTxn(t, kv)
+	testutils.RunTestBatch(t, kv)
+	testutils.RunTestLock(t, kv)
+	testutils.RunTestWatch(t, kv)
+	testutils.RunTestWatchEvents(t, kv)
+
+	assert := assert.New(t)
+	for _, op := range []string{OpPut, OpGet, OpDelete, OpList, OpListPage, OpAtomicPut, OpAtomicDelete, OpLock, OpUnlock,
+		OpWatch, OpWatchEvents, OpGetMany, OpPutMany, OpDeleteMany, OpTxn} {
+		assert.True(registry.Count("memory", op) > 0, op)
+	}
+	assert.True(registry.Errors("memory", OpGet, "key_not_found") > 0)
+	assert.True(registry.Errors("memory", OpAtomicPut, "key_exists") > 0)
+}
+
+// go test -v -run TestInstrumentedWatchesAndSpans github.com/beyondyyh/libs/kvstore/metrics
+func TestInstrumentedWatchesAndSpans(t *testing.T) {
+	assert := assert.New(t)
+	registry := NewRegistry(nil)
+
+	var spans []string
+	kv := New(makeMemoryClient(t), &Options{
+		Backend:  "memory",
+		Recorder: registry,
+		Span: func(op, key string) func(error) {
+			return func(err error) {
+				spans = append(spans, fmt.Sprintf("%s %s %s", op, key, ErrorKind(err)))
+			}
+		},
+	})
+	defer kv.Close()
+
+	assert.NoError(kv.Put("testSpan", []byte("foo"), nil))
+	_, err := kv.Get("testSpan/missing")
+	assert.Equal(store.ErrKeyNotFound, err)
+	assert.Equal([]string{"put testSpan ", "get testSpan/missing key_not_found"}, spans)
+
+	stopCh := make(chan struct{})
+	_, err = kv.WatchTree("testSpan", stopCh)
+	assert.NoError(err)
+	assert.Equal(1, registry.Watches("memory", OpWatchTree))
+
+	close(stopCh)
+	assert.Eventually(func() bool {
+		return registry.Watches("memory", OpWatchTree) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// noTxnStore is a backend without transactions
+type noTxnStore struct {
+	store.Store
+}
+
+func (noTxnStore) Txn(ops []*store.TxnOp) ([]*store.KVPair, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+// go test -v -run TestInstrumentedOptional github.com/beyondyyh/libs/kvstore/metrics
+func TestInstrumentedOptional(t *testing.T) {
+	assert := assert.New(t)
+	registry := NewRegistry(nil)
+	kv := New(makeMemoryClient(t), &Options{Backend: "memory", Recorder: registry})
+	defer kv.Close()
+
+	// the memory store has neither error watches nor DeleteTreeWithOptions
+	_, _, err := kv.WatchWithErrors("testOptional", nil)
+	assert.Equal(store.ErrCallNotSupported, err)
+	_, _, err = kv.WatchTreeWithErrors("testOptional", nil)
+	assert.Equal(store.ErrCallNotSupported, err)
+	_, err = kv.DeleteTreeWithOptions("testOptional", nil)
+	assert.Equal(store.ErrCallNotSupported, err)
+
+	// the transactions of a store without them are measured as failed
+	noTxn := New(noTxnStore{makeMemoryClient(t)}, &Options{Backend: "noTxn", Recorder: registry})
+	_, err = noTxn.Txn([]*store.TxnOp{store.DeleteOp("testOptional")})
+	assert.Equal(store.ErrCallNotSupported, err)
+	assert.Equal(uint64(1), registry.Errors("noTxn", OpTxn, "call_not_supported"))
+
+	// the watches of events are counted while active
+	stopCh := make(chan struct{})
+	_, err = kv.WatchEvents("testOptional", stopCh)
+	assert.NoError(err)
+	assert.Equal(1, registry.Watches("memory", OpWatchEvents))
+	close(stopCh)
+	assert.Eventually(func() bool {
+		return registry.Watches("memory", OpWatchEvents) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// go test -v -run TestRegistryPrometheus github.com/beyondyyh/libs/kvstore/metrics
+func TestRegistryPrometheus(t *testing.T) {
+	registry := NewRegistry([]float64{0.01, 0.1})
+	registry.ObserveOperation("consul", OpGet, 5*time.Millisecond, "")
+	registry.ObserveOperation("consul", OpGet, 50*time.Millisecond, "key_not_found")
+	registry.ObserveOperation("consul", OpGet, time.Second, "not_reachable")
+	registry.ObserveOperation("redis", OpPut, time.Millisecond, "")
+	registry.AddWatches("redis", OpWatch, 2)
+	registry.AddWatches("redis", OpWatch, -1)
+	registry.AddWatches("re\"dis", OpWatch, 1)
+
+	var buf bytes.Buffer
+	assert.NoError(t, registry.WritePrometheus(&buf))
+	assert.Equal(t, `# HELP kvstore_operation_duration_seconds Latency of the kvstore operations.
+# TYPE kvstore_operation_duration_seconds histogram
+kvstore_operation_duration_seconds_bucket{backend="consul",op="get",le="0.01"} 1
+kvstore_operation_duration_seconds_bucket{backend="consul",op="get",le="0.1"} 2
+kvstore_operation_duration_seconds_bucket{backend="consul",op="get",le="+Inf"} 3
+kvstore_operation_duration_seconds_sum{backend="consul",op="get"} 1.055
+kvstore_operation_duration_seconds_count{backend="consul",op="get"} 3
+kvstore_operation_duration_seconds_bucket{backend="redis",op="put",le="0.01"} 1
+kvstore_operation_duration_seconds_bucket{backend="redis",op="put",le="0.1"} 1
+kvstore_operation_duration_seconds_bucket{backend="redis",op="put",le="+Inf"} 1
+kvstore_operation_duration_seconds_sum{backend="redis",op="put"} 0.001
+kvstore_operation_duration_seconds_count{backend="redis",op="put"} 1
+# HELP kvstore_operation_errors_total Errors of the kvstore operations by kind.
+# TYPE kvstore_operation_errors_total counter
+kvstore_operation_errors_total{backend="consul",op="get",error="key_not_found"} 1
+kvstore_operation_errors_total{backend="consul",op="get",error="not_reachable"} 1
+# HELP kvstore_active_watches Active kvstore watches.
+# TYPE kvstore_active_watches gauge
+kvstore_active_watches{backend="re\"dis",op="watch"} 1
+kvstore_active_watches{backend="redis",op="watch"} 1
+`, buf.String())
+}
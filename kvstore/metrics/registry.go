@@ -0,0 +1,217 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the latency histograms
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultRegistry is the Recorder of the stores instrumented without one
+var DefaultRegistry = NewRegistry(nil)
+
+// metric names of the Prometheus exposition
+const (
+	durationMetric = "kvstore_operation_duration_seconds"
+	errorsMetric   = "kvstore_operation_errors_total"
+	watchesMetric  = "kvstore_active_watches"
+)
+
+// Registry is a Recorder keeping the measures in memory,
+// it's exported in the Prometheus text format by WritePrometheus or ServeHTTP
+type Registry struct {
+	mu        sync.Mutex
+	buckets   []float64
+	durations map[opLabels]*histogram
+	errors    map[errorLabels]uint64
+	watches   map[opLabels]int
+}
+
+type opLabels struct {
+	backend, op string
+}
+
+type errorLabels struct {
+	backend, op, kind string
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+var _ Recorder = (*Registry)(nil)
+
+// NewRegistry creates a registry whose histograms have the given buckets, DefaultBuckets if nil
+func NewRegistry(buckets []float64) *Registry {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	return &Registry{
+		buckets:   sorted,
+		durations: make(map[opLabels]*histogram),
+		errors:    make(map[errorLabels]uint64),
+		watches:   make(map[opLabels]int),
+	}
+}
+
+// ObserveOperation implements Recorder
+func (r *Registry) ObserveOperation(backend, op string, duration time.Duration, kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	labels := opLabels{backend, op}
+	h, ok := r.durations[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(r.buckets))}
+		r.durations[labels] = h
+	}
+	seconds := duration.Seconds()
+	if i := sort.SearchFloat64s(r.buckets, seconds); i < len(r.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += seconds
+
+	if kind != "" {
+		r.errors[errorLabels{backend, op, kind}]++
+	}
+}
+
+// AddWatches implements Recorder
+func (r *Registry) AddWatches(backend, op string, delta int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.watches[opLabels{backend, op}] += delta
+}
+
+// Errors returns the number of errors of the given kind
+func (r *Registry) Errors(backend, op, kind string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.errors[errorLabels{backend, op, kind}]
+}
+
+// Watches returns the number of active watches
+func (r *Registry) Watches(backend, op string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.watches[opLabels{backend, op}]
+}
+
+// Count returns the number of operations recorded
+func (r *Registry) Count(backend, op string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if h, ok := r.durations[opLabels{backend, op}]; ok {
+		return h.count
+	}
+	return 0
+}
+
+// WritePrometheus writes the measures in the Prometheus text exposition format
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "# HELP %s Latency of the kvstore operations.\n", durationMetric)
+	fmt.Fprintf(bw, "# TYPE %s histogram\n", durationMetric)
+	durations := make([]opLabels, 0, len(r.durations))
+	for labels := range r.durations {
+		durations = append(durations, labels)
+	}
+	sortOpLabels(durations)
+	for _, labels := range durations {
+		h := r.durations[labels]
+		base := formatLabels("backend", labels.backend, "op", labels.op)
+		var cumulative uint64
+		for i, bound := range r.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(bw, "%s_bucket{%s,le=\"%s\"} %d\n", durationMetric, base, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(bw, "%s_bucket{%s,le=\"+Inf\"} %d\n", durationMetric, base, h.count)
+		fmt.Fprintf(bw, "%s_sum{%s} %s\n", durationMetric, base, formatFloat(h.sum))
+		fmt.Fprintf(bw, "%s_count{%s} %d\n", durationMetric, base, h.count)
+	}
+
+	fmt.Fprintf(bw, "# HELP %s Errors of the kvstore operations by kind.\n", errorsMetric)
+	fmt.Fprintf(bw, "# TYPE %s counter\n", errorsMetric)
+	errs := make([]errorLabels, 0, len(r.errors))
+	for labels := range r.errors {
+		errs = append(errs, labels)
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		a, b := errs[i], errs[j]
+		if a.backend != b.backend {
+			return a.backend < b.backend
+		}
+		if a.op != b.op {
+			return a.op < b.op
+		}
+		return a.kind < b.kind
+	})
+	for _, labels := range errs {
+		fmt.Fprintf(bw, "%s{%s} %d\n", errorsMetric,
+			formatLabels("backend", labels.backend, "op", labels.op, "error", labels.kind), r.errors[labels])
+	}
+
+	fmt.Fprintf(bw, "# HELP %s Active kvstore watches.\n", watchesMetric)
+	fmt.Fprintf(bw, "# TYPE %s gauge\n", watchesMetric)
+	watches := make([]opLabels, 0, len(r.watches))
+	for labels := range r.watches {
+		watches = append(watches, labels)
+	}
+	sortOpLabels(watches)
+	for _, labels := range watches {
+		fmt.Fprintf(bw, "%s{%s} %d\n", watchesMetric, formatLabels("backend", labels.backend, "op", labels.op), r.watches[labels])
+	}
+
+	return bw.Flush()
+}
+
+// ServeHTTP exposes the measures to a Prometheus scraper
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WritePrometheus(w)
+}
+
+func sortOpLabels(labels []opLabels) {
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].backend != labels[j].backend {
+			return labels[i].backend < labels[j].backend
+		}
+		return labels[i].op < labels[j].op
+	})
+}
+
+// formatLabels formats the name and value pairs, the values are escaped
+func formatLabels(nameValues ...string) string {
+	parts := make([]string, 0, len(nameValues)/2)
+	for i := 0; i+1 < len(nameValues); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", nameValues[i], labelEscaper.Replace(nameValues[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
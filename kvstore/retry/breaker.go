@@ -0,0 +1,130 @@
+package retry
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a Breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets the calls through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails the calls fast
+	BreakerOpen
+	// BreakerHalfOpen lets a single trial call through
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Breaker options defaults
+const (
+	DefaultFailureThreshold = 5
+	DefaultOpenTimeout      = 10 * time.Second
+)
+
+// Breaker is a circuit breaker: it opens after FailureThreshold consecutive failures,
+// then lets a trial call through every OpenTimeout and closes once a trial succeeds
+type Breaker struct {
+	FailureThreshold int           // consecutive failures opening the breaker, DefaultFailureThreshold if not positive
+	OpenTimeout      time.Duration // delay before a trial call, DefaultOpenTimeout if not positive
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trial    bool // a trial call is in flight
+	now      func() time.Time
+}
+
+// State returns the current state of the breaker
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && b.clock().Sub(b.openedAt) >= b.openTimeout() {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// allow tells if a call may go through and if it's the trial call of a half-open breaker,
+// the call must report its outcome with done
+func (b *Breaker) allow() (ok bool, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerClosed:
+		return true, false
+	case BreakerOpen:
+		if b.clock().Sub(b.openedAt) < b.openTimeout() {
+			return false, false
+		}
+		b.state = BreakerHalfOpen
+	}
+	if b.trial {
+		return false, false
+	}
+	b.trial = true
+	return true, true
+}
+
+// done reports the outcome of a call, failed is true for the errors of the backend itself.
+// Once the breaker is open, only the outcome of the trial call changes its state: a call
+// let through while it was closed and finishing late is ignored
+func (b *Breaker) done(trial bool, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if trial {
+		b.trial = false
+	} else if b.state != BreakerClosed {
+		return
+	}
+
+	if !failed {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if trial || b.failures >= b.failureThreshold() {
+		b.state = BreakerOpen
+		b.openedAt = b.clock()
+	}
+}
+
+func (b *Breaker) failureThreshold() int {
+	if b.FailureThreshold <= 0 {
+		return DefaultFailureThreshold
+	}
+	return b.FailureThreshold
+}
+
+func (b *Breaker) openTimeout() time.Duration {
+	if b.OpenTimeout <= 0 {
+		return DefaultOpenTimeout
+	}
+	return b.OpenTimeout
+}
+
+func (b *Breaker) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,387 @@
+// Package retry provides a store.Store decorator retrying the failed calls
+// with an exponential backoff behind a circuit breaker
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/hashicorp/consul/api"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// Policy options defaults
+const (
+	DefaultMaxAttempts    = 3
+	DefaultInitialBackoff = 50 * time.Millisecond
+	DefaultMaxBackoff     = 2 * time.Second
+	DefaultMultiplier     = 2
+)
+
+// Policy tells which calls are retried and how long to wait in between
+type Policy struct {
+	MaxAttempts    int           // attempts of a call, the first one included, DefaultMaxAttempts if not positive
+	InitialBackoff time.Duration // delay before the first retry, DefaultInitialBackoff if not positive
+	MaxBackoff     time.Duration // max delay between two attempts, DefaultMaxBackoff if not positive
+	Multiplier     float64       // growth of the delay after every retry, DefaultMultiplier if less than 1
+	Jitter         float64       // fraction of the delay randomly added or removed, between 0 and 1
+
+	// Retryable tells if err is a failure of the backend worth retrying, Retryable by default
+	Retryable func(err error) bool
+
+	// RetryAtomic enables the retries of AtomicPut, AtomicDelete and Txn. It's off by default
+	// since an attempt may succeed without its response being received, the retry
+	// then fails with ErrKeyExists, ErrKeyModified or ErrKeyNotFound
+	RetryAtomic bool
+}
+
+// redisTransient are the prefixes of the replies of a redis server which can't serve
+// the call for now: a replica, a server loading its data, a cluster being resharded
+// or failed over
+var redisTransient = []string{"READONLY ", "LOADING ", "MASTERDOWN ", "CLUSTERDOWN ", "TRYAGAIN ", "MOVED ", "ASK "}
+
+// Retryable returns true for the failures to reach the backend only: store.ErrNotReachable,
+// the network errors, the connections closed with io.EOF, the errors of the consul servers
+// (5xx, no cluster leader) and the transient replies of the redis servers (READONLY, LOADING,
+// MASTERDOWN, CLUSTERDOWN, TRYAGAIN, MOVED and ASK). Any other error, such as store.ErrKeyNotFound or a value which
+// can't be decoded, is the answer of the backend and would fail again, the context errors
+// are the caller giving up
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, store.ErrNotReachable) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var statusErr api.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500
+	}
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		msg := redisErr.Error()
+		for _, prefix := range redisTransient {
+			if strings.HasPrefix(msg, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.Contains(err.Error(), "No cluster leader")
+}
+
+// backoff returns the delay before the given retry, starting at 1
+func (p *Policy) backoff(retry int) time.Duration {
+	initial, max, multiplier := p.InitialBackoff, p.MaxBackoff, p.Multiplier
+	if initial <= 0 {
+		initial = DefaultInitialBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	if multiplier < 1 {
+		multiplier = DefaultMultiplier
+	}
+
+	d := float64(initial) * math.Pow(multiplier, float64(retry-1))
+	if d > float64(max) {
+		d = float64(max)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+func (p *Policy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *Policy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return Retryable(err)
+}
+
+// Options of a Retrier
+type Options struct {
+	Policy Policy
+	// Breaker is shared by the calls of the store, nil to disable it
+	Breaker *Breaker
+}
+
+// Retrier implements store.Store around another store, the calls failing with a retryable
+// error are retried following Policy. While Breaker is open the calls fail fast with
+// store.ErrNotReachable. The watches and NewLock are retried until they start,
+// Lock and Unlock are not retried.
+//
+// The optional interfaces of the store package are implemented on top of the ones of the
+// wrapped store: ListPage and the batches fall back like their store helpers, the others
+// return store.ErrCallNotSupported when the wrapped store does not implement them
+type Retrier struct {
+	store.Store
+	policy  Policy
+	breaker *Breaker
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var (
+	_ store.ListPager    = (*Retrier)(nil)
+	_ store.ErrorWatcher = (*Retrier)(nil)
+	_ store.EventWatcher = (*Retrier)(nil)
+	_ store.TreeDeleter  = (*Retrier)(nil)
+	_ store.BatchStore   = (*Retrier)(nil)
+)
+
+// New creates the decorator around s
+func New(s store.Store, options *Options) *Retrier {
+	if options == nil {
+		options = &Options{}
+	}
+	return &Retrier{
+		Store:   s,
+		policy:  options.Policy,
+		breaker: options.Breaker,
+		done:    make(chan struct{}),
+	}
+}
+
+// do calls fn until it succeeds, fails with an error which is not retryable
+// or runs out of attempts. The last error is returned
+func (r *Retrier) do(retry bool, fn func() error) error {
+	attempts := r.policy.maxAttempts()
+	if !retry {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		trial := false
+		if r.breaker != nil {
+			var ok bool
+			if ok, trial = r.breaker.allow(); !ok {
+				if err == nil {
+					err = store.ErrNotReachable
+				}
+				return err
+			}
+		}
+
+		err = fn()
+		retryable := r.policy.retryable(err)
+		if r.breaker != nil {
+			r.breaker.done(trial, retryable)
+		}
+		if !retryable || attempt >= attempts {
+			return err
+		}
+
+		select {
+		case <-r.done:
+			return err
+		case <-time.After(r.policy.backoff(attempt)):
+		}
+	}
+}
+
+func (r *Retrier) Put(key string, value []byte, options *store.WriteOptions) error {
+	return r.do(true, func() error {
+		return r.Store.Put(key, value, options)
+	})
+}
+
+func (r *Retrier) Get(key string) (pair *store.KVPair, err error) {
+	err = r.do(true, func() error {
+		pair, err = r.Store.Get(key)
+		return err
+	})
+	return pair, err
+}
+
+func (r *Retrier) Delete(key string) error {
+	return r.do(true, func() error {
+		return r.Store.Delete(key)
+	})
+}
+
+func (r *Retrier) Exists(key string) (ok bool, err error) {
+	err = r.do(true, func() error {
+		ok, err = r.Store.Exists(key)
+		return err
+	})
+	return ok, err
+}
+
+func (r *Retrier) Watch(key string, stopCh <-chan struct{}) (watchCh <-chan *store.KVPair, err error) {
+	err = r.do(true, func() error {
+		watchCh, err = r.Store.Watch(key, stopCh)
+		return err
+	})
+	return watchCh, err
+}
+
+func (r *Retrier) WatchTree(directory string, stopCh <-chan struct{}) (watchCh <-chan []*store.KVPair, err error) {
+	err = r.do(true, func() error {
+		watchCh, err = r.Store.WatchTree(directory, stopCh)
+		return err
+	})
+	return watchCh, err
+}
+
+func (r *Retrier) WatchWithErrors(key string, stopCh <-chan struct{}) (watchCh <-chan *store.KVPair, errCh <-chan error, err error) {
+	w, ok := r.Store.(store.ErrorWatcher)
+	if !ok {
+		return nil, nil, store.ErrCallNotSupported
+	}
+	err = r.do(true, func() error {
+		watchCh, errCh, err = w.WatchWithErrors(key, stopCh)
+		return err
+	})
+	return watchCh, errCh, err
+}
+
+func (r *Retrier) WatchTreeWithErrors(directory string, stopCh <-chan struct{}) (watchCh <-chan []*store.KVPair, errCh <-chan error, err error) {
+	w, ok := r.Store.(store.ErrorWatcher)
+	if !ok {
+		return nil, nil, store.ErrCallNotSupported
+	}
+	err = r.do(true, func() error {
+		watchCh, errCh, err = w.WatchTreeWithErrors(directory, stopCh)
+		return err
+	})
+	return watchCh, errCh, err
+}
+
+func (r *Retrier) WatchEvents(directory string, stopCh <-chan struct{}) (eventCh <-chan *store.Event, err error) {
+	w, ok := r.Store.(store.EventWatcher)
+	if !ok {
+		return nil, store.ErrCallNotSupported
+	}
+	err = r.do(true, func() error {
+		eventCh, err = w.WatchEvents(directory, stopCh)
+		return err
+	})
+	return eventCh, err
+}
+
+func (r *Retrier) NewLock(key string, options *store.LockOptions) (locker store.Locker, err error) {
+	err = r.do(true, func() error {
+		locker, err = r.Store.NewLock(key, options)
+		return err
+	})
+	return locker, err
+}
+
+func (r *Retrier) List(directory string) (pairs []*store.KVPair, err error) {
+	err = r.do(true, func() error {
+		pairs, err = r.Store.List(directory)
+		return err
+	})
+	return pairs, err
+}
+
+// ListPage lists a page of directory, see store.ListPage
+func (r *Retrier) ListPage(directory, cursor string, limit int) (pairs []*store.KVPair, next string, err error) {
+	err = r.do(true, func() error {
+		pairs, next, err = store.ListPage(r.Store, directory, cursor, limit)
+		return err
+	})
+	return pairs, next, err
+}
+
+func (r *Retrier) DeleteTree(directory string) error {
+	return r.do(true, func() error {
+		return r.Store.DeleteTree(directory)
+	})
+}
+
+func (r *Retrier) DeleteTreeWithOptions(directory string, options *store.DeleteTreeOptions) (n int, err error) {
+	d, ok := r.Store.(store.TreeDeleter)
+	if !ok {
+		return 0, store.ErrCallNotSupported
+	}
+	err = r.do(true, func() error {
+		n, err = d.DeleteTreeWithOptions(directory, options)
+		return err
+	})
+	return n, err
+}
+
+// Txn applies ops atomically, see store.Store. It's retried like AtomicPut, see Policy.RetryAtomic
+func (r *Retrier) Txn(ops []*store.TxnOp) (pairs []*store.KVPair, err error) {
+	err = r.do(r.policy.RetryAtomic, func() error {
+		pairs, err = r.Store.Txn(ops)
+		return err
+	})
+	return pairs, err
+}
+
+// GetMany reads keys, see store.GetMany. Only the failure of the whole call is retried
+func (r *Retrier) GetMany(keys []string) (results []*store.KeyResult, err error) {
+	err = r.do(true, func() error {
+		results, err = store.GetMany(r.Store, keys)
+		return err
+	})
+	return results, err
+}
+
+// PutMany writes pairs, see store.PutMany. Only the failure of the whole call is retried
+func (r *Retrier) PutMany(pairs []*store.KVPair, options *store.WriteOptions) (results []*store.KeyResult, err error) {
+	err = r.do(true, func() error {
+		results, err = store.PutMany(r.Store, pairs, options)
+		return err
+	})
+	return results, err
+}
+
+// DeleteMany deletes keys, see store.DeleteMany. Only the failure of the whole call is retried
+func (r *Retrier) DeleteMany(keys []string) (results []*store.KeyResult, err error) {
+	err = r.do(true, func() error {
+		results, err = store.DeleteMany(r.Store, keys)
+		return err
+	})
+	return results, err
+}
+
+func (r *Retrier) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (ok bool, pair *store.KVPair, err error) {
+	err = r.do(r.policy.RetryAtomic, func() error {
+		ok, pair, err = r.Store.AtomicPut(key, value, previous, options)
+		return err
+	})
+	return ok, pair, err
+}
+
+func (r *Retrier) AtomicDelete(key string, previous *store.KVPair) (ok bool, err error) {
+	err = r.do(r.policy.RetryAtomic, func() error {
+		ok, err = r.Store.AtomicDelete(key, previous)
+		return err
+	})
+	return ok, err
+}
+
+// Close stops the pending retries and closes the underlying store
+func (r *Retrier) Close() {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		r.Store.Close()
+	})
+}
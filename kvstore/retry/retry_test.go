@@ -0,0 +1,299 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore/encrypt"
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/store/memory"
+	"github.com/beyondyyh/libs/kvstore/store/redis"
+	"github.com/beyondyyh/libs/kvstore/testutils"
+)
+
+// run all: go test -v github.com/beyondyyh/libs/kvstore/retry
+
+func makeMemoryClient(t *testing.T) store.Store {
+	kv, err := memory.New(nil, nil)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	return kv
+}
+
+var errFlaky = &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+// flakyStore fails the calls of Get, Put and ListPage with errFlaky while failures is positive
+type flakyStore struct {
+	store.Store
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+func (s *flakyStore) fail() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+	if s.failures > 0 {
+		s.failures--
+		return errFlaky
+	}
+	return nil
+}
+
+func (s *flakyStore) setFailures(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures, s.calls = n, 0
+}
+
+func (s *flakyStore) Get(key string) (*store.KVPair, error) {
+	if err := s.fail(); err != nil {
+		return nil, err
+	}
+	return s.Store.Get(key)
+}
+
+func (s *flakyStore) Put(key string, value []byte, options *store.WriteOptions) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.Store.Put(key, value, options)
+}
+
+func (s *flakyStore) ListPage(directory, cursor string, limit int) ([]*store.KVPair, string, error) {
+	if err := s.fail(); err != nil {
+		return nil, "", err
+	}
+	return store.ListPage(s.Store, directory, cursor, limit)
+}
+
+// go test -v -run TestRetrierStore github.com/beyondyyh/libs/kvstore/retry
+func TestRetrierStore(t *testing.T) {
+	kv := New(makeMemoryClient(t), &Options{Breaker: &Breaker{}})
+	defer kv.Close()
+	defer testutils.RunCleanup(t, kv)
+
+	testutils.RunTestCommon(t, kv)
+	testutils.RunTestAtomic(t, kv)
+	testutils.RunTestTxn(t, kv)
+	testutils.RunTestBatch(t, kv)
+	testutils.RunTestLock(t, kv)
+	testutils.RunTestWatch(t, kv)
+	testutils.RunTestWatchEvents(t, kv)
+}
+
+// go test -v -run TestRetrierRetries github.com/beyondyyh/libs/kvstore/retry
+func TestRetrierRetries(t *testing.T) {
+	assert := assert.New(t)
+
+	flaky := &flakyStore{Store: makeMemoryClient(t)}
+	kv := New(flaky, &Options{Policy: Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Jitter: 0.5}})
+	defer kv.Close()
+
+	// recovers within the attempts
+	flaky.setFailures(2)
+	assert.NoError(kv.Put("testRetry", []byte("foo"), nil))
+	assert.Equal(3, flaky.calls)
+
+	// runs out of attempts
+	flaky.setFailures(3)
+	_, err := kv.Get("testRetry")
+	assert.Equal(errFlaky, err)
+	assert.Equal(3, flaky.calls)
+
+	// the answers of the backend are not retried
+	flaky.setFailures(0)
+	_, err = kv.Get("testRetry/missing")
+	assert.Equal(store.ErrKeyNotFound, err)
+	assert.Equal(1, flaky.calls)
+
+	// custom classifier
+	kv = New(flaky, &Options{Policy: Policy{Retryable: func(error) bool { return false }}})
+	flaky.setFailures(1)
+	_, err = kv.Get("testRetry")
+	assert.Equal(errFlaky, err)
+	assert.Equal(1, flaky.calls)
+}
+
+// go test -v -run TestRetrierOptional github.com/beyondyyh/libs/kvstore/retry
+func TestRetrierOptional(t *testing.T) {
+	assert := assert.New(t)
+
+	flaky := &flakyStore{Store: makeMemoryClient(t)}
+	kv := New(flaky, &Options{Policy: Policy{InitialBackoff: time.Millisecond}})
+	defer kv.Close()
+
+	// the pages are read from the ListPager of the wrapped store, and retried
+	assert.NoError(kv.Put("testOptional/key", []byte("foo"), nil))
+	flaky.setFailures(1)
+	pairs, next, err := store.ListPage(kv, "testOptional", "", 10)
+	assert.NoError(err)
+	assert.Equal("", next)
+	assert.Equal(1, len(pairs))
+	assert.Equal(2, flaky.calls)
+
+	// the memory store has neither error watches nor DeleteTreeWithOptions
+	_, _, err = kv.WatchWithErrors("testOptional", nil)
+	assert.Equal(store.ErrCallNotSupported, err)
+	_, err = kv.DeleteTreeWithOptions("testOptional", nil)
+	assert.Equal(store.ErrCallNotSupported, err)
+}
+
+// redisReply is an error reply of a redis server, such as the ones of go-redis
+type redisReply string
+
+func (e redisReply) Error() string { return string(e) }
+
+func (redisReply) RedisError() {}
+
+// go test -v -run TestRetryable github.com/beyondyyh/libs/kvstore/retry
+func TestRetryable(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, err := range []error{
+		store.ErrNotReachable,
+		errFlaky,
+		io.EOF,
+		fmt.Errorf("redis: %w", io.ErrUnexpectedEOF),
+		api.StatusError{Code: 500, Body: "No cluster leader"},
+		api.StatusError{Code: 503, Body: "unavailable"},
+		errors.New("Unexpected response code: 500 (rpc error making call: No cluster leader)"),
+		redisReply("READONLY You can't write against a read only replica."),
+		redisReply("LOADING Redis is loading the dataset in memory"),
+		redisReply("MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'."),
+		redisReply("CLUSTERDOWN The cluster is down"),
+		redisReply("TRYAGAIN Multiple keys request during rehashing of slot"),
+		redisReply("MOVED 3999 127.0.0.1:6381"),
+		fmt.Errorf("redis: %w", redisReply("ASK 3999 127.0.0.1:6381")),
+	} {
+		assert.True(Retryable(err), err.Error())
+	}
+
+	for _, err := range []error{
+		nil,
+		store.ErrKeyNotFound,
+		store.ErrKeyModified,
+		store.ErrCallNotSupported,
+		encrypt.ErrDecrypt,
+		encrypt.ErrMalformedValue,
+		redis.ErrMalformedData,
+		redis.ErrUnknownCodec,
+		&redis.NotificationsError{Addr: "localhost:6379", Err: errors.New("ERR unknown command 'CONFIG'")},
+		api.StatusError{Code: 403, Body: "Permission denied"},
+		redisReply("WRONGTYPE Operation against a key holding the wrong kind of value"),
+		redisReply("NOSCRIPT No matching script. Please use EVAL."),
+		redisReply("ERR READONLY is not a command"),
+		context.Canceled,
+		context.DeadlineExceeded,
+		&net.OpError{Op: "dial", Net: "tcp", Err: context.DeadlineExceeded},
+	} {
+		assert.False(Retryable(err), "%v", err)
+	}
+}
+
+// go test -v -run TestPolicyBackoff github.com/beyondyyh/libs/kvstore/retry
+func TestPolicyBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &Policy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	assert.Equal(10*time.Millisecond, p.backoff(1))
+	assert.Equal(20*time.Millisecond, p.backoff(2))
+	assert.Equal(40*time.Millisecond, p.backoff(3))
+	assert.Equal(50*time.Millisecond, p.backoff(4))
+
+	p.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		d := p.backoff(2)
+		assert.True(d >= 16*time.Millisecond && d <= 24*time.Millisecond, d)
+	}
+}
+
+// go test -v -run TestBreaker github.com/beyondyyh/libs/kvstore/retry
+func TestBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	breaker := &Breaker{FailureThreshold: 2, OpenTimeout: time.Second, now: func() time.Time { return now }}
+	flaky := &flakyStore{Store: makeMemoryClient(t)}
+	kv := New(flaky, &Options{Policy: Policy{MaxAttempts: 1}, Breaker: breaker})
+	defer kv.Close()
+
+	// opens after FailureThreshold consecutive failures
+	flaky.setFailures(2)
+	for i := 0; i < 2; i++ {
+		_, err := kv.Get("testBreaker")
+		assert.Equal(errFlaky, err)
+	}
+	assert.Equal(BreakerOpen, breaker.State())
+
+	// fails fast while open
+	_, err := kv.Get("testBreaker")
+	assert.Equal(store.ErrNotReachable, err)
+	assert.Equal(2, flaky.calls)
+
+	// a failed trial opens it again
+	now = now.Add(time.Second)
+	assert.Equal(BreakerHalfOpen, breaker.State())
+	flaky.setFailures(1)
+	_, err = kv.Get("testBreaker")
+	assert.Equal(errFlaky, err)
+	assert.Equal(BreakerOpen, breaker.State())
+
+	// a successful trial closes it
+	now = now.Add(time.Second)
+	_, err = kv.Get("testBreaker")
+	assert.Equal(store.ErrKeyNotFound, err)
+	assert.Equal(BreakerClosed, breaker.State())
+	assert.NoError(kv.Put("testBreaker", []byte("foo"), nil))
+}
+
+// go test -v -run TestBreakerStaleCall github.com/beyondyyh/libs/kvstore/retry
+func TestBreakerStaleCall(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	breaker := &Breaker{FailureThreshold: 1, OpenTimeout: time.Second, now: func() time.Time { return now }}
+
+	// the calls let through while closed are still in flight when the breaker opens
+	for i := 0; i < 3; i++ {
+		ok, trial := breaker.allow()
+		assert.True(ok)
+		assert.False(trial)
+	}
+	breaker.done(false, true)
+	assert.Equal(BreakerOpen, breaker.State())
+
+	// its late outcome changes nothing, failure or success
+	breaker.done(false, true)
+	assert.Equal(BreakerOpen, breaker.State())
+	now = now.Add(time.Second)
+	ok, trial := breaker.allow()
+	assert.True(ok)
+	assert.True(trial)
+	breaker.done(false, false)
+	assert.Equal(BreakerHalfOpen, breaker.State())
+
+	// the trial is still in flight
+	ok, _ = breaker.allow()
+	assert.False(ok)
+
+	// the outcome of the trial does
+	breaker.done(true, false)
+	assert.Equal(BreakerClosed, breaker.State())
+	ok, trial = breaker.allow()
+	assert.True(ok)
+	assert.False(trial)
+}
@@ -0,0 +1,69 @@
+package store
+
+// KeyResult is the result of a batch operation on a single key
+type KeyResult struct {
+	Pair *KVPair // the pair read by GetMany or written by PutMany, nil on error
+	Err  error   // the error of this key only, such as ErrKeyNotFound
+}
+
+// BatchStore is implemented by the backends which read or write many keys in a few round trips.
+// The results are in the order of the keys, the returned error is the failure of the whole call.
+// Unlike Txn the operations of a batch are not atomic
+type BatchStore interface {
+	// GetMany reads keys, a missing key has the ErrKeyNotFound error
+	GetMany(keys []string) ([]*KeyResult, error)
+
+	// PutMany writes pairs with the same options, the written pairs have their LastIndex set
+	PutMany(pairs []*KVPair, options *WriteOptions) ([]*KeyResult, error)
+
+	// DeleteMany deletes keys, a missing key has the ErrKeyNotFound error
+	DeleteMany(keys []string) ([]*KeyResult, error)
+}
+
+// GetMany reads keys from s, see BatchStore.
+// For the backends which don't implement BatchStore the keys are read one by one
+func GetMany(s Store, keys []string) ([]*KeyResult, error) {
+	if b, ok := s.(BatchStore); ok {
+		return b.GetMany(keys)
+	}
+
+	results := make([]*KeyResult, len(keys))
+	for i, key := range keys {
+		pair, err := s.Get(key)
+		results[i] = &KeyResult{Pair: pair, Err: err}
+	}
+	return results, nil
+}
+
+// PutMany writes pairs to s, see BatchStore.
+// For the backends which don't implement BatchStore the pairs are written one by one,
+// the LastIndex of the written pairs is then 0 since Put does not return it
+func PutMany(s Store, pairs []*KVPair, options *WriteOptions) ([]*KeyResult, error) {
+	if b, ok := s.(BatchStore); ok {
+		return b.PutMany(pairs, options)
+	}
+
+	results := make([]*KeyResult, len(pairs))
+	for i, pair := range pairs {
+		if err := s.Put(pair.Key, pair.Value, options); err != nil {
+			results[i] = &KeyResult{Err: err}
+			continue
+		}
+		results[i] = &KeyResult{Pair: &KVPair{Key: pair.Key, Value: pair.Value}}
+	}
+	return results, nil
+}
+
+// DeleteMany deletes keys from s, see BatchStore.
+// For the backends which don't implement BatchStore the keys are deleted one by one
+func DeleteMany(s Store, keys []string) ([]*KeyResult, error) {
+	if b, ok := s.(BatchStore); ok {
+		return b.DeleteMany(keys)
+	}
+
+	results := make([]*KeyResult, len(keys))
+	for i, key := range keys {
+		results[i] = &KeyResult{Err: s.Delete(key)}
+	}
+	return results, nil
+}
@@ -0,0 +1,23 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/store/memory"
+	"github.com/beyondyyh/libs/kvstore/testutils"
+)
+
+// go test -v -run TestBatchFallback github.com/beyondyyh/libs/kvstore/store
+func TestBatchFallback(t *testing.T) {
+	kv, _ := memory.New(nil, nil)
+	defer kv.Close()
+
+	// listOnly hides the BatchStore of the memory store as well
+	var s store.Store = listOnly{kv}
+	if _, ok := s.(store.BatchStore); ok {
+		t.Fatal("store.BatchStore should be hidden")
+	}
+	testutils.RunTestBatch(t, s)
+	testutils.RunCleanup(t, kv)
+}
@@ -0,0 +1,181 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// GetMany reads keys by transactions of maxTxnOps gets, see store.BatchStore
+func (s *Consul) GetMany(keys []string) ([]*store.KeyResult, error) {
+	return s.getMany(context.Background(), keys)
+}
+
+func (s *Consul) getMany(ctx context.Context, keys []string) ([]*store.KeyResult, error) {
+	ops := make(api.KVTxnOps, len(keys))
+	for i, key := range keys {
+		ops[i] = &api.KVTxnOp{Verb: api.KVGet, Key: s.normalize(key)}
+	}
+	pairs, errs, err := s.txnEach(ctx, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*store.KeyResult, len(keys))
+	for i, pair := range pairs {
+		if errs[i] != nil || pair == nil {
+			results[i] = &store.KeyResult{Err: errs[i]}
+			continue
+		}
+		results[i] = &store.KeyResult{Pair: &store.KVPair{Key: pair.Key, Value: pair.Value, LastIndex: pair.ModifyIndex}}
+	}
+	return results, nil
+}
+
+// PutMany writes pairs by transactions of maxTxnOps sets, see store.BatchStore.
+// The pairs with a ttl or ephemeral are written one by one since every key needs its own session
+func (s *Consul) PutMany(pairs []*store.KVPair, options *store.WriteOptions) ([]*store.KeyResult, error) {
+	return s.putMany(context.Background(), pairs, options)
+}
+
+func (s *Consul) putMany(ctx context.Context, pairs []*store.KVPair, options *store.WriteOptions) ([]*store.KeyResult, error) {
+	results := make([]*store.KeyResult, len(pairs))
+	if options != nil && (options.TTL > 0 || options.Ephemeral) {
+		for i, pair := range pairs {
+			if err := s.put(ctx, pair.Key, pair.Value, options); err != nil {
+				results[i] = &store.KeyResult{Err: err}
+				continue
+			}
+			written, err := s.get(ctx, pair.Key)
+			results[i] = &store.KeyResult{Pair: written, Err: err}
+		}
+		return results, nil
+	}
+
+	ops := make(api.KVTxnOps, len(pairs))
+	for i, pair := range pairs {
+		ops[i] = &api.KVTxnOp{
+			Verb:  api.KVSet,
+			Key:   s.normalize(pair.Key),
+			Value: pair.Value,
+			Flags: api.LockFlagValue,
+		}
+	}
+	written, errs, err := s.txnEach(ctx, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, pair := range written {
+		if errs[i] != nil || pair == nil {
+			results[i] = &store.KeyResult{Err: errs[i]}
+			continue
+		}
+		// the results of the sets have no value
+		results[i] = &store.KeyResult{Pair: &store.KVPair{Key: pair.Key, Value: pairs[i].Value, LastIndex: pair.ModifyIndex}}
+	}
+	return results, nil
+}
+
+// DeleteMany deletes keys by transactions of maxTxnOps operations, see store.BatchStore.
+// Every delete is preceded by a get of its key so that the missing keys are reported
+func (s *Consul) DeleteMany(keys []string) ([]*store.KeyResult, error) {
+	return s.deleteMany(context.Background(), keys)
+}
+
+func (s *Consul) deleteMany(ctx context.Context, keys []string) ([]*store.KeyResult, error) {
+	ops := make(api.KVTxnOps, 0, 2*len(keys))
+	for _, key := range keys {
+		key = s.normalize(key)
+		ops = append(ops,
+			&api.KVTxnOp{Verb: api.KVGet, Key: key},
+			&api.KVTxnOp{Verb: api.KVDelete, Key: key},
+		)
+	}
+	_, errs, err := s.txnEach(ctx, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*store.KeyResult, len(keys))
+	for i := range keys {
+		err := errs[2*i]
+		if err == nil {
+			err = errs[2*i+1]
+		}
+		results[i] = &store.KeyResult{Err: err}
+	}
+	return results, nil
+}
+
+// txnEach runs ops by transactions of maxTxnOps operations and returns the result and
+// the error of every op. The ops failing on their own are dropped and the rest of their
+// transaction is retried, deletes have no result
+func (s *Consul) txnEach(ctx context.Context, ops api.KVTxnOps) ([]*api.KVPair, []error, error) {
+	pairs := make([]*api.KVPair, len(ops))
+	errs := make([]error, len(ops))
+	for start := 0; start < len(ops); start += maxTxnOps {
+		end := start + maxTxnOps
+		if end > len(ops) {
+			end = len(ops)
+		}
+		pending := make([]int, 0, end-start)
+		for i := start; i < end; i++ {
+			pending = append(pending, i)
+		}
+
+		for len(pending) > 0 {
+			txnOps := make(api.KVTxnOps, len(pending))
+			for j, i := range pending {
+				txnOps[j] = ops[i]
+			}
+			ok, resp, _, err := s.client.KV().Txn(txnOps, queryOptions(ctx))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if ok {
+				results := resp.Results
+				for _, i := range pending {
+					if ops[i].Verb == api.KVDelete || len(results) == 0 {
+						continue
+					}
+					pairs[i], results = results[0], results[1:]
+				}
+				break
+			}
+
+			if len(resp.Errors) == 0 {
+				return nil, nil, errors.New("consul: transaction rolled back")
+			}
+			failed := make(map[int]bool, len(resp.Errors))
+			for _, txnErr := range resp.Errors {
+				if txnErr.OpIndex < 0 || txnErr.OpIndex >= len(pending) {
+					return nil, nil, errors.New("consul: " + txnErr.What)
+				}
+				errs[pending[txnErr.OpIndex]] = txnOpError(txnErr.What)
+				failed[txnErr.OpIndex] = true
+			}
+			rest := make([]int, 0, len(pending)-len(failed))
+			for j, i := range pending {
+				if !failed[j] {
+					rest = append(rest, i)
+				}
+			}
+			pending = rest
+		}
+	}
+	return pairs, errs, nil
+}
+
+// txnOpError converts the error of an operation of a transaction
+func txnOpError(what string) error {
+	if strings.Contains(what, "doesn't exist") {
+		return store.ErrKeyNotFound
+	}
+	return errors.New("consul: " + what)
+}
@@ -1,9 +1,11 @@
 package consul
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -30,7 +32,7 @@ const (
 	MaxSessionDestroyAttempts = 5
 
 	// defaultLockTTL is the default ttl for the consul lock
-	// defaultLockTTL = 20 * time.Second
+	defaultLockTTL = 20 * time.Second
 )
 
 var (
@@ -41,12 +43,26 @@ var (
 	// ErrSessionRenew is thrown when the session can't be
 	// renewed because the Consul version does not support sessions
 	ErrSessionRenew = errors.New("cannot set or renew session for ttl, unable to operate on sessions")
+
+	// ErrTooManyTxnOps is thrown when a transaction holds more than maxTxnOps operations
+	ErrTooManyTxnOps = errors.New("consul: too many operations in a transaction")
 )
 
 type Consul struct {
 	sync.Mutex
 	config *api.Config
 	client *api.Client
+
+	// ephemeral keys, see ephemeral.go
+	sessionsMu sync.Mutex
+	sessions   map[time.Duration]string // session by ttl
+	done       chan struct{}
+	wg         sync.WaitGroup
+
+	// key lists of the ListPage listings, see list.go
+	snapshotsMu sync.Mutex
+	snapshots   map[uint64]*keySnapshot
+	snapshotSeq uint64
 }
 
 func Register() {
@@ -58,7 +74,11 @@ func New(endpoints []string, options *store.Config) (store.Store, error) {
 		return nil, ErrMultipleEndpointsUnsupported
 	}
 
-	s := &Consul{}
+	s := &Consul{
+		sessions:  make(map[time.Duration]string),
+		done:      make(chan struct{}),
+		snapshots: make(map[uint64]*keySnapshot),
+	}
 
 	// Create consul client
 	config := api.DefaultConfig()
@@ -106,9 +126,9 @@ func (s *Consul) normalize(key string) string {
 	return strings.TrimPrefix(key, "/")
 }
 
-func (s *Consul) renewSession(pair *api.KVPair, ttl time.Duration) error {
+func (s *Consul) renewSession(ctx context.Context, pair *api.KVPair, ttl time.Duration) error {
 	// Check if there is any previous session with an active TTL
-	session, err := s.getActiveSession(pair.Key)
+	session, err := s.getActiveSession(ctx, pair.Key)
 	if err != nil {
 		return err
 	}
@@ -121,7 +141,7 @@ func (s *Consul) renewSession(pair *api.KVPair, ttl time.Duration) error {
 		}
 
 		// Create the key session
-		session, _, err := s.client.Session().Create(entry, nil)
+		session, _, err = s.client.Session().Create(entry, writeOptions(ctx))
 		if err != nil {
 			return err
 		}
@@ -140,12 +160,12 @@ func (s *Consul) renewSession(pair *api.KVPair, ttl time.Duration) error {
 		}
 	}
 
-	_, _, err = s.client.Session().Renew(session, nil)
+	_, _, err = s.client.Session().Renew(session, writeOptions(ctx))
 	return err
 }
 
-func (s *Consul) getActiveSession(key string) (string, error) {
-	pair, _, err := s.client.KV().Get(key, nil)
+func (s *Consul) getActiveSession(ctx context.Context, key string) (string, error) {
+	pair, _, err := s.client.KV().Get(key, queryOptions(ctx))
 	if err != nil {
 		return "", err
 	}
@@ -155,14 +175,28 @@ func (s *Consul) getActiveSession(key string) (string, error) {
 	return "", nil
 }
 
+// queryOptions returns the read options bound to ctx
+func queryOptions(ctx context.Context) *api.QueryOptions {
+	return (&api.QueryOptions{}).WithContext(ctx)
+}
+
+// writeOptions returns the write options bound to ctx
+func writeOptions(ctx context.Context) *api.WriteOptions {
+	return (&api.WriteOptions{}).WithContext(ctx)
+}
+
 // Get the value at "key", returns the last modified index
 func (s *Consul) Get(key string) (*store.KVPair, error) {
-	options := &api.QueryOptions{
+	return s.get(context.Background(), key)
+}
+
+func (s *Consul) get(ctx context.Context, key string) (*store.KVPair, error) {
+	options := (&api.QueryOptions{
 		AllowStale:        false,
 		RequireConsistent: true,
-	}
+	}).WithContext(ctx)
 
-	pair, meta, err := s.client.KV().Get(s.normalize(key), options)
+	pair, _, err := s.client.KV().Get(s.normalize(key), options)
 	if err != nil {
 		return nil, err
 	}
@@ -172,10 +206,17 @@ func (s *Consul) Get(key string) (*store.KVPair, error) {
 		return nil, store.ErrKeyNotFound
 	}
 
-	return &store.KVPair{Key: pair.Key, Value: pair.Value, LastIndex: meta.LastIndex}, nil
+	// ModifyIndex is used rather than the X-Consul-Index so that
+	// LastIndex can be passed back to CAS operations
+	return &store.KVPair{Key: pair.Key, Value: pair.Value, LastIndex: pair.ModifyIndex}, nil
 }
 
+// Put a value at "key"
 func (s *Consul) Put(key string, value []byte, opts *store.WriteOptions) error {
+	return s.put(context.Background(), key, value, opts)
+}
+
+func (s *Consul) put(ctx context.Context, key string, value []byte, opts *store.WriteOptions) error {
 	key = s.normalize(key)
 
 	p := &api.KVPair{
@@ -184,34 +225,57 @@ func (s *Consul) Put(key string, value []byte, opts *store.WriteOptions) error {
 		Flags: api.LockFlagValue,
 	}
 
-	if opts != nil && opts.TTL > 0 {
-		for retry := 1; retry <= RenewSessionRetryMax; retry++ {
-			err := s.renewSession(p, opts.TTL)
-			if err == nil {
-				break
-			}
-			if retry == RenewSessionRetryMax {
-				return ErrSessionRenew
-			}
-		}
+	if opts != nil && opts.Ephemeral {
+		return s.putEphemeral(ctx, p, opts.TTL)
+	}
+	if err := s.setTTL(ctx, p, opts); err != nil {
+		return err
 	}
 
-	_, err := s.client.KV().Put(p, nil)
+	_, err := s.client.KV().Put(p, writeOptions(ctx))
 	return err
 }
 
+// setTTL attaches a session with the ttl of opts to the pair
+func (s *Consul) setTTL(ctx context.Context, p *api.KVPair, opts *store.WriteOptions) error {
+	if opts == nil || opts.TTL <= 0 {
+		return nil
+	}
+	for retry := 1; retry <= RenewSessionRetryMax; retry++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := s.renewSession(ctx, p, opts.TTL)
+		if err == nil {
+			break
+		}
+		if retry == RenewSessionRetryMax {
+			return ErrSessionRenew
+		}
+	}
+	return nil
+}
+
 // Delete the value at "key"
 func (s *Consul) Delete(key string) error {
-	if _, err := s.Get(key); err != nil {
+	return s.delete(context.Background(), key)
+}
+
+func (s *Consul) delete(ctx context.Context, key string) error {
+	if _, err := s.get(ctx, key); err != nil {
 		return err
 	}
-	_, err := s.client.KV().Delete(s.normalize(key), nil)
+	_, err := s.client.KV().Delete(s.normalize(key), writeOptions(ctx))
 	return err
 }
 
 // Exists checks the key exists inside the store
 func (s *Consul) Exists(key string) (bool, error) {
-	_, err := s.Get(key)
+	return s.exists(context.Background(), key)
+}
+
+func (s *Consul) exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.get(ctx, key)
 	if err != nil {
 		if err == store.ErrKeyNotFound {
 			return false, nil
@@ -223,7 +287,11 @@ func (s *Consul) Exists(key string) (bool, error) {
 
 // List child nodes of a given directory
 func (s *Consul) List(directory string) ([]*store.KVPair, error) {
-	pairs, _, err := s.client.KV().List(s.normalize(directory), nil)
+	return s.list(context.Background(), directory)
+}
+
+func (s *Consul) list(ctx context.Context, directory string) ([]*store.KVPair, error) {
+	pairs, _, err := s.client.KV().List(s.normalize(directory), queryOptions(ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -246,19 +314,300 @@ func (s *Consul) List(directory string) ([]*store.KVPair, error) {
 	return kvpairs, nil
 }
 
+// maxTxnOps is the maximum number of operations in a single consul transaction
+const maxTxnOps = 64
+
+// ListPage returns limit pairs under directory following cursor, which names the listing and the last key of
+// the previous page. Since consul can't page the keys they are fetched at once by the first page and kept by the
+// store for the following ones, snapshotTTL at most after the last page. The keys created meanwhile are missed,
+// the deleted ones are skipped. The values are read by transactions of maxTxnOps gets
+func (s *Consul) ListPage(directory, cursor string, limit int) ([]*store.KVPair, string, error) {
+	return s.listPage(context.Background(), directory, cursor, limit)
+}
+
+func (s *Consul) listPage(ctx context.Context, directory, cursor string, limit int) ([]*store.KVPair, string, error) {
+	if limit <= 0 {
+		limit = store.DefaultPageLimit
+	}
+
+	id, after, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	directory = s.normalize(directory)
+	keys := s.snapshot(id, directory)
+	if keys == nil {
+		// first page, or the listing is expired or known by another client
+		if keys, _, err = s.client.KV().Keys(directory, "", queryOptions(ctx)); err != nil {
+			return nil, "", err
+		}
+		id = 0
+	}
+	// consul returns the keys sorted
+	if after != "" {
+		keys = keys[sort.Search(len(keys), func(i int) bool { return keys[i] > after }):]
+	}
+
+	next := ""
+	if len(keys) > limit {
+		if id == 0 {
+			id = s.addSnapshot(directory, keys)
+		}
+		keys = keys[:limit]
+		next = formatCursor(id, keys[limit-1])
+	} else if id != 0 {
+		s.dropSnapshot(id)
+	}
+
+	pairs := []*store.KVPair{}
+	for start := 0; start < len(keys); start += maxTxnOps {
+		end := start + maxTxnOps
+		if end > len(keys) {
+			end = len(keys)
+		}
+		chunk, err := s.getMulti(ctx, keys[start:end])
+		if err != nil {
+			return nil, "", err
+		}
+		for _, pair := range chunk {
+			if pair.Key != directory {
+				pairs = append(pairs, pair)
+			}
+		}
+	}
+	return pairs, next, nil
+}
+
+// getMulti reads keys in a single transaction, the keys deleted
+// meanwhile are skipped by falling back to a get per key
+func (s *Consul) getMulti(ctx context.Context, keys []string) ([]*store.KVPair, error) {
+	ops := make(api.KVTxnOps, 0, len(keys))
+	for _, key := range keys {
+		ops = append(ops, &api.KVTxnOp{Verb: api.KVGet, Key: key})
+	}
+	ok, resp, _, err := s.client.KV().Txn(ops, queryOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]*store.KVPair, 0, len(keys))
+	if !ok {
+		for _, key := range keys {
+			pair, err := s.get(ctx, key)
+			if err == store.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			pairs = append(pairs, pair)
+		}
+		return pairs, nil
+	}
+
+	for _, pair := range resp.Results {
+		pairs = append(pairs, &store.KVPair{
+			Key:       pair.Key,
+			Value:     pair.Value,
+			LastIndex: pair.ModifyIndex,
+		})
+	}
+	return pairs, nil
+}
+
 // DeleteTree deletes a range of keys under a given directory
 func (s *Consul) DeleteTree(directory string) error {
-	if _, err := s.List(directory); err != nil {
+	return s.deleteTree(context.Background(), directory)
+}
+
+func (s *Consul) deleteTree(ctx context.Context, directory string) error {
+	if _, err := s.list(ctx, directory); err != nil {
 		return err
 	}
-	_, err := s.client.KV().DeleteTree(s.normalize(directory), nil)
+	_, err := s.client.KV().DeleteTree(s.normalize(directory), writeOptions(ctx))
 	return err
 }
 
+// AtomicPut put a value at "key" if the key has not been
+// modified in the meantime, throws an error if this is the case.
+// The ephemeral keys are not supported, the session can't be acquired along with the CAS
+func (s *Consul) AtomicPut(key string, value []byte, previous *store.KVPair, opts *store.WriteOptions) (bool, *store.KVPair, error) {
+	return s.atomicPut(context.Background(), key, value, previous, opts)
+}
+
+func (s *Consul) atomicPut(ctx context.Context, key string, value []byte, previous *store.KVPair, opts *store.WriteOptions) (bool, *store.KVPair, error) {
+	if opts != nil && opts.Ephemeral {
+		return false, nil, store.ErrCallNotSupported
+	}
+	p := &api.KVPair{
+		Key:   s.normalize(key),
+		Value: value,
+		Flags: api.LockFlagValue,
+	}
+
+	if previous == nil {
+		// Consul interprets ModifyIndex = 0 as new key
+		p.ModifyIndex = 0
+	} else {
+		p.ModifyIndex = previous.LastIndex
+	}
+
+	if err := s.setTTL(ctx, p, opts); err != nil {
+		return false, nil, err
+	}
+
+	ok, _, err := s.client.KV().CAS(p, writeOptions(ctx))
+	if err != nil {
+		return false, nil, err
+	}
+	if !ok {
+		if previous == nil {
+			return false, nil, store.ErrKeyExists
+		}
+		// Distinguish a deleted key from a modified one
+		if _, err := s.get(ctx, key); err == store.ErrKeyNotFound {
+			return false, nil, err
+		}
+		return false, nil, store.ErrKeyModified
+	}
+
+	pair, err := s.get(ctx, key)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, pair, nil
+}
+
+// AtomicDelete deletes a value at "key" if the key
+// has not been modified in the meantime, throws an
+// error if this is the case
+func (s *Consul) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	return s.atomicDelete(context.Background(), key, previous)
+}
+
+func (s *Consul) atomicDelete(ctx context.Context, key string, previous *store.KVPair) (bool, error) {
+	if previous == nil {
+		return false, store.ErrPreviousNotSpecified
+	}
+
+	p := &api.KVPair{
+		Key:         s.normalize(key),
+		ModifyIndex: previous.LastIndex,
+		Flags:       api.LockFlagValue,
+	}
+
+	// Extra Get operation to check on the key
+	if _, err := s.get(ctx, key); err != nil {
+		return false, err
+	}
+
+	ok, _, err := s.client.KV().DeleteCAS(p, writeOptions(ctx))
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, store.ErrKeyModified
+	}
+	return true, nil
+}
+
+// Txn applies ops atomically with the consul transaction API, see store.Store.
+// A transaction holds at most maxTxnOps operations, and TxnPut supports neither the TTL nor the ephemeral keys
+func (s *Consul) Txn(ops []*store.TxnOp) ([]*store.KVPair, error) {
+	return s.txn(context.Background(), ops)
+}
+
+func (s *Consul) txn(ctx context.Context, ops []*store.TxnOp) ([]*store.KVPair, error) {
+	if len(ops) == 0 {
+		return []*store.KVPair{}, nil
+	}
+	if len(ops) > maxTxnOps {
+		return nil, ErrTooManyTxnOps
+	}
+
+	txnOps := make(api.KVTxnOps, 0, len(ops))
+	for i, op := range ops {
+		txnOp := &api.KVTxnOp{Key: s.normalize(op.Key)}
+		switch op.Type {
+		case store.TxnPut:
+			if op.Options != nil && (op.Options.TTL > 0 || op.Options.Ephemeral) {
+				return nil, &store.TxnError{Op: i, Err: store.ErrCallNotSupported}
+			}
+			txnOp.Verb = api.KVSet
+			txnOp.Value = op.Value
+			txnOp.Flags = api.LockFlagValue
+		case store.TxnDelete:
+			txnOp.Verb = api.KVDelete
+		case store.TxnCheckIndex:
+			if op.Index == 0 {
+				txnOp.Verb = api.KVCheckNotExists
+			} else {
+				txnOp.Verb = api.KVCheckIndex
+				txnOp.Index = op.Index
+			}
+		default:
+			return nil, &store.TxnError{Op: i, Err: store.ErrInvalidTxnOp}
+		}
+		txnOps = append(txnOps, txnOp)
+	}
+	if len(txnOps) == 0 {
+		return []*store.KVPair{}, nil
+	}
+
+	ok, resp, _, err := s.client.KV().Txn(txnOps, queryOptions(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, txnError(ops, resp.Errors)
+	}
+
+	// only the set and check-index verbs have a result
+	pairs := make([]*store.KVPair, len(ops))
+	results := resp.Results
+	for i, op := range txnOps {
+		if op.Verb != api.KVSet && op.Verb != api.KVCheckIndex {
+			continue
+		}
+		if len(results) == 0 {
+			break
+		}
+		if op.Verb == api.KVSet {
+			pairs[i] = &store.KVPair{Key: results[0].Key, Value: ops[i].Value, LastIndex: results[0].ModifyIndex}
+		}
+		results = results[1:]
+	}
+	return pairs, nil
+}
+
+// txnError converts the errors of a rolled back transaction
+func txnError(ops []*store.TxnOp, errs api.TxnErrors) error {
+	if len(errs) == 0 || errs[0].OpIndex < 0 || errs[0].OpIndex >= len(ops) {
+		return errors.New("consul: transaction rolled back")
+	}
+
+	i, what := errs[0].OpIndex, errs[0].What
+	if ops[i].Type != store.TxnCheckIndex {
+		return &store.TxnError{Op: i, Err: errors.New("consul: " + what)}
+	}
+	switch {
+	case ops[i].Index == 0:
+		return &store.TxnError{Op: i, Err: store.ErrKeyExists}
+	case strings.Contains(what, "doesn't exist"):
+		return &store.TxnError{Op: i, Err: store.ErrKeyNotFound}
+	}
+	return &store.TxnError{Op: i, Err: store.ErrKeyModified}
+}
+
 // Watch for changes on a "key"
 // - key: 指定要监听的key
 // - stopch: 非nil的channel用来停止监听
 func (s *Consul) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	return s.watch(context.Background(), key, stopCh)
+}
+
+// watch issues the blocking queries with ctx and stops once stopCh is closed
+func (s *Consul) watch(ctx context.Context, key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
 	kv := s.client.KV()
 	watchCh := make(chan *store.KVPair)
 
@@ -266,7 +615,7 @@ func (s *Consul) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair
 		defer close(watchCh)
 
 		// 使用等待时间去check是否应该退出监听，当指定 `WaitTime > 0` 时，api是阻塞式查询
-		opts := &api.QueryOptions{WaitTime: DefaultWatchWaitTime}
+		opts := (&api.QueryOptions{WaitTime: DefaultWatchWaitTime}).WithContext(ctx)
 		// Gets loop
 		for {
 			// Check退出信号
@@ -289,10 +638,14 @@ func (s *Consul) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair
 			opts.WaitIndex = meta.LastIndex
 
 			if pair != nil {
-				watchCh <- &store.KVPair{
+				select {
+				case watchCh <- &store.KVPair{
 					Key:       pair.Key,
 					Value:     pair.Value,
 					LastIndex: pair.ModifyIndex,
+				}:
+				case <-stopCh:
+					return
 				}
 			}
 		}
@@ -305,6 +658,11 @@ func (s *Consul) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair
 // - key: 指定要监听的dir
 // - stopch: 非nil的channel用来停止监听
 func (s *Consul) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return s.watchTree(context.Background(), directory, stopCh)
+}
+
+// watchTree issues the blocking queries with ctx and stops once stopCh is closed
+func (s *Consul) watchTree(ctx context.Context, directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
 	kv := s.client.KV()
 	watchCh := make(chan []*store.KVPair)
 
@@ -312,7 +670,7 @@ func (s *Consul) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*
 		defer close(watchCh)
 
 		// 使用等待时间去check是否应该退出监听，当指定 `WaitTime > 0` 时，api是阻塞式查询
-		opts := &api.QueryOptions{WaitTime: DefaultWatchWaitTime}
+		opts := (&api.QueryOptions{WaitTime: DefaultWatchWaitTime}).WithContext(ctx)
 		for {
 			// Check退出信号
 			select {
@@ -343,14 +701,102 @@ func (s *Consul) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*
 					LastIndex: pair.ModifyIndex,
 				})
 			}
-			watchCh <- kvpairs
+			select {
+			case watchCh <- kvpairs:
+			case <-stopCh:
+				return
+			}
 		}
 	}()
 
 	return watchCh, nil
 }
 
-// Close the client connection
+// WatchEvents watches for changes on child nodes under a given directory, the events
+// are the diff between the results of consecutive blocking queries. Consul can't tell
+// an expired key apart so every removed key is reported as store.EventDelete
+func (s *Consul) WatchEvents(directory string, stopCh <-chan struct{}) (<-chan *store.Event, error) {
+	return s.watchEvents(context.Background(), directory, stopCh)
+}
+
+func (s *Consul) watchEvents(ctx context.Context, directory string, stopCh <-chan struct{}) (<-chan *store.Event, error) {
+	kv := s.client.KV()
+	directory = s.normalize(directory)
+	eventCh := make(chan *store.Event)
+
+	// 使用等待时间去check是否应该退出监听，当指定 `WaitTime > 0` 时，api是阻塞式查询
+	opts := (&api.QueryOptions{WaitTime: DefaultWatchWaitTime}).WithContext(ctx)
+	list := func() ([]*store.KVPair, error) {
+		pairs, meta, err := kv.List(directory, opts)
+		if err != nil {
+			return nil, err
+		}
+		opts.WaitIndex = meta.LastIndex
+
+		kvpairs := []*store.KVPair{}
+		for _, pair := range pairs {
+			if pair.Key == directory {
+				continue
+			}
+			kvpairs = append(kvpairs, &store.KVPair{
+				Key:       pair.Key,
+				Value:     pair.Value,
+				LastIndex: pair.ModifyIndex,
+			})
+		}
+		return kvpairs, nil
+	}
+
+	// the current content is the base of the diff, the changes made
+	// once WatchEvents returns are reported
+	prev, err := list()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer close(eventCh)
+
+		for {
+			// Check退出信号
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+
+			waitIndex := opts.WaitIndex
+			pairs, err := list()
+			if err != nil {
+				return
+			}
+			if opts.WaitIndex == waitIndex {
+				continue
+			}
+
+			events := store.DiffEvents(prev, pairs)
+			prev = pairs
+			for _, event := range events {
+				select {
+				case eventCh <- event:
+				case <-stopCh:
+					return
+				}
+			}
+		}
+	}()
+
+	return eventCh, nil
+}
+
+// Close the store, the sessions of the ephemeral keys are destroyed so the keys are deleted
 func (s *Consul) Close() {
-	return
+	s.sessionsMu.Lock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	s.sessionsMu.Unlock()
+	s.wg.Wait()
 }
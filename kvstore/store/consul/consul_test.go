@@ -51,5 +51,66 @@ func TestConsulStore(t *testing.T) {
 	defer testutils.RunCleanup(t, kv)
 
 	testutils.RunTestCommon(t, kv)
+	testutils.RunTestAtomic(t, kv)
+	testutils.RunTestTxn(t, kv)
+	testutils.RunTestBatch(t, kv)
+	testutils.RunTestLock(t, kv)
 	testutils.RunTestWatch(t, kv)
+	testutils.RunTestWatchEvents(t, kv)
+}
+
+// go test -v -run TestConsulEphemeral github.com/beyondyyh/libs/kvstore/store/consul
+func TestConsulEphemeral(t *testing.T) {
+	assert := assert.New(t)
+	kv := makeConsulClient(t)
+	other := makeConsulClient(t)
+	defer other.Close()
+
+	assert.NoError(kv.Put("testConsulEphemeral", []byte("foo"), &store.WriteOptions{Ephemeral: true}))
+	// the key is held by the session of kv
+	assert.Equal(ErrKeyHeld, other.Put("testConsulEphemeral", []byte("bar"), &store.WriteOptions{Ephemeral: true}))
+
+	// the session deletes the key once destroyed by Close
+	kv.Close()
+	_, err := other.Get("testConsulEphemeral")
+	assert.Equal(store.ErrKeyNotFound, err)
+	assert.Equal(ErrClosed, kv.Put("testConsulEphemeral", []byte("foo"), &store.WriteOptions{Ephemeral: true}))
+}
+
+// go test -v -run TestListSnapshot github.com/beyondyyh/libs/kvstore/store/consul
+func TestListSnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	id, after, err := parseCursor("")
+	assert.NoError(err)
+	assert.Equal(uint64(0), id)
+	assert.Equal("", after)
+
+	id, after, err = parseCursor(formatCursor(3, "testListPage/key:09"))
+	assert.NoError(err)
+	assert.Equal(uint64(3), id)
+	assert.Equal("testListPage/key:09", after)
+
+	for _, cursor := range []string{"testListPage/key09", "0:key", "a:key", ":key"} {
+		_, _, err = parseCursor(cursor)
+		assert.Equal(store.ErrInvalidCursor, err, cursor)
+	}
+
+	s := &Consul{snapshots: make(map[uint64]*keySnapshot)}
+	keys := []string{"dir/a", "dir/b"}
+	id = s.addSnapshot("dir", keys)
+	assert.Equal(keys, s.snapshot(id, "dir"))
+	// the listing belongs to its directory
+	assert.Nil(s.snapshot(id, "other"))
+	assert.Nil(s.snapshot(id+1, "dir"))
+
+	// the expired listings are dropped by the next one
+	s.snapshots[id].expire = time.Now().Add(-time.Second)
+	assert.Nil(s.snapshot(id, "dir"))
+	next := s.addSnapshot("dir", keys)
+	assert.NotEqual(id, next)
+	assert.Equal(1, len(s.snapshots))
+
+	s.dropSnapshot(next)
+	assert.Nil(s.snapshot(next, "dir"))
 }
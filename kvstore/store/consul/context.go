@@ -0,0 +1,78 @@
+package consul
+
+import (
+	"context"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// consulContext implements store.ContextStore, the http
+// requests to consul are canceled once ctx is done
+type consulContext struct {
+	*Consul
+}
+
+// ContextStore returns the context-aware variant of the store
+func (s *Consul) ContextStore() store.ContextStore {
+	return consulContext{s}
+}
+
+// Put a value at "key"
+func (c consulContext) Put(ctx context.Context, key string, value []byte, opts *store.WriteOptions) error {
+	return c.put(ctx, key, value, opts)
+}
+
+// Get the value at "key", returns the last modified index
+func (c consulContext) Get(ctx context.Context, key string) (*store.KVPair, error) {
+	return c.get(ctx, key)
+}
+
+// Delete the value at "key"
+func (c consulContext) Delete(ctx context.Context, key string) error {
+	return c.delete(ctx, key)
+}
+
+// Exists checks the key exists inside the store
+func (c consulContext) Exists(ctx context.Context, key string) (bool, error) {
+	return c.exists(ctx, key)
+}
+
+// Watch for changes on a "key" until ctx is done
+func (c consulContext) Watch(ctx context.Context, key string) (<-chan *store.KVPair, error) {
+	return c.watch(ctx, key, ctx.Done())
+}
+
+// WatchTree watches for changes on a "directory" until ctx is done
+func (c consulContext) WatchTree(ctx context.Context, directory string) (<-chan []*store.KVPair, error) {
+	return c.watchTree(ctx, directory, ctx.Done())
+}
+
+// List child nodes of a given directory
+func (c consulContext) List(ctx context.Context, directory string) ([]*store.KVPair, error) {
+	return c.list(ctx, directory)
+}
+
+// DeleteTree deletes a range of keys under a given directory
+func (c consulContext) DeleteTree(ctx context.Context, directory string) error {
+	return c.deleteTree(ctx, directory)
+}
+
+// AtomicPut put a value at "key" if the key has not been modified in the meantime
+func (c consulContext) AtomicPut(ctx context.Context, key string, value []byte, previous *store.KVPair, opts *store.WriteOptions) (bool, *store.KVPair, error) {
+	return c.atomicPut(ctx, key, value, previous, opts)
+}
+
+// AtomicDelete deletes a value at "key" if the key has not been modified in the meantime
+func (c consulContext) AtomicDelete(ctx context.Context, key string, previous *store.KVPair) (bool, error) {
+	return c.atomicDelete(ctx, key, previous)
+}
+
+// Txn applies ops atomically with the consul transaction API
+func (c consulContext) Txn(ctx context.Context, ops []*store.TxnOp) ([]*store.KVPair, error) {
+	return c.txn(ctx, ops)
+}
+
+// NewLock creates a lock for a given key, no request is issued until Lock
+func (c consulContext) NewLock(ctx context.Context, key string, options *store.LockOptions) (store.Locker, error) {
+	return c.Consul.NewLock(key, options)
+}
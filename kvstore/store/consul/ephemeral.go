@@ -0,0 +1,82 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+var (
+	// ErrClosed is thrown when an ephemeral key is put after Close
+	ErrClosed = errors.New("consul: store closed")
+
+	// ErrKeyHeld is thrown when an ephemeral key is held by the session of another client
+	ErrKeyHeld = errors.New("consul: key held by another session")
+)
+
+// putEphemeral writes p acquired by the session of the store for ttl, defaultLockTTL if 0.
+// The session deletes its keys once it's destroyed by Close or expired with the process,
+// consul requires a ttl of 20s at least since it's the double of the session ttl
+func (s *Consul) putEphemeral(ctx context.Context, p *api.KVPair, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+	session, err := s.ephemeralSession(ctx, ttl)
+	if err != nil {
+		return err
+	}
+
+	p.Session = session
+	ok, _, err := s.client.KV().Acquire(p, writeOptions(ctx))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrKeyHeld
+	}
+	return nil
+}
+
+// ephemeralSession returns the session of the ephemeral keys with ttl, it's created
+// on the first use and renewed until Close or until it's invalidated
+func (s *Consul) ephemeralSession(ctx context.Context, ttl time.Duration) (string, error) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	select {
+	case <-s.done:
+		return "", ErrClosed
+	default:
+	}
+	if session, ok := s.sessions[ttl]; ok {
+		return session, nil
+	}
+
+	entry := &api.SessionEntry{
+		Behavior:  api.SessionBehaviorDelete, // Delete the keys when the session expires
+		TTL:       (ttl / 2).String(),        // Consul multiplies the TTL by 2x
+		LockDelay: 1 * time.Millisecond,      // Virtually disable lock delay
+	}
+	session, _, err := s.client.Session().Create(entry, writeOptions(ctx))
+	if err != nil {
+		return "", err
+	}
+	s.sessions[ttl] = session
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		// the session is destroyed once done is closed
+		s.client.Session().RenewPeriodic(entry.TTL, session, nil, s.done)
+
+		s.sessionsMu.Lock()
+		if s.sessions[ttl] == session {
+			delete(s.sessions, ttl)
+		}
+		s.sessionsMu.Unlock()
+	}()
+	return session, nil
+}
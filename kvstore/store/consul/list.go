@@ -0,0 +1,79 @@
+package consul
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// snapshotTTL is how long the keys of a listing are kept after its last page
+const snapshotTTL = time.Minute
+
+// keySnapshot is the key list of a directory fetched by the first page of a listing
+// and read by the following ones, so that a listing fetches the keys once only
+type keySnapshot struct {
+	directory string
+	keys      []string
+	expire    time.Time
+}
+
+// snapshot returns the keys of the listing id, nil if unknown or expired
+func (s *Consul) snapshot(id uint64, directory string) []string {
+	s.snapshotsMu.Lock()
+	defer s.snapshotsMu.Unlock()
+
+	snap, ok := s.snapshots[id]
+	if !ok || snap.directory != directory || time.Now().After(snap.expire) {
+		return nil
+	}
+	snap.expire = time.Now().Add(snapshotTTL)
+	return snap.keys
+}
+
+// addSnapshot keeps the keys of a new listing and returns its id,
+// the expired listings are dropped meanwhile
+func (s *Consul) addSnapshot(directory string, keys []string) uint64 {
+	s.snapshotsMu.Lock()
+	defer s.snapshotsMu.Unlock()
+
+	now := time.Now()
+	for id, snap := range s.snapshots {
+		if now.After(snap.expire) {
+			delete(s.snapshots, id)
+		}
+	}
+	s.snapshotSeq++
+	s.snapshots[s.snapshotSeq] = &keySnapshot{directory: directory, keys: keys, expire: now.Add(snapshotTTL)}
+	return s.snapshotSeq
+}
+
+// dropSnapshot forgets the keys of an exhausted listing
+func (s *Consul) dropSnapshot(id uint64) {
+	s.snapshotsMu.Lock()
+	defer s.snapshotsMu.Unlock()
+
+	delete(s.snapshots, id)
+}
+
+// formatCursor returns the cursor of the page following key in the listing id
+func formatCursor(id uint64, key string) string {
+	return strconv.FormatUint(id, 10) + ":" + key
+}
+
+// parseCursor returns the listing and the last key of a cursor, "" is the first page
+func parseCursor(cursor string) (uint64, string, error) {
+	if cursor == "" {
+		return 0, "", nil
+	}
+	i := strings.IndexByte(cursor, ':')
+	if i < 0 {
+		return 0, "", store.ErrInvalidCursor
+	}
+	id, err := strconv.ParseUint(cursor[:i], 10, 64)
+	if err != nil || id == 0 {
+		return 0, "", store.ErrInvalidCursor
+	}
+	return id, cursor[i+1:], nil
+}
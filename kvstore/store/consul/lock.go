@@ -0,0 +1,154 @@
+package consul
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// consulLock implements store.Locker with a consul session,
+// a new session is created for every Lock and destroyed on Unlock
+type consulLock struct {
+	mu    sync.Mutex
+	s     *Consul
+	key   string
+	value []byte
+	ttl   time.Duration
+
+	lock    *api.Lock
+	renewCh chan struct{}
+}
+
+// NewLock creates a lock for a given key.
+// The returned Locker is not held and must be acquired
+// with `.Lock`. The Value is optional.
+func (s *Consul) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	lock := &consulLock{
+		s:   s,
+		key: s.normalize(key),
+		ttl: defaultLockTTL,
+	}
+
+	if options != nil {
+		// Set optional TTL on Lock
+		if options.TTL != 0 {
+			lock.ttl = options.TTL
+		}
+		// Set optional value on Lock
+		lock.value = options.Value
+	}
+
+	return lock, nil
+}
+
+// Lock attempts to acquire the lock and blocks while
+// doing so. It returns a channel that is closed if our
+// lock is lost or if an error occurs
+func (l *consulLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.lock != nil {
+		return nil, store.ErrCannotLock
+	}
+
+	entry := &api.SessionEntry{
+		Behavior:  api.SessionBehaviorRelease, // Release the lock when the session expires
+		TTL:       (l.ttl / 2).String(),       // Consul multiplies the TTL by 2x
+		LockDelay: 1 * time.Millisecond,       // Virtually disable lock delay
+	}
+
+	// Create the session
+	session, _, err := l.s.client.Session().Create(entry, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Renew the session ttl lock periodically
+	renewCh := make(chan struct{})
+	l.s.renewLockSession(l.ttl/2, session, renewCh)
+
+	lock, err := l.s.client.LockOpts(&api.LockOptions{
+		Key:     l.key,
+		Value:   l.value,
+		Session: session,
+	})
+	if err != nil {
+		close(renewCh)
+		return nil, err
+	}
+
+	lostCh, err := lock.Lock(stopCh)
+	if err != nil || lostCh == nil {
+		close(renewCh)
+		return nil, err
+	}
+
+	l.lock = lock
+	l.renewCh = renewCh
+	return lostCh, nil
+}
+
+// Unlock the "key". Calling unlock while
+// not holding the lock will throw an error
+func (l *consulLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.lock == nil {
+		return store.ErrLockNotHeld
+	}
+
+	err := l.lock.Unlock()
+	close(l.renewCh)
+	l.lock, l.renewCh = nil, nil
+
+	if err == api.ErrLockNotHeld {
+		return store.ErrLockNotHeld
+	}
+	return err
+}
+
+// renewLockSession renews the session until stopRenew is closed,
+// the session is destroyed explicitly on exit
+func (s *Consul) renewLockSession(ttl time.Duration, id string, stopRenew chan struct{}) {
+	sessionDestroyAttempts := 0
+
+	go func() {
+		for {
+			select {
+			case <-time.After(ttl / 2):
+				entry, _, err := s.client.Session().Renew(id, nil)
+				if err != nil {
+					// If an error occurs, continue until the
+					// session gets destroyed explicitly or
+					// the session ttl times out
+					sessionDestroyAttempts++
+					if sessionDestroyAttempts >= MaxSessionDestroyAttempts {
+						// Session destroy attempts exceeded, clean up
+						s.client.Session().Destroy(id, nil)
+						return
+					}
+					continue
+				}
+				// The session has been invalidated
+				if entry == nil {
+					return
+				}
+
+				// Reset the session destroy counter
+				sessionDestroyAttempts = 0
+				if d, err := time.ParseDuration(entry.TTL); err == nil {
+					ttl = d
+				}
+			case <-stopRenew:
+				// Explicit Session destroy
+				s.client.Session().Destroy(id, nil)
+				return
+			}
+		}
+	}()
+}
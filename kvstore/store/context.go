@@ -0,0 +1,255 @@
+package store
+
+import (
+	"context"
+)
+
+// ContextStore is the context.Context-aware variant of Store,
+// the calls honor the deadline and cancellation of ctx.
+// Watches are stopped once ctx is done.
+type ContextStore interface {
+	// Put a value at the specified key
+	Put(ctx context.Context, key string, value []byte, options *WriteOptions) error
+
+	// Get a value given its key
+	Get(ctx context.Context, key string) (*KVPair, error)
+
+	// Delete the key at the specified key
+	Delete(ctx context.Context, key string) error
+
+	// Verify if a key exists in the store
+	Exists(ctx context.Context, key string) (bool, error)
+
+	// Watch for changes on a key until ctx is done
+	Watch(ctx context.Context, key string) (<-chan *KVPair, error)
+
+	// WatchTree watches for changes on child nodes under a given directory until ctx is done
+	WatchTree(ctx context.Context, directory string) (<-chan []*KVPair, error)
+
+	// List the content of a given prefix
+	List(ctx context.Context, directory string) ([]*KVPair, error)
+
+	// DeleteTree deletes a range keys under a given directory
+	DeleteTree(ctx context.Context, directory string) error
+
+	// AtomicPut is a CAS operation on a single value,
+	// pass previous = nil to create a new key
+	AtomicPut(ctx context.Context, key string, value []byte, previous *KVPair, options *WriteOptions) (bool, *KVPair, error)
+
+	// AtomicDelete deletes a single value only if it's not modified since previous
+	AtomicDelete(ctx context.Context, key string, previous *KVPair) (bool, error)
+
+	// Txn applies ops in order, all of them or none, see Store.Txn
+	Txn(ctx context.Context, ops []*TxnOp) ([]*KVPair, error)
+
+	// NewLock creates a lock for a given key,
+	// pass ctx.Done() to Locker.Lock to bound the acquisition
+	NewLock(ctx context.Context, key string, options *LockOptions) (Locker, error)
+
+	// Close the store connection
+	Close()
+}
+
+// ContextStorer is implemented by the backends which
+// honor deadlines and cancellation natively
+type ContextStorer interface {
+	ContextStore() ContextStore
+}
+
+// WithContext returns the context-aware variant of s.
+// For the backends which don't implement ContextStorer,
+// ctx is only checked before issuing every call
+func WithContext(s Store) ContextStore {
+	if cs, ok := s.(ContextStorer); ok {
+		return cs.ContextStore()
+	}
+	if a, ok := s.(storeAdapter); ok {
+		return a.cs
+	}
+	return contextAdapter{s: s}
+}
+
+// WithoutContext adapts cs to Store so that existing
+// Store users keep working, every call uses context.Background()
+func WithoutContext(cs ContextStore) Store {
+	if a, ok := cs.(contextAdapter); ok {
+		return a.s
+	}
+	return storeAdapter{cs: cs}
+}
+
+// contextAdapter implements ContextStore on top of a Store
+type contextAdapter struct {
+	s Store
+}
+
+func (a contextAdapter) Put(ctx context.Context, key string, value []byte, options *WriteOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.s.Put(key, value, options)
+}
+
+func (a contextAdapter) Get(ctx context.Context, key string) (*KVPair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.s.Get(key)
+}
+
+func (a contextAdapter) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.s.Delete(key)
+}
+
+func (a contextAdapter) Exists(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return a.s.Exists(key)
+}
+
+func (a contextAdapter) Watch(ctx context.Context, key string) (<-chan *KVPair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.s.Watch(key, ctx.Done())
+}
+
+func (a contextAdapter) WatchTree(ctx context.Context, directory string) (<-chan []*KVPair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.s.WatchTree(directory, ctx.Done())
+}
+
+func (a contextAdapter) List(ctx context.Context, directory string) ([]*KVPair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.s.List(directory)
+}
+
+func (a contextAdapter) DeleteTree(ctx context.Context, directory string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.s.DeleteTree(directory)
+}
+
+func (a contextAdapter) AtomicPut(ctx context.Context, key string, value []byte, previous *KVPair, options *WriteOptions) (bool, *KVPair, error) {
+	if err := ctx.Err(); err != nil {
+		return false, nil, err
+	}
+	return a.s.AtomicPut(key, value, previous, options)
+}
+
+func (a contextAdapter) AtomicDelete(ctx context.Context, key string, previous *KVPair) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return a.s.AtomicDelete(key, previous)
+}
+
+func (a contextAdapter) Txn(ctx context.Context, ops []*TxnOp) ([]*KVPair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.s.Txn(ops)
+}
+
+func (a contextAdapter) NewLock(ctx context.Context, key string, options *LockOptions) (Locker, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.s.NewLock(key, options)
+}
+
+func (a contextAdapter) Close() {
+	a.s.Close()
+}
+
+// storeAdapter implements Store on top of a ContextStore
+type storeAdapter struct {
+	cs ContextStore
+}
+
+func (a storeAdapter) Put(key string, value []byte, options *WriteOptions) error {
+	return a.cs.Put(context.Background(), key, value, options)
+}
+
+func (a storeAdapter) Get(key string) (*KVPair, error) {
+	return a.cs.Get(context.Background(), key)
+}
+
+func (a storeAdapter) Delete(key string) error {
+	return a.cs.Delete(context.Background(), key)
+}
+
+func (a storeAdapter) Exists(key string) (bool, error) {
+	return a.cs.Exists(context.Background(), key)
+}
+
+func (a storeAdapter) Watch(key string, stopCh <-chan struct{}) (<-chan *KVPair, error) {
+	ctx, cancel := StopContext(stopCh)
+	ch, err := a.cs.Watch(ctx, key)
+	if err != nil {
+		cancel()
+	}
+	return ch, err
+}
+
+func (a storeAdapter) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*KVPair, error) {
+	ctx, cancel := StopContext(stopCh)
+	ch, err := a.cs.WatchTree(ctx, directory)
+	if err != nil {
+		cancel()
+	}
+	return ch, err
+}
+
+func (a storeAdapter) List(directory string) ([]*KVPair, error) {
+	return a.cs.List(context.Background(), directory)
+}
+
+func (a storeAdapter) DeleteTree(directory string) error {
+	return a.cs.DeleteTree(context.Background(), directory)
+}
+
+func (a storeAdapter) AtomicPut(key string, value []byte, previous *KVPair, options *WriteOptions) (bool, *KVPair, error) {
+	return a.cs.AtomicPut(context.Background(), key, value, previous, options)
+}
+
+func (a storeAdapter) AtomicDelete(key string, previous *KVPair) (bool, error) {
+	return a.cs.AtomicDelete(context.Background(), key, previous)
+}
+
+func (a storeAdapter) Txn(ops []*TxnOp) ([]*KVPair, error) {
+	return a.cs.Txn(context.Background(), ops)
+}
+
+func (a storeAdapter) NewLock(key string, options *LockOptions) (Locker, error) {
+	return a.cs.NewLock(context.Background(), key, options)
+}
+
+func (a storeAdapter) Close() {
+	a.cs.Close()
+}
+
+// StopContext returns a context which is canceled once stopCh is closed,
+// cancel must be called to release the resources if stopCh is never closed
+func StopContext(stopCh <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if stopCh != nil {
+		go func() {
+			select {
+			case <-stopCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return ctx, cancel
+}
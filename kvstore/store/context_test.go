@@ -0,0 +1,62 @@
+package store_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/store/memory"
+	"github.com/beyondyyh/libs/kvstore/testutils"
+)
+
+// run all: go test -v github.com/beyondyyh/libs/kvstore/store
+
+// go test -v -run TestWithContext github.com/beyondyyh/libs/kvstore/store
+func TestWithContext(t *testing.T) {
+	assert := assert.New(t)
+	kv, _ := memory.New(nil, nil)
+	defer kv.Close()
+
+	cs := store.WithContext(kv)
+	assert.Equal(kv, store.WithoutContext(cs))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(cs.Put(ctx, "testWithContext", []byte("bar"), nil))
+	pair, err := cs.Get(ctx, "testWithContext")
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), pair.Value)
+
+	events, err := cs.Watch(ctx, "testWithContext")
+	assert.NoError(err)
+	<-events
+
+	// the watch is stopped and the calls fail once canceled
+	cancel()
+	select {
+	case _, ok := <-events:
+		assert.False(ok)
+	case <-time.After(time.Second):
+		t.Fatal("Timeout reached")
+	}
+	_, err = cs.Get(ctx, "testWithContext")
+	assert.Equal(context.Canceled, err)
+	assert.Equal(context.Canceled, cs.Put(ctx, "testWithContext", nil, nil))
+}
+
+// go test -v -run TestWithoutContext github.com/beyondyyh/libs/kvstore/store
+func TestWithoutContext(t *testing.T) {
+	kv, _ := memory.New(nil, nil)
+	defer kv.Close()
+
+	// hide the underlying store so that WithoutContext can't unwrap it
+	cs := struct{ store.ContextStore }{store.WithContext(kv)}
+	s := store.WithoutContext(cs)
+	defer testutils.RunCleanup(t, s)
+
+	testutils.RunTestCommon(t, s)
+	testutils.RunTestAtomic(t, s)
+	testutils.RunTestWatch(t, s)
+}
@@ -0,0 +1,512 @@
+package dir
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/beyondyyh/libs/kvstore"
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// defaultPollInterval is the delay between two polls of the watches
+const defaultPollInterval = 500 * time.Millisecond
+
+var (
+	// ErrRootRequired is returned when no endpoint is given as the root directory
+	ErrRootRequired = errors.New("dir: the root directory is required")
+	// ErrMultipleEndpointsUnsupported is thrown when multiple endpoints specified
+	ErrMultipleEndpointsUnsupported = errors.New("dir: does not support multiple endpoints")
+	// ErrInvalidKey is returned for the keys which can't be mapped onto a file,
+	// the parts of a key must not be "." or "..", nor start with "." which is left to the editors
+	ErrInvalidKey = errors.New("dir: invalid key")
+	// ErrKeyIsDirectory is returned when writing a key which is the directory of other keys
+	ErrKeyIsDirectory = errors.New("dir: key is a directory")
+)
+
+// Dir implements store.Store with a file per key under a root directory, so that the keys
+// can be edited with a text editor. The parts of the key are the directories of the file,
+// thus a key can't be both a value and the directory of other keys.
+//
+// LastIndex is the modification time of the file in nanoseconds, the writes of the store
+// make sure it increases. The writes are atomic thanks to a rename but the atomic operations
+// are only atomic within the process. The watches poll the files every ResyncInterval,
+// the TTLs are kept in memory thus lost once the store is closed
+type Dir struct {
+	root    string
+	watcher *store.PollingWatcher
+
+	mu     sync.Mutex // serializes the writes
+	timers map[string]*time.Timer
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var (
+	_ store.ErrorWatcher = (*Dir)(nil)
+	_ store.EventWatcher = (*Dir)(nil)
+)
+
+func Register() {
+	kvstore.AddStore(store.DIR, New)
+}
+
+// New creates a store rooted at the directory endpoints[0], which is created if missing
+func New(endpoints []string, options *store.Config) (store.Store, error) {
+	if len(endpoints) == 0 || endpoints[0] == "" {
+		return nil, ErrRootRequired
+	}
+	if len(endpoints) > 1 {
+		return nil, ErrMultipleEndpointsUnsupported
+	}
+
+	root, err := filepath.Abs(endpoints[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	interval := defaultPollInterval
+	if options != nil && options.ResyncInterval > 0 {
+		interval = options.ResyncInterval
+	}
+
+	d := &Dir{
+		root:   root,
+		timers: make(map[string]*time.Timer),
+		done:   make(chan struct{}),
+	}
+	d.watcher = store.NewPollingWatcher(d, interval, 0)
+	return d, nil
+}
+
+// normalize returns the key without the empty parts and the path of its file
+func (d *Dir) normalize(key string) (string, string, error) {
+	parts := strings.FieldsFunc(key, func(r rune) bool { return r == '/' })
+	for _, part := range parts {
+		if strings.HasPrefix(part, ".") || strings.ContainsRune(part, filepath.Separator) {
+			return "", "", ErrInvalidKey
+		}
+	}
+	return strings.Join(parts, "/"), filepath.Join(append([]string{d.root}, parts...)...), nil
+}
+
+// Put a value at the specified key, the ephemeral keys are not supported since the files outlive the process
+func (d *Dir) Put(key string, value []byte, options *store.WriteOptions) error {
+	if options != nil && options.Ephemeral {
+		return store.ErrCallNotSupported
+	}
+	nKey, path, err := d.normalize(key)
+	if err != nil {
+		return err
+	}
+	if nKey == "" {
+		return ErrKeyIsDirectory
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	prev, err := read(nKey, path)
+	if err != nil && err != store.ErrKeyNotFound {
+		return err
+	}
+	_, err = d.write(nKey, path, value, prev, options)
+	return err
+}
+
+// write replaces the file of key then sets its ttl, caller must hold the lock
+func (d *Dir) write(key, path string, value []byte, prev *store.KVPair, options *store.WriteOptions) (*store.KVPair, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return nil, ErrKeyIsDirectory
+	}
+
+	parent := filepath.Dir(path)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(parent, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmp.Write(value)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	// the index must change even if the clock did not move since the previous write
+	if prev != nil && uint64(info.ModTime().UnixNano()) <= prev.LastIndex {
+		mtime := time.Unix(0, int64(prev.LastIndex+1))
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			return nil, err
+		}
+		if info, err = os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+
+	pair := &store.KVPair{Key: key, Value: value, LastIndex: uint64(info.ModTime().UnixNano())}
+	d.setTTL(key, pair.LastIndex, options)
+	return pair, nil
+}
+
+// setTTL replaces the timer removing key once expired, caller must hold the lock
+func (d *Dir) setTTL(key string, index uint64, options *store.WriteOptions) {
+	if timer, ok := d.timers[key]; ok {
+		timer.Stop()
+		delete(d.timers, key)
+	}
+	if options == nil || options.TTL <= 0 {
+		return
+	}
+	d.timers[key] = time.AfterFunc(options.TTL, func() {
+		d.expire(key, index)
+	})
+}
+
+// expire removes the key once its ttl is reached, unless it has been rewritten since
+func (d *Dir) expire(key string, index uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, path, _ := d.normalize(key)
+	if pair, err := read(key, path); err == nil && pair.LastIndex == index {
+		d.remove(key, path)
+	}
+}
+
+// remove deletes the file of key and its empty parents, caller must hold the lock
+func (d *Dir) remove(key, path string) error {
+	if timer, ok := d.timers[key]; ok {
+		timer.Stop()
+		delete(d.timers, key)
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return store.ErrKeyNotFound
+		}
+		return err
+	}
+	d.prune(filepath.Dir(path))
+	return nil
+}
+
+// prune removes dir and its parents up to the root as long as they are empty
+func (d *Dir) prune(dir string) {
+	for dir != d.root && strings.HasPrefix(dir, d.root) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// read returns the pair stored in the file at path
+func read(key, path string) (*store.KVPair, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		return nil, store.ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, store.ErrKeyNotFound
+	}
+	value, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return &store.KVPair{Key: key, Value: value, LastIndex: uint64(info.ModTime().UnixNano())}, nil
+}
+
+// Get a value given its key
+func (d *Dir) Get(key string) (*store.KVPair, error) {
+	nKey, path, err := d.normalize(key)
+	if err != nil {
+		return nil, err
+	}
+	return read(nKey, path)
+}
+
+// Delete the value at the specified key
+func (d *Dir) Delete(key string) error {
+	nKey, path, err := d.normalize(key)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return store.ErrKeyNotFound
+	}
+	return d.remove(nKey, path)
+}
+
+// Verify if a key exists in the store
+func (d *Dir) Exists(key string) (bool, error) {
+	_, err := d.Get(key)
+	if err == store.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// List the content of a given directory, the sub directories included
+func (d *Dir) List(directory string) ([]*store.KVPair, error) {
+	_, path, err := d.normalize(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var pairs []*store.KVPair
+	err = filepath.WalkDir(path, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if p == path {
+			if !entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// the hidden files are the temporary files of the editors and of write
+		if strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		pair, err := read(key, p)
+		if err == store.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pairs = append(pairs, pair)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs, nil
+}
+
+// DeleteTree deletes a range of keys under a given directory
+func (d *Dir) DeleteTree(directory string) error {
+	nKey, path, err := d.normalize(directory)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return store.ErrKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return d.remove(nKey, path)
+	}
+
+	for key, timer := range d.timers {
+		if nKey == "" || strings.HasPrefix(key, nKey+"/") {
+			timer.Stop()
+			delete(d.timers, key)
+		}
+	}
+	if path == d.root {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := os.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	d.prune(filepath.Dir(path))
+	return nil
+}
+
+// AtomicPut is a CAS operation on a single value,
+// pass previous = nil to create a new key. The ephemeral keys are not supported, see Put
+func (d *Dir) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	if options != nil && options.Ephemeral {
+		return false, nil, store.ErrCallNotSupported
+	}
+	nKey, path, err := d.normalize(key)
+	if err != nil {
+		return false, nil, err
+	}
+	if nKey == "" {
+		return false, nil, ErrKeyIsDirectory
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	current, err := read(nKey, path)
+	if err != nil && err != store.ErrKeyNotFound {
+		return false, nil, err
+	}
+	if previous == nil {
+		if current != nil {
+			return false, nil, store.ErrKeyExists
+		}
+	} else {
+		if current == nil {
+			return false, nil, store.ErrKeyNotFound
+		}
+		if current.LastIndex != previous.LastIndex {
+			return false, nil, store.ErrKeyModified
+		}
+	}
+
+	pair, err := d.write(nKey, path, value, current, options)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, pair, nil
+}
+
+// AtomicDelete deletes a single value only if it's not modified since previous
+func (d *Dir) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	if previous == nil {
+		return false, store.ErrPreviousNotSpecified
+	}
+	nKey, path, err := d.normalize(key)
+	if err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	current, err := read(nKey, path)
+	if err != nil {
+		return false, err
+	}
+	if current.LastIndex != previous.LastIndex {
+		return false, store.ErrKeyModified
+	}
+	if err := d.remove(nKey, path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Txn is not supported, the files can't be written together atomically
+func (d *Dir) Txn(ops []*store.TxnOp) ([]*store.KVPair, error) {
+	return nil, store.ErrCallNotSupported
+}
+
+// Watch for changes on a key by polling its file
+func (d *Dir) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	return d.watcher.Watch(key, d.stop(stopCh))
+}
+
+// WatchWithErrors is Watch with the errors of the polls reported on the error channel
+func (d *Dir) WatchWithErrors(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, <-chan error, error) {
+	return d.watcher.WatchWithErrors(key, d.stop(stopCh))
+}
+
+// WatchTree watches for changes on child nodes under a given directory by polling its files
+func (d *Dir) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return d.watcher.WatchTree(directory, d.stop(stopCh))
+}
+
+// WatchTreeWithErrors is WatchTree with the errors of the polls reported on the error channel
+func (d *Dir) WatchTreeWithErrors(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, <-chan error, error) {
+	return d.watcher.WatchTreeWithErrors(directory, d.stop(stopCh))
+}
+
+// WatchEvents watches for changes on child nodes under a given directory by polling its files
+func (d *Dir) WatchEvents(directory string, stopCh <-chan struct{}) (<-chan *store.Event, error) {
+	return d.watcher.WatchEvents(directory, d.stop(stopCh))
+}
+
+// stop returns a channel closed once stopCh is closed or the store is closed
+func (d *Dir) stop(stopCh <-chan struct{}) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		select {
+		case <-stopCh:
+		case <-d.done:
+		}
+	}()
+	return ch
+}
+
+// Close the store, all the watches are stopped and the pending TTLs are dropped
+func (d *Dir) Close() {
+	d.closeOnce.Do(func() {
+		close(d.done)
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for key, timer := range d.timers {
+			timer.Stop()
+			delete(d.timers, key)
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package dir
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore"
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/testutils"
+)
+
+// run all: go test -v github.com/beyondyyh/libs/kvstore/store/dir
+
+func makeDirClient(t *testing.T, root string) *Dir {
+	kv, err := New([]string{root}, &store.Config{ResyncInterval: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	return kv.(*Dir)
+}
+
+// go test -v -run TestRegister github.com/beyondyyh/libs/kvstore/store/dir
+func TestRegister(t *testing.T) {
+	Register()
+
+	assert := assert.New(t)
+	kv, err := kvstore.NewStore(store.DIR, []string{t.TempDir()}, nil)
+	assert.NoError(err)
+	assert.NotNil(kv)
+	defer kv.Close()
+
+	if _, ok := kv.(*Dir); !ok {
+		t.Fatal("Error registering and initializing dir")
+	}
+
+	_, err = kvstore.NewStore(store.DIR, nil, nil)
+	assert.Equal(ErrRootRequired, err)
+}
+
+// go test -v -run TestDirStore github.com/beyondyyh/libs/kvstore/store/dir
+func TestDirStore(t *testing.T) {
+	kv := makeDirClient(t, t.TempDir())
+	defer kv.Close()
+	defer testutils.RunCleanup(t, kv)
+
+	testutils.RunTestCommon(t, kv)
+	testutils.RunTestAtomic(t, kv)
+	testutils.RunTestLock(t, kv)
+	testutils.RunTestWatch(t, kv)
+	testutils.RunTestWatchEvents(t, kv)
+}
+
+// go test -v -run TestDirLayout github.com/beyondyyh/libs/kvstore/store/dir
+func TestDirLayout(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	kv := makeDirClient(t, root)
+	defer kv.Close()
+
+	// the keys are files under the root
+	assert.NoError(kv.Put("/testLayout/app/config", []byte("foo"), nil))
+	data, err := os.ReadFile(filepath.Join(root, "testLayout", "app", "config"))
+	assert.NoError(err)
+	assert.Equal("foo", string(data))
+
+	// a key can't be both a value and a directory
+	assert.Equal(ErrKeyIsDirectory, kv.Put("testLayout/app", []byte("foo"), nil))
+	assert.Error(kv.Put("testLayout/app/config/sub", []byte("foo"), nil))
+
+	for _, key := range []string{"testLayout/../escape", "testLayout/./key", "testLayout/.hidden"} {
+		assert.Equal(ErrInvalidKey, kv.Put(key, []byte("foo"), nil), key)
+	}
+
+	// the files edited by hand are seen by the watches, the hidden ones are ignored
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	events, err := kv.Watch("testLayout/app/config", stopCh)
+	assert.NoError(err)
+	pair := <-events
+	assert.Equal([]byte("foo"), pair.Value)
+
+	assert.NoError(os.WriteFile(filepath.Join(root, "testLayout", "app", ".config.swp"), []byte("swap"), 0644))
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(os.WriteFile(filepath.Join(root, "testLayout", "app", "config"), []byte("bar"), 0644))
+	select {
+	case pair = <-events:
+		assert.Equal([]byte("bar"), pair.Value)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout reached")
+	}
+
+	pairs, err := kv.List("testLayout")
+	assert.NoError(err)
+	if assert.Equal(1, len(pairs)) {
+		assert.Equal("testLayout/app/config", pairs[0].Key)
+	}
+
+	// the empty directories are removed along with the last key
+	assert.NoError(kv.Delete("testLayout/app/config"))
+	_, err = os.Stat(filepath.Join(root, "testLayout", "app", "config"))
+	assert.True(os.IsNotExist(err))
+	assert.NoError(kv.DeleteTree("testLayout"))
+	_, err = os.Stat(filepath.Join(root, "testLayout"))
+	assert.True(os.IsNotExist(err))
+}
+
+// go test -v -run TestDirTTL github.com/beyondyyh/libs/kvstore/store/dir
+func TestDirTTL(t *testing.T) {
+	assert := assert.New(t)
+	kv := makeDirClient(t, t.TempDir())
+	defer kv.Close()
+
+	assert.NoError(kv.Put("testTTL/expired", []byte("foo"), &store.WriteOptions{TTL: 100 * time.Millisecond}))
+	assert.NoError(kv.Put("testTTL/rewritten", []byte("foo"), &store.WriteOptions{TTL: 100 * time.Millisecond}))
+	assert.NoError(kv.Put("testTTL/rewritten", []byte("bar"), nil))
+
+	time.Sleep(300 * time.Millisecond)
+	_, err := kv.Get("testTTL/expired")
+	assert.Equal(store.ErrKeyNotFound, err)
+	pair, err := kv.Get("testTTL/rewritten")
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), pair.Value)
+}
+
+// go test -v -run TestDirLockTakeover github.com/beyondyyh/libs/kvstore/store/dir
+func TestDirLockTakeover(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	kv := makeDirClient(t, root)
+	defer kv.Close()
+
+	// a lock file left by a dead process
+	path := filepath.Join(root, "testLockTakeover")
+	assert.NoError(os.WriteFile(path, []byte("dead"), 0644))
+	old := time.Now().Add(-time.Minute)
+	assert.NoError(os.Chtimes(path, old, old))
+
+	lock, err := kv.NewLock("testLockTakeover", &store.LockOptions{Value: []byte("alive"), TTL: 300 * time.Millisecond})
+	assert.NoError(err)
+	lockCh, err := lock.Lock(nil)
+	assert.NoError(err)
+
+	// the lock is kept alive beyond its ttl while held
+	select {
+	case <-lockCh:
+		t.Fatal("Lock lost while held")
+	case <-time.After(time.Second):
+	}
+	pair, err := kv.Get("testLockTakeover")
+	assert.NoError(err)
+	assert.Equal([]byte("alive"), pair.Value)
+
+	assert.NoError(lock.Unlock())
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+}
+
+// go test -v -run TestDirLockTinyTTL github.com/beyondyyh/libs/kvstore/store/dir
+func TestDirLockTinyTTL(t *testing.T) {
+	assert := assert.New(t)
+	kv := makeDirClient(t, t.TempDir())
+	defer kv.Close()
+
+	// a ttl under 3ns used to make the renewal ticker panic
+	lock, err := kv.NewLock("testLockTinyTTL", &store.LockOptions{TTL: time.Nanosecond})
+	assert.NoError(err)
+	_, err = lock.Lock(nil)
+	assert.NoError(err)
+	time.Sleep(10 * time.Millisecond)
+	lock.Unlock()
+}
+
+// go test -v -run TestDirEphemeral github.com/beyondyyh/libs/kvstore/store/dir
+func TestDirEphemeral(t *testing.T) {
+	kv := makeDirClient(t, t.TempDir())
+	defer kv.Close()
+
+	err := kv.Put("testEphemeral", []byte("foo"), &store.WriteOptions{Ephemeral: true})
+	assert.Equal(t, store.ErrCallNotSupported, err)
+	_, _, err = kv.AtomicPut("testEphemeral", []byte("foo"), nil, &store.WriteOptions{Ephemeral: true})
+	assert.Equal(t, store.ErrCallNotSupported, err)
+}
+
+// go test -v -run TestDirTxn github.com/beyondyyh/libs/kvstore/store/dir
+func TestDirTxn(t *testing.T) {
+	kv := makeDirClient(t, t.TempDir())
+	defer kv.Close()
+
+	_, err := kv.Txn([]*store.TxnOp{store.PutOp("testTxn", []byte("foo"), nil)})
+	assert.Equal(t, store.ErrCallNotSupported, err)
+}
@@ -0,0 +1,168 @@
+package dir
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// defaultLockTTL is the default ttl for the dir lock
+const defaultLockTTL = 20 * time.Second
+
+// dirLock implements store.Locker with a file created exclusively. The modification time
+// of the file is refreshed while the lock is held, a file not refreshed for longer than
+// the ttl is left by a dead process and may be taken over, also by another process
+type dirLock struct {
+	mu    sync.Mutex
+	d     *Dir
+	key   string
+	value []byte
+	ttl   time.Duration
+
+	last     *store.KVPair
+	unlockCh chan struct{}
+}
+
+// NewLock creates a lock for a given key
+func (d *Dir) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	ttl := defaultLockTTL
+	var value []byte
+	if options != nil {
+		if options.TTL > 0 {
+			ttl = options.TTL
+		}
+		value = options.Value
+	}
+
+	return &dirLock{
+		d:     d,
+		key:   key,
+		value: value,
+		ttl:   ttl,
+	}, nil
+}
+
+// Lock attempts to acquire the lock and blocks while doing so,
+// the returned channel is closed if the lock is lost or released
+func (l *dirLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.last != nil {
+		return nil, store.ErrCannotLock
+	}
+
+	for {
+		_, pair, err := l.d.AtomicPut(l.key, l.value, nil, nil)
+		if err == nil {
+			l.last = pair
+			l.unlockCh = make(chan struct{})
+			lostCh := make(chan struct{})
+			go l.renewLoop(lostCh, l.unlockCh)
+			return lostCh, nil
+		}
+		if err != store.ErrKeyExists {
+			return nil, err
+		}
+
+		// take over a lock which is not refreshed anymore
+		if current, err := l.d.Get(l.key); err == nil && time.Since(time.Unix(0, int64(current.LastIndex))) > l.ttl {
+			l.d.AtomicDelete(l.key, current)
+			continue
+		}
+
+		select {
+		case <-stopCh:
+			return nil, nil
+		case <-l.d.done:
+			return nil, store.ErrCannotLock
+		case <-time.After(l.d.watcher.Interval):
+		}
+	}
+}
+
+// renewLoop refreshes the lock until it's released or lost
+func (l *dirLock) renewLoop(lostCh, unlockCh chan struct{}) {
+	defer close(lostCh)
+
+	heartbeat := time.NewTicker(store.RenewInterval(l.ttl))
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-unlockCh:
+			return
+		case <-l.d.done:
+			return
+		case <-heartbeat.C:
+			if !l.renew(unlockCh) {
+				return
+			}
+		}
+	}
+}
+
+// renew refreshes the lock unless it's released meanwhile, it holds l.mu
+// so that Unlock deletes the key with its latest index
+func (l *dirLock) renew(unlockCh chan struct{}) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.unlockCh != unlockCh {
+		return false
+	}
+	pair, ok := l.d.touch(l.key, l.last.LastIndex)
+	if ok {
+		l.last = pair
+	}
+	return ok
+}
+
+// Unlock releases the lock, the key is deleted only if we still own it
+func (l *dirLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.last == nil {
+		return store.ErrLockNotHeld
+	}
+	pair := l.last
+	close(l.unlockCh)
+	l.last, l.unlockCh = nil, nil
+
+	if _, err := l.d.AtomicDelete(l.key, pair); err != nil {
+		return store.ErrLockNotHeld
+	}
+	return nil
+}
+
+// touch sets the modification time of key to now if it's not modified since index,
+// the key is returned with its new index
+func (d *Dir) touch(key string, index uint64) (*store.KVPair, bool) {
+	nKey, path, err := d.normalize(key)
+	if err != nil {
+		return nil, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	pair, err := read(nKey, path)
+	if err != nil || pair.LastIndex != index {
+		return nil, false
+	}
+	mtime := time.Now()
+	if uint64(mtime.UnixNano()) <= index {
+		mtime = time.Unix(0, int64(index+1))
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		return nil, false
+	}
+	pair, err = read(nKey, path)
+	if err != nil {
+		return nil, false
+	}
+	return pair, true
+}
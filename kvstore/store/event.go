@@ -0,0 +1,73 @@
+package store
+
+import (
+	"sort"
+)
+
+// EventType is the kind of change of a key
+type EventType int
+
+const (
+	// EventPut is a key created or updated
+	EventPut EventType = iota + 1
+	// EventDelete is a key deleted
+	EventDelete
+	// EventExpire is a key removed once its TTL elapsed, only reported by the
+	// backends which can tell it apart from EventDelete
+	EventExpire
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "put"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	}
+	return "unknown"
+}
+
+// Event is a change of a key under a watched directory.
+// Pair is the new value, only its Key is set for EventDelete and EventExpire.
+// PrevPair is the value known before the change, nil if the key was unknown
+type Event struct {
+	Type     EventType
+	Pair     *KVPair
+	PrevPair *KVPair
+}
+
+// EventWatcher is implemented by the backends which report the changes
+// of a directory one by one instead of the whole content
+type EventWatcher interface {
+	// WatchEvents watches for changes on child nodes under a given directory until stopCh is closed,
+	// the current content is not reported
+	WatchEvents(directory string, stopCh <-chan struct{}) (<-chan *Event, error)
+}
+
+// DiffEvents returns the events turning prev into next,
+// the keys which are not in next are reported as deleted
+func DiffEvents(prev, next []*KVPair) []*Event {
+	known := make(map[string]*KVPair, len(prev))
+	for _, pair := range prev {
+		known[pair.Key] = pair
+	}
+
+	var events []*Event
+	for _, pair := range next {
+		old, ok := known[pair.Key]
+		delete(known, pair.Key)
+		if ok && old.LastIndex == pair.LastIndex {
+			continue
+		}
+		events = append(events, &Event{Type: EventPut, Pair: pair, PrevPair: old})
+	}
+
+	deleted := make([]*Event, 0, len(known))
+	for key, old := range known {
+		deleted = append(deleted, &Event{Type: EventDelete, Pair: &KVPair{Key: key}, PrevPair: old})
+	}
+	sort.Slice(deleted, func(i, j int) bool { return deleted[i].Pair.Key < deleted[j].Pair.Key })
+	return append(events, deleted...)
+}
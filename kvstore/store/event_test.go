@@ -0,0 +1,34 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// go test -v -run TestDiffEvents github.com/beyondyyh/libs/kvstore/store
+func TestDiffEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	a1 := &store.KVPair{Key: "a", Value: []byte("1"), LastIndex: 1}
+	a2 := &store.KVPair{Key: "a", Value: []byte("2"), LastIndex: 2}
+	b := &store.KVPair{Key: "b", Value: []byte("b"), LastIndex: 1}
+	c := &store.KVPair{Key: "c", Value: []byte("c"), LastIndex: 3}
+	d := &store.KVPair{Key: "d", Value: []byte("d"), LastIndex: 1}
+
+	assert.Empty(store.DiffEvents(nil, nil))
+	assert.Empty(store.DiffEvents([]*store.KVPair{a1, b}, []*store.KVPair{b, a1}))
+
+	events := store.DiffEvents([]*store.KVPair{a1, b, d}, []*store.KVPair{a2, c})
+	assert.Equal([]*store.Event{
+		{Type: store.EventPut, Pair: a2, PrevPair: a1},
+		{Type: store.EventPut, Pair: c},
+		{Type: store.EventDelete, Pair: &store.KVPair{Key: "b"}, PrevPair: b},
+		{Type: store.EventDelete, Pair: &store.KVPair{Key: "d"}, PrevPair: d},
+	}, events)
+
+	assert.Equal("put", store.EventPut.String())
+	assert.Equal("expire", store.EventExpire.String())
+}
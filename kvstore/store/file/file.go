@@ -0,0 +1,299 @@
+package file
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/beyondyyh/libs/kvstore"
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/store/memory"
+)
+
+const (
+	// a log is compacted once it holds compactRatio times more records than live keys,
+	// and at least compactMinRecords records
+	compactRatio      = 4
+	compactMinRecords = 1000
+)
+
+var (
+	// ErrPathRequired is returned when no endpoint is given as the path of the file
+	ErrPathRequired = errors.New("file: the path of the file is required")
+	// ErrMultipleEndpointsUnsupported is thrown when multiple endpoints specified
+	ErrMultipleEndpointsUnsupported = errors.New("file: does not support multiple endpoints")
+	// ErrClosed is returned by the writes once the store is closed
+	ErrClosed = errors.New("file: store closed")
+)
+
+// File implements store.Store with a memory store whose writes are appended to a local file.
+// The file is replayed when the store is created and compacted in the background once most
+// of its records are obsolete. Watches and locks are in-process only, the file must not be
+// opened by several stores at once
+type File struct {
+	*memory.Memory
+	log *journal
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// journal implements memory.Journal and memory.Batcher by appending the records to the file
+type journal struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	buf     []byte
+	records int                 // records in the log
+	live    map[string]struct{} // keys put and not deleted since, the expired ones included
+
+	compactCh chan struct{}
+}
+
+func Register() {
+	kvstore.AddStore(store.FILE, New)
+}
+
+// New opens the store kept in the file endpoints[0], the file is created if missing
+func New(endpoints []string, options *store.Config) (store.Store, error) {
+	if len(endpoints) == 0 || endpoints[0] == "" {
+		return nil, ErrPathRequired
+	}
+	if len(endpoints) > 1 {
+		return nil, ErrMultipleEndpointsUnsupported
+	}
+	return Open(endpoints[0])
+}
+
+// Open opens the store kept in the file at path, the file is created if missing
+func Open(path string) (*File, error) {
+	index, entries, offset, records, err := replay(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if offset == 0 {
+		if _, err := f.Write([]byte(logMagic)); err != nil {
+			f.Close()
+			return nil, err
+		}
+		offset = int64(len(logMagic))
+	}
+	// drop the torn tail if any, the records are appended after the valid ones
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	j := &journal{
+		path:      path,
+		f:         f,
+		records:   records,
+		live:      make(map[string]struct{}, len(entries)),
+		compactCh: make(chan struct{}, 1),
+	}
+	for _, e := range entries {
+		j.live[e.Key] = struct{}{}
+	}
+	s := &File{
+		Memory: memory.NewJournaled(j),
+		log:    j,
+		done:   make(chan struct{}),
+	}
+	s.Memory.Restore(index, entries)
+
+	if j.needCompact() {
+		if err := s.Compact(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	go s.compactLoop()
+	return s, nil
+}
+
+func (s *File) compactLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.log.compactCh:
+			// a failed compaction is retried once the log grows again
+			s.Compact()
+		}
+	}
+}
+
+// Compact rewrites the file with the live keys only, the writes are blocked meanwhile
+func (s *File) Compact() error {
+	return s.Memory.Snapshot(s.log.rewrite)
+}
+
+// Put implements memory.Journal, the record is synced before the write is applied
+func (j *journal) Put(e *memory.Entry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.append(putRecord(e), 1); err != nil {
+		return err
+	}
+	j.live[e.Key] = struct{}{}
+	return nil
+}
+
+// Delete implements memory.Journal
+func (j *journal) Delete(key string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.append(&record{op: opDelete, key: key}, 1); err != nil {
+		return err
+	}
+	delete(j.live, key)
+	return nil
+}
+
+// Batch implements memory.Batcher, the records are appended as a single opBatch record
+func (j *journal) Batch(puts []*memory.Entry, deletes []string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(puts)+len(deletes) == 0 {
+		return nil
+	}
+	var value []byte
+	for _, e := range puts {
+		value = putRecord(e).encode(value)
+	}
+	for _, key := range deletes {
+		value = (&record{op: opDelete, key: key}).encode(value)
+	}
+	if err := j.append(&record{op: opBatch, value: value}, len(puts)+len(deletes)); err != nil {
+		return err
+	}
+
+	for _, e := range puts {
+		j.live[e.Key] = struct{}{}
+	}
+	for _, key := range deletes {
+		delete(j.live, key)
+	}
+	return nil
+}
+
+// append writes and syncs the record counting for n records, caller must hold j.mu
+func (j *journal) append(r *record, n int) error {
+	if j.f == nil {
+		return ErrClosed
+	}
+
+	j.buf = r.encode(j.buf[:0])
+	if _, err := j.f.Write(j.buf); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+
+	j.records += n
+	if j.needCompact() {
+		select {
+		case j.compactCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// needCompact tells if most of the records are obsolete, caller must hold j.mu
+func (j *journal) needCompact() bool {
+	return j.records >= compactMinRecords && j.records >= compactRatio*len(j.live)
+}
+
+// rewrite replaces the log with the given snapshot, the new log is written
+// beside the file then renamed over it so that a crash leaves either log intact
+func (j *journal) rewrite(index uint64, entries []*memory.Entry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f == nil {
+		return ErrClosed
+	}
+
+	tmp := j.path + ".compact"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshot(f, index, entries); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(j.path))
+
+	j.f.Close()
+	j.f = f
+	j.records = len(entries) + 1
+	j.live = make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		j.live[e.Key] = struct{}{}
+	}
+	return nil
+}
+
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+}
+
+// writeSnapshot writes a whole log to f and syncs it, f is left at its end
+func writeSnapshot(f *os.File, index uint64, entries []*memory.Entry) error {
+	buf := []byte(logMagic)
+	buf = (&record{op: opIndex, index: index}).encode(buf)
+	for _, e := range entries {
+		buf = putRecord(e).encode(buf)
+	}
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// syncDir persists a rename in dir, it's best effort since not every platform supports it
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// Close the store and its file, all the watches are stopped
+func (s *File) Close() {
+	s.closeOnce.Do(func() {
+		s.Memory.Close()
+		close(s.done)
+		s.log.close()
+	})
+}
@@ -0,0 +1,263 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore"
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/testutils"
+)
+
+// run all: go test -v github.com/beyondyyh/libs/kvstore/store/file
+
+func makeFileClient(t *testing.T, path string) *File {
+	kv, err := Open(path)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	return kv
+}
+
+// go test -v -run TestRegister github.com/beyondyyh/libs/kvstore/store/file
+func TestRegister(t *testing.T) {
+	Register()
+
+	assert := assert.New(t)
+	kv, err := kvstore.NewStore(store.FILE, []string{filepath.Join(t.TempDir(), "kv.log")}, nil)
+	assert.NoError(err)
+	assert.NotNil(kv)
+	defer kv.Close()
+
+	if _, ok := kv.(*File); !ok {
+		t.Fatal("Error registering and initializing file")
+	}
+
+	_, err = kvstore.NewStore(store.FILE, nil, nil)
+	assert.Equal(ErrPathRequired, err)
+}
+
+// go test -v -run TestFileStore github.com/beyondyyh/libs/kvstore/store/file
+func TestFileStore(t *testing.T) {
+	kv := makeFileClient(t, filepath.Join(t.TempDir(), "kv.log"))
+	defer kv.Close()
+	defer testutils.RunCleanup(t, kv)
+
+	testutils.RunTestCommon(t, kv)
+	testutils.RunTestAtomic(t, kv)
+	testutils.RunTestTxn(t, kv)
+	testutils.RunTestBatch(t, kv)
+	testutils.RunTestLock(t, kv)
+	testutils.RunTestWatch(t, kv)
+	testutils.RunTestWatchEvents(t, kv)
+}
+
+// go test -v -run TestFileReopen github.com/beyondyyh/libs/kvstore/store/file
+func TestFileReopen(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	kv := makeFileClient(t, path)
+	assert.NoError(kv.Put("testReopen/kept", []byte("foo"), nil))
+	assert.NoError(kv.Put("testReopen/kept", []byte("bar"), nil))
+	assert.NoError(kv.Put("testReopen/deleted", []byte("foo"), nil))
+	assert.NoError(kv.Delete("testReopen/deleted"))
+	assert.NoError(kv.Put("testReopen/ttl", []byte("foo"), &store.WriteOptions{TTL: 200 * time.Millisecond}))
+	ttl, err := kv.Get("testReopen/ttl")
+	assert.NoError(err)
+	assert.NoError(kv.Put("testReopen/expired", []byte("foo"), &store.WriteOptions{TTL: time.Millisecond}))
+	kv.Close()
+
+	assert.Equal(ErrClosed, kv.Put("testReopen/closed", []byte("foo"), nil))
+
+	time.Sleep(10 * time.Millisecond)
+	kv = makeFileClient(t, path)
+	defer kv.Close()
+
+	pair, err := kv.Get("testReopen/kept")
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), pair.Value)
+
+	for _, key := range []string{"testReopen/deleted", "testReopen/expired", "testReopen/closed"} {
+		_, err = kv.Get(key)
+		assert.Equal(store.ErrKeyNotFound, err, key)
+	}
+
+	// the ttl is kept across the reopen
+	_, err = kv.Get("testReopen/ttl")
+	assert.NoError(err)
+	time.Sleep(300 * time.Millisecond)
+	_, err = kv.Get("testReopen/ttl")
+	assert.Equal(store.ErrKeyNotFound, err)
+
+	// the indexes keep increasing, the one of the expired key is not reused
+	assert.NoError(kv.Put("testReopen/new", []byte("foo"), nil))
+	pair, err = kv.Get("testReopen/new")
+	assert.NoError(err)
+	assert.True(pair.LastIndex > ttl.LastIndex+1)
+}
+
+// go test -v -run TestFileCompact github.com/beyondyyh/libs/kvstore/store/file
+func TestFileCompact(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	kv := makeFileClient(t, path)
+	assert.NoError(kv.Put("testCompact/other", []byte("foo"), nil))
+	for i := 0; i < 100; i++ {
+		assert.NoError(kv.Put("testCompact/key", []byte("value"), nil))
+	}
+	assert.NoError(kv.Put("testCompact/deleted", []byte("foo"), nil))
+	deleted, err := kv.Get("testCompact/deleted")
+	assert.NoError(err)
+	assert.NoError(kv.Delete("testCompact/deleted"))
+
+	before, err := os.Stat(path)
+	assert.NoError(err)
+	assert.NoError(kv.Compact())
+	after, err := os.Stat(path)
+	assert.NoError(err)
+	assert.True(after.Size() < before.Size())
+	kv.Close()
+
+	kv = makeFileClient(t, path)
+	pairs, err := kv.List("testCompact")
+	assert.NoError(err)
+	assert.Equal(2, len(pairs))
+
+	// the index of the deleted key is not reused
+	assert.NoError(kv.Put("testCompact/new", []byte("foo"), nil))
+	pair, err := kv.Get("testCompact/new")
+	assert.NoError(err)
+	assert.True(pair.LastIndex > deleted.LastIndex)
+	kv.Close()
+
+	// the writes go on in the compacted log
+	kv = makeFileClient(t, path)
+	defer kv.Close()
+	pair, err = kv.Get("testCompact/new")
+	assert.NoError(err)
+	assert.Equal([]byte("foo"), pair.Value)
+}
+
+// go test -v -run TestFileEphemeral github.com/beyondyyh/libs/kvstore/store/file
+func TestFileEphemeral(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	kv := makeFileClient(t, path)
+	assert.NoError(kv.Put("testEphemeral/key", []byte("foo"), nil))
+	assert.NoError(kv.Put("testEphemeral/key", []byte("bar"), &store.WriteOptions{Ephemeral: true}))
+	assert.NoError(kv.Put("testEphemeral/compacted", []byte("foo"), &store.WriteOptions{Ephemeral: true}))
+	assert.NoError(kv.Compact())
+	assert.NoError(kv.Put("testEphemeral/txn", []byte("foo"), nil))
+	_, err := kv.Txn([]*store.TxnOp{store.PutOp("testEphemeral/txn", []byte("bar"), &store.WriteOptions{Ephemeral: true})})
+	assert.NoError(err)
+	assert.NoError(kv.Put("testEphemeral/kept", []byte("foo"), nil))
+	pair, err := kv.Get("testEphemeral/key")
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), pair.Value)
+	kv.Close()
+
+	// neither the ephemeral keys nor the values they replaced survive the reopen
+	kv = makeFileClient(t, path)
+	defer kv.Close()
+	for _, key := range []string{"testEphemeral/key", "testEphemeral/compacted", "testEphemeral/txn"} {
+		_, err = kv.Get(key)
+		assert.Equal(store.ErrKeyNotFound, err, key)
+	}
+	_, err = kv.Get("testEphemeral/kept")
+	assert.NoError(err)
+}
+
+// go test -v -run TestFileTornTail github.com/beyondyyh/libs/kvstore/store/file
+func TestFileTornTail(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	kv := makeFileClient(t, path)
+	assert.NoError(kv.Put("testTorn/key", []byte("foo"), nil))
+	kv.Close()
+
+	// a crash in the middle of a record leaves a partial one at the end
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(err)
+	_, err = f.Write([]byte{0, 0, 0, 40, 1, 2, 3})
+	assert.NoError(err)
+	f.Close()
+
+	kv = makeFileClient(t, path)
+	pair, err := kv.Get("testTorn/key")
+	assert.NoError(err)
+	assert.Equal([]byte("foo"), pair.Value)
+	assert.NoError(kv.Put("testTorn/other", []byte("bar"), nil))
+	kv.Close()
+
+	kv = makeFileClient(t, path)
+	defer kv.Close()
+	pair, err = kv.Get("testTorn/other")
+	assert.NoError(err)
+	assert.Equal([]byte("bar"), pair.Value)
+}
+
+// go test -v -run TestFileBadFormat github.com/beyondyyh/libs/kvstore/store/file
+func TestFileBadFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	assert.NoError(t, os.WriteFile(path, []byte("not a kvstore log"), 0644))
+
+	_, err := Open(path)
+	assert.Equal(t, ErrBadFormat, err)
+
+	// the file is left untouched
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "not a kvstore log", string(data))
+}
+
+// go test -v -run TestFileTxn github.com/beyondyyh/libs/kvstore/store/file
+func TestFileTxn(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	kv := makeFileClient(t, path)
+	assert.NoError(kv.Put("testTxn/old", []byte("foo"), nil))
+	_, err := kv.Txn([]*store.TxnOp{
+		store.PutOp("testTxn/config", []byte("v1"), nil),
+		store.PutOp("testTxn/version", []byte("1"), nil),
+		store.DeleteOp("testTxn/old"),
+	})
+	assert.NoError(err)
+	kv.Close()
+
+	info, err := os.Stat(path)
+	assert.NoError(err)
+	kv = makeFileClient(t, path)
+	pairs, err := kv.List("testTxn")
+	assert.NoError(err)
+	assert.Len(pairs, 2)
+	_, err = kv.Get("testTxn/old")
+	assert.Equal(store.ErrKeyNotFound, err)
+
+	// a torn batch is dropped as a whole
+	_, err = kv.Txn([]*store.TxnOp{
+		store.PutOp("testTxn/config", []byte("v2"), nil),
+		store.PutOp("testTxn/version", []byte("2"), nil),
+	})
+	assert.NoError(err)
+	kv.Close()
+	assert.NoError(os.Truncate(path, info.Size()+40))
+
+	kv = makeFileClient(t, path)
+	defer kv.Close()
+	for key, value := range map[string]string{"testTxn/config": "v1", "testTxn/version": "1"} {
+		pair, err := kv.Get(key)
+		assert.NoError(err)
+		if assert.NotNil(pair) {
+			assert.Equal([]byte(value), pair.Value)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/beyondyyh/libs/kvstore/store/memory"
+)
+
+// The log starts with logMagic followed by the records:
+//
+//     | length uint32 | crc32 uint32 | op byte | index uint64 | expire int64 | key length uint32 | key | value |
+//
+// length and crc32 cover the bytes from op to the end of value, expire is in unix nanoseconds, 0 if none.
+// A compacted log starts with an opIndex record holding the last index of the store.
+// The value of an opBatch record is the records of a transaction, so that they are replayed
+// all together or, if the batch is torn, not at all
+const logMagic = "KVLOG01\n"
+
+const (
+	opPut byte = iota + 1
+	opDelete
+	opIndex
+	opBatch
+)
+
+const (
+	recordHeaderSize = 8
+	recordFixedSize  = 1 + 8 + 8 + 4
+	maxRecordSize    = 1 << 30
+)
+
+// ErrBadFormat is returned when the file is not a log of the file backend
+var ErrBadFormat = errors.New("file: not a kvstore log")
+
+type record struct {
+	op     byte
+	index  uint64
+	expire int64
+	key    string
+	value  []byte
+}
+
+func putRecord(e *memory.Entry) *record {
+	r := &record{op: opPut, index: e.Index, key: e.Key, value: e.Value}
+	if !e.Expire.IsZero() {
+		r.expire = e.Expire.UnixNano()
+	}
+	return r
+}
+
+func (r *record) entry() *memory.Entry {
+	e := &memory.Entry{Key: r.key, Value: r.value, Index: r.index}
+	if r.expire != 0 {
+		e.Expire = time.Unix(0, r.expire)
+	}
+	return e
+}
+
+// encode appends the record with its header to buf
+func (r *record) encode(buf []byte) []byte {
+	size := recordFixedSize + len(r.key) + len(r.value)
+	start := len(buf)
+	buf = append(buf, make([]byte, recordHeaderSize+recordFixedSize)...)
+
+	b := buf[start:]
+	binary.BigEndian.PutUint32(b[0:], uint32(size))
+	b[8] = r.op
+	binary.BigEndian.PutUint64(b[9:], r.index)
+	binary.BigEndian.PutUint64(b[17:], uint64(r.expire))
+	binary.BigEndian.PutUint32(b[25:], uint32(len(r.key)))
+	buf = append(buf, r.key...)
+	buf = append(buf, r.value...)
+
+	binary.BigEndian.PutUint32(buf[start+4:], crc32.ChecksumIEEE(buf[start+recordHeaderSize:]))
+	return buf
+}
+
+// decodeRecord reads the next record, io.EOF is returned at the end of the log
+// and io.ErrUnexpectedEOF if the last record is torn or corrupted
+func decodeRecord(rd *bufio.Reader) (*record, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(rd, header[:]); err != nil {
+		return nil, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[0:])
+	if size < recordFixedSize || size > maxRecordSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(rd, payload); err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	keyLen := binary.BigEndian.Uint32(payload[17:])
+	if uint64(keyLen) > uint64(size-recordFixedSize) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	rest := payload[recordFixedSize:]
+	r := &record{
+		op:     payload[0],
+		index:  binary.BigEndian.Uint64(payload[1:]),
+		expire: int64(binary.BigEndian.Uint64(payload[9:])),
+		key:    string(rest[:keyLen]),
+		value:  rest[keyLen:],
+	}
+	return r, int64(recordHeaderSize + size), nil
+}
+
+// decodeBatch reads the records held by the value of an opBatch record,
+// the value is covered by the crc32 of the batch so a bad record means a bad log
+func decodeBatch(value []byte) ([]*record, error) {
+	var records []*record
+	rd := bufio.NewReader(bytes.NewReader(value))
+	for {
+		r, _, err := decodeRecord(rd)
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil || r.op == opBatch {
+			return nil, ErrBadFormat
+		}
+		records = append(records, r)
+	}
+}
+
+// replay reads the log at path, it returns the last index and the live entries,
+// the offset where the valid records end and the number of records read.
+// A missing or empty file is an empty log
+func replay(path string) (index uint64, entries []*memory.Entry, offset int64, records int, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil, 0, 0, nil
+	}
+	if err != nil {
+		return 0, nil, 0, 0, err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	magic := make([]byte, len(logMagic))
+	if n, err := io.ReadFull(rd, magic); err != nil {
+		if n == 0 && err == io.EOF {
+			return 0, nil, 0, 0, nil
+		}
+		return 0, nil, 0, 0, ErrBadFormat
+	}
+	if string(magic) != logMagic {
+		return 0, nil, 0, 0, ErrBadFormat
+	}
+	offset = int64(len(logMagic))
+
+	live := make(map[string]*memory.Entry)
+	apply := func(r *record) {
+		records++
+		if r.index > index {
+			index = r.index
+		}
+		switch r.op {
+		case opPut:
+			live[r.key] = r.entry()
+		case opDelete:
+			delete(live, r.key)
+		}
+	}
+	for {
+		r, n, err := decodeRecord(rd)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// a torn tail is the trace of a crash during a write, it's dropped
+			break
+		}
+		if err != nil {
+			return 0, nil, 0, 0, err
+		}
+		offset += n
+
+		if r.op != opBatch {
+			apply(r)
+			continue
+		}
+		batch, err := decodeBatch(r.value)
+		if err != nil {
+			return 0, nil, 0, 0, err
+		}
+		for _, r := range batch {
+			apply(r)
+		}
+	}
+
+	entries = make([]*memory.Entry, 0, len(live))
+	for _, e := range live {
+		entries = append(entries, e)
+	}
+	return index, entries, offset, records, nil
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrInvalidCursor is thrown when the cursor given to ListPage is not
+// one returned by a previous call on the same backend
+var ErrInvalidCursor = errors.New("Invalid list cursor")
+
+// DefaultPageLimit is used when the limit given to ListPage is not positive
+const DefaultPageLimit = 1000
+
+// ListPager is implemented by the backends which list a large
+// directory page by page instead of loading it at once
+type ListPager interface {
+	// ListPage returns about limit pairs under directory starting at cursor,
+	// "" is the first cursor and the returned cursor is "" once the directory is exhausted.
+	// Unlike List an empty directory is not an error, and a page may be empty
+	// while the returned cursor is not "".
+	ListPage(directory, cursor string, limit int) ([]*KVPair, string, error)
+}
+
+// ListPage lists a page of directory, see ListPager.
+// For the backends which don't implement ListPager the whole directory
+// is listed and the cursor is the last key of the page
+func ListPage(s Store, directory, cursor string, limit int) ([]*KVPair, string, error) {
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+	if p, ok := s.(ListPager); ok {
+		return p.ListPage(directory, cursor, limit)
+	}
+
+	pairs, err := s.List(directory)
+	if err == ErrKeyNotFound {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return PageByKey(pairs, cursor, limit)
+}
+
+// PageByKey returns the page of pairs sorted by key following the cursor,
+// which is the last key of the previous page
+func PageByKey(pairs []*KVPair, cursor string, limit int) ([]*KVPair, string, error) {
+	start := 0
+	if cursor != "" {
+		start = sort.Search(len(pairs), func(i int) bool { return pairs[i].Key > cursor })
+	}
+	end := start + limit
+	if end >= len(pairs) {
+		return pairs[start:], "", nil
+	}
+	return pairs[start:end], pairs[end-1].Key, nil
+}
+
+// ListStream lists directory page by page in the background, every page is sent on
+// the returned channel which is closed once the directory is exhausted, stopCh is closed
+// or an error occurs. The error, if any, is sent on the error channel which is closed afterwards.
+func ListStream(s Store, directory string, limit int, stopCh <-chan struct{}) (<-chan []*KVPair, <-chan error) {
+	pairsCh := make(chan []*KVPair)
+	errCh := make(chan error, 1)
+
+	go func() {
+		defer close(errCh)
+		defer close(pairsCh)
+
+		cursor := ""
+		for {
+			pairs, next, err := ListPage(s, directory, cursor, limit)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if len(pairs) > 0 {
+				select {
+				case pairsCh <- pairs:
+				case <-stopCh:
+					return
+				}
+			}
+			if next == "" {
+				return
+			}
+			cursor = next
+		}
+	}()
+
+	return pairsCh, errCh
+}
@@ -0,0 +1,49 @@
+package store_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/store/memory"
+	"github.com/beyondyyh/libs/kvstore/testutils"
+)
+
+// listOnly hides the ListPage of the wrapped store
+type listOnly struct {
+	store.Store
+}
+
+// go test -v -run TestListPage github.com/beyondyyh/libs/kvstore/store
+func TestListPage(t *testing.T) {
+	kv, _ := memory.New(nil, nil)
+	defer kv.Close()
+
+	// the fallback on top of List
+	testutils.RunTestCommon(t, listOnly{kv})
+	testutils.RunCleanup(t, kv)
+}
+
+// go test -v -run TestListStreamStop github.com/beyondyyh/libs/kvstore/store
+func TestListStreamStop(t *testing.T) {
+	assert := assert.New(t)
+	kv, _ := memory.New(nil, nil)
+	defer kv.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(kv.Put(fmt.Sprintf("testListStream/key%d", i), []byte("value"), nil))
+	}
+
+	stopCh := make(chan struct{})
+	pairsCh, errCh := store.ListStream(kv, "testListStream", 3, stopCh)
+	pairs := <-pairsCh
+	assert.Equal(3, len(pairs))
+
+	// the stream is closed without reading the remaining pages
+	close(stopCh)
+	for range pairsCh {
+	}
+	assert.NoError(<-errCh)
+}
@@ -0,0 +1,92 @@
+package memory
+
+import (
+	"time"
+)
+
+// Entry is a key of a Memory store with its metadata, see Journal and Restore
+type Entry struct {
+	Key    string
+	Value  []byte
+	Index  uint64
+	Expire time.Time // zero if the key has no ttl
+}
+
+// Journal records the writes of a Memory store so that it can be restored later.
+// The methods are called with the lock of the store held, before the write is applied,
+// so the records are in the order of the writes and a write fails if its record fails.
+// The expirations are not recorded, they are known from Entry.Expire,
+// and the ephemeral keys are recorded as deleted since they don't outlive the store
+type Journal interface {
+	// Put records a key created, updated or renewed
+	Put(e *Entry) error
+	// Delete records a key deleted
+	Delete(key string) error
+}
+
+// Batcher is implemented by the journals which record several writes at once,
+// Txn fails with store.ErrCallNotSupported on a store whose journal is not a Batcher
+type Batcher interface {
+	// Batch records the keys put and deleted by a transaction, all of them or none.
+	// A key is either in puts or in deletes
+	Batch(puts []*Entry, deletes []string) error
+}
+
+// NewJournaled creates a memory store whose writes are recorded by j,
+// it's the base of the persistent backends such as store/file
+func NewJournaled(j Journal) *Memory {
+	m := newMemory()
+	m.journal = j
+	return m
+}
+
+// Restore loads entries without recording them, the keys already expired are skipped.
+// index is the last index known by the journal, possibly from keys since deleted,
+// so that the indexes keep increasing across restores
+func (m *Memory) Restore(index uint64, entries []*Entry) {
+	m.Lock()
+	defer m.Unlock()
+
+	if index > m.index {
+		m.index = index
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if e.Index > m.index {
+			m.index = e.Index
+		}
+		if !e.Expire.IsZero() && !e.Expire.After(now) {
+			continue
+		}
+		m.set(normalize(e.Key), &entry{
+			value:     copyBytes(e.Value),
+			lastIndex: e.Index,
+			expire:    e.Expire,
+		})
+	}
+}
+
+// Snapshot calls fn with the current index and entries but the ephemeral ones, sorted by key.
+// No write happens while fn is running, so fn must not write to the store
+func (m *Memory) Snapshot(fn func(index uint64, entries []*Entry) error) error {
+	m.RLock()
+	defer m.RUnlock()
+
+	keys := m.keys("")
+	entries := make([]*Entry, 0, len(keys))
+	for _, key := range keys {
+		if e := m.data[key]; !e.ephemeral {
+			entries = append(entries, e.export(key))
+		}
+	}
+	return fn(m.index, entries)
+}
+
+func (e *entry) export(key string) *Entry {
+	return &Entry{
+		Key:    key,
+		Value:  e.value,
+		Index:  e.lastIndex,
+		Expire: e.expire,
+	}
+}
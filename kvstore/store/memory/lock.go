@@ -0,0 +1,144 @@
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// defaultLockTTL is the default ttl for the memory lock
+const defaultLockTTL = 60 * time.Second
+
+// memoryLock implements store.Locker, the ttl of the key
+// is renewed periodically while the lock is held
+type memoryLock struct {
+	mu    sync.Mutex
+	m     *Memory
+	key   string
+	value []byte
+	ttl   time.Duration
+
+	last     *store.KVPair
+	unlockCh chan struct{}
+}
+
+// NewLock creates a lock for a given key
+func (m *Memory) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	ttl := defaultLockTTL
+	var value []byte
+	if options != nil {
+		if options.TTL > 0 {
+			ttl = options.TTL
+		}
+		value = options.Value
+	}
+
+	return &memoryLock{
+		m:     m,
+		key:   normalize(key),
+		value: value,
+		ttl:   ttl,
+	}, nil
+}
+
+// Lock attempts to acquire the lock and blocks while doing so,
+// the returned channel is closed if the lock is lost or released
+func (l *memoryLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.last != nil {
+		return nil, store.ErrCannotLock
+	}
+
+	// wake up as soon as the key is deleted or expired
+	w := l.m.addWatcher(l.key, false)
+	defer l.m.removeWatcher(w)
+
+	for {
+		_, pair, err := l.m.AtomicPut(l.key, l.value, nil, &store.WriteOptions{TTL: l.ttl})
+		if err == nil {
+			l.last = pair
+			l.unlockCh = make(chan struct{})
+			lostCh := make(chan struct{})
+			go l.renewLoop(pair, lostCh, l.unlockCh)
+			return lostCh, nil
+		}
+		if err != store.ErrKeyExists {
+			return nil, err
+		}
+
+		select {
+		case <-stopCh:
+			return nil, nil
+		case <-l.m.done:
+			return nil, store.ErrCannotLock
+		case <-w.notifyCh:
+		}
+	}
+}
+
+// renewLoop refreshes the ttl of the lock until it's released or lost
+func (l *memoryLock) renewLoop(pair *store.KVPair, lostCh, unlockCh chan struct{}) {
+	defer close(lostCh)
+
+	heartbeat := time.NewTicker(store.RenewInterval(l.ttl))
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-unlockCh:
+			return
+		case <-l.m.done:
+			return
+		case <-heartbeat.C:
+			if !l.m.renew(l.key, pair.LastIndex, l.ttl) {
+				return
+			}
+		}
+	}
+}
+
+// Unlock releases the lock, the key is deleted only if we still own it
+func (l *memoryLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.last == nil {
+		return store.ErrLockNotHeld
+	}
+	pair := l.last
+	close(l.unlockCh)
+	l.last, l.unlockCh = nil, nil
+
+	if _, err := l.m.AtomicDelete(l.key, pair); err != nil {
+		return store.ErrLockNotHeld
+	}
+	return nil
+}
+
+// renew resets the ttl of key if it's not modified since index
+func (m *Memory) renew(key string, index uint64, ttl time.Duration) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	e, ok := m.data[key]
+	if !ok || e.lastIndex != index {
+		return false
+	}
+	expire := time.Now().Add(ttl)
+	if m.journal != nil {
+		renewed := e.export(key)
+		renewed.Expire = expire
+		if err := m.journal.Put(renewed); err != nil {
+			return false
+		}
+	}
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.expire = expire
+	m.arm(key, e)
+	return true
+}
@@ -0,0 +1,647 @@
+package memory
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beyondyyh/libs/kvstore"
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// Memory implements store.Store interface with an in-process map,
+// it's mainly used by unit tests which can not reach a live redis/consul
+type Memory struct {
+	sync.RWMutex
+	data     map[string]*entry
+	index    uint64
+	watchers map[*watcher]struct{}
+	journal  Journal
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type entry struct {
+	value     []byte
+	lastIndex uint64
+	expire    time.Time
+	timer     *time.Timer
+	ephemeral bool // removed on Close, see store.WriteOptions.Ephemeral
+}
+
+// watcher is notified whenever a matched key is modified,
+// notifyCh is buffered so that notifications are coalesced
+type watcher struct {
+	key      string
+	tree     bool
+	notifyCh chan struct{}
+}
+
+func (w *watcher) match(key string) bool {
+	if w.tree {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+func Register() {
+	kvstore.AddStore(store.MEMORY, New)
+}
+
+// New creates a memory store, endpoints and options are ignored
+func New(endpoints []string, options *store.Config) (store.Store, error) {
+	return newMemory(), nil
+}
+
+func newMemory() *Memory {
+	return &Memory{
+		data:     make(map[string]*entry),
+		watchers: make(map[*watcher]struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Put a value at the specified key
+func (m *Memory) Put(key string, value []byte, options *store.WriteOptions) error {
+	m.Lock()
+	defer m.Unlock()
+
+	_, err := m.put(normalize(key), value, options)
+	return err
+}
+
+// put stores the value and notifies watchers, caller must hold the lock
+func (m *Memory) put(key string, value []byte, options *store.WriteOptions) (*entry, error) {
+	e := &entry{
+		value:     copyBytes(value),
+		lastIndex: m.index + 1,
+	}
+	if options != nil && options.Ephemeral {
+		// the store itself keeps the key alive, so it never expires before Close
+		e.ephemeral = true
+	} else if options != nil && options.TTL > 0 {
+		e.expire = time.Now().Add(options.TTL)
+	}
+	if m.journal != nil {
+		var err error
+		if e.ephemeral {
+			// the key must not survive a restore, its previous value neither
+			err = m.journal.Delete(key)
+		} else {
+			err = m.journal.Put(e.export(key))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.index = e.lastIndex
+	m.set(key, e)
+	return e, nil
+}
+
+// set replaces the entry of key and notifies watchers, caller must hold the lock
+func (m *Memory) set(key string, e *entry) {
+	if old, ok := m.data[key]; ok && old.timer != nil {
+		old.timer.Stop()
+	}
+	m.arm(key, e)
+	m.data[key] = e
+	m.notify(key)
+}
+
+// arm starts the timer removing the entry once expired, caller must hold the lock
+func (m *Memory) arm(key string, e *entry) {
+	if e.expire.IsZero() {
+		return
+	}
+	index := e.lastIndex
+	e.timer = time.AfterFunc(time.Until(e.expire), func() {
+		m.expire(key, index)
+	})
+}
+
+// expire removes the key once its ttl is reached, unless it has been rewritten since
+func (m *Memory) expire(key string, index uint64) {
+	m.Lock()
+	defer m.Unlock()
+
+	if e, ok := m.data[key]; ok && e.lastIndex == index {
+		m.drop(key)
+	}
+}
+
+// remove records the deletion of key and drops it, caller must hold the lock
+func (m *Memory) remove(key string) error {
+	if m.journal != nil {
+		if err := m.journal.Delete(key); err != nil {
+			return err
+		}
+	}
+	m.drop(key)
+	return nil
+}
+
+// drop deletes the key and notifies watchers, caller must hold the lock
+func (m *Memory) drop(key string) {
+	if e, ok := m.data[key]; ok && e.timer != nil {
+		e.timer.Stop()
+	}
+	delete(m.data, key)
+	m.notify(key)
+}
+
+// notify wakes up the watchers interested in key, caller must hold the lock
+func (m *Memory) notify(key string) {
+	for w := range m.watchers {
+		if !w.match(key) {
+			continue
+		}
+		select {
+		case w.notifyCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Get a value given its key
+func (m *Memory) Get(key string) (*store.KVPair, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.get(normalize(key))
+}
+
+func (m *Memory) get(key string) (*store.KVPair, error) {
+	e, ok := m.data[key]
+	if !ok {
+		return nil, store.ErrKeyNotFound
+	}
+	return e.pair(key), nil
+}
+
+func (e *entry) pair(key string) *store.KVPair {
+	return &store.KVPair{
+		Key:       key,
+		Value:     copyBytes(e.value),
+		LastIndex: e.lastIndex,
+	}
+}
+
+// Delete the key at the specified key
+func (m *Memory) Delete(key string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	nKey := normalize(key)
+	if _, ok := m.data[nKey]; !ok {
+		return store.ErrKeyNotFound
+	}
+	return m.remove(nKey)
+}
+
+// Verify if a key exists in the store
+func (m *Memory) Exists(key string) (bool, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	_, ok := m.data[normalize(key)]
+	return ok, nil
+}
+
+// List the content of a given prefix
+func (m *Memory) List(directory string) ([]*store.KVPair, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.list(normalize(directory))
+}
+
+func (m *Memory) list(directory string) ([]*store.KVPair, error) {
+	keys := m.keys(directory)
+	if len(keys) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+
+	pairs := make([]*store.KVPair, 0, len(keys))
+	for _, key := range keys {
+		if key == directory {
+			continue
+		}
+		pairs = append(pairs, m.data[key].pair(key))
+	}
+	return pairs, nil
+}
+
+// ListPage returns limit pairs under directory following cursor, which is the last key of the previous page
+func (m *Memory) ListPage(directory, cursor string, limit int) ([]*store.KVPair, string, error) {
+	if limit <= 0 {
+		limit = store.DefaultPageLimit
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	directory = normalize(directory)
+	keys := m.keys(directory)
+	if cursor != "" {
+		keys = keys[sort.Search(len(keys), func(i int) bool { return keys[i] > cursor }):]
+	}
+
+	var pairs []*store.KVPair
+	for i, key := range keys {
+		if len(pairs) == limit {
+			return pairs, keys[i-1], nil
+		}
+		if key == directory {
+			continue
+		}
+		pairs = append(pairs, m.data[key].pair(key))
+	}
+	return pairs, "", nil
+}
+
+// keys returns the sorted keys with the given prefix, caller must hold the lock
+func (m *Memory) keys(prefix string) []string {
+	var keys []string
+	for key := range m.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DeleteTree deletes a range keys under a given directory
+func (m *Memory) DeleteTree(directory string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	keys := m.keys(normalize(directory))
+	if len(keys) == 0 {
+		return store.ErrKeyNotFound
+	}
+	for _, key := range keys {
+		if err := m.remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AtomicPut is a CAS operation on a single value,
+// pass previous = nil to create a new key
+func (m *Memory) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	nKey := normalize(key)
+	e, ok := m.data[nKey]
+	if previous == nil {
+		if ok {
+			return false, nil, store.ErrKeyExists
+		}
+	} else {
+		if !ok {
+			return false, nil, store.ErrKeyNotFound
+		}
+		if e.lastIndex != previous.LastIndex {
+			return false, nil, store.ErrKeyModified
+		}
+	}
+
+	e, err := m.put(nKey, value, options)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, e.pair(nKey), nil
+}
+
+// AtomicDelete deletes a single value only if it's not modified since previous
+func (m *Memory) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	if previous == nil {
+		return false, store.ErrPreviousNotSpecified
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	nKey := normalize(key)
+	e, ok := m.data[nKey]
+	if !ok {
+		return false, store.ErrKeyNotFound
+	}
+	if e.lastIndex != previous.LastIndex {
+		return false, store.ErrKeyModified
+	}
+	if err := m.remove(nKey); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Txn applies ops atomically, see store.Store. The writes of a transaction share the same index
+func (m *Memory) Txn(ops []*store.TxnOp) ([]*store.KVPair, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	// staged holds the keys written by the previous ops, nil once deleted
+	staged := make(map[string]*entry)
+	pairs := make([]*store.KVPair, len(ops))
+	index := m.index + 1
+	for i, op := range ops {
+		key := normalize(op.Key)
+		switch op.Type {
+		case store.TxnPut:
+			e := &entry{
+				value:     copyBytes(op.Value),
+				lastIndex: index,
+			}
+			if op.Options != nil && op.Options.Ephemeral {
+				e.ephemeral = true
+			} else if op.Options != nil && op.Options.TTL > 0 {
+				e.expire = time.Now().Add(op.Options.TTL)
+			}
+			staged[key] = e
+			pairs[i] = e.pair(key)
+		case store.TxnDelete:
+			staged[key] = nil
+		case store.TxnCheckIndex:
+			e, ok := staged[key]
+			if !ok {
+				e = m.data[key]
+			}
+			var current uint64
+			if e != nil {
+				current = e.lastIndex
+			}
+			if err := store.CheckIndex(current, op.Index); err != nil {
+				return nil, &store.TxnError{Op: i, Err: err}
+			}
+		default:
+			return nil, &store.TxnError{Op: i, Err: store.ErrInvalidTxnOp}
+		}
+	}
+	if len(staged) == 0 {
+		return pairs, nil
+	}
+
+	keys := make([]string, 0, len(staged))
+	for key := range staged {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if m.journal != nil {
+		b, ok := m.journal.(Batcher)
+		if !ok {
+			return nil, store.ErrCallNotSupported
+		}
+		var (
+			puts    []*Entry
+			deletes []string
+		)
+		for _, key := range keys {
+			e := staged[key]
+			if _, ok := m.data[key]; e == nil && !ok {
+				continue
+			}
+			// like put, an ephemeral key is deleted from the journal
+			if e != nil && !e.ephemeral {
+				puts = append(puts, e.export(key))
+			} else {
+				deletes = append(deletes, key)
+			}
+		}
+		if err := b.Batch(puts, deletes); err != nil {
+			return nil, err
+		}
+	}
+
+	m.index = index
+	for _, key := range keys {
+		if e := staged[key]; e != nil {
+			m.set(key, e)
+		} else if _, ok := m.data[key]; ok {
+			m.drop(key)
+		}
+	}
+	return pairs, nil
+}
+
+// GetMany reads keys under a single lock, see store.BatchStore
+func (m *Memory) GetMany(keys []string) ([]*store.KeyResult, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	results := make([]*store.KeyResult, len(keys))
+	for i, key := range keys {
+		pair, err := m.get(normalize(key))
+		results[i] = &store.KeyResult{Pair: pair, Err: err}
+	}
+	return results, nil
+}
+
+// PutMany writes pairs under a single lock, see store.BatchStore
+func (m *Memory) PutMany(pairs []*store.KVPair, options *store.WriteOptions) ([]*store.KeyResult, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	results := make([]*store.KeyResult, len(pairs))
+	for i, pair := range pairs {
+		key := normalize(pair.Key)
+		e, err := m.put(key, pair.Value, options)
+		if err != nil {
+			results[i] = &store.KeyResult{Err: err}
+			continue
+		}
+		results[i] = &store.KeyResult{Pair: e.pair(key)}
+	}
+	return results, nil
+}
+
+// DeleteMany deletes keys under a single lock, see store.BatchStore
+func (m *Memory) DeleteMany(keys []string) ([]*store.KeyResult, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	results := make([]*store.KeyResult, len(keys))
+	for i, key := range keys {
+		nKey := normalize(key)
+		err := store.ErrKeyNotFound
+		if _, ok := m.data[nKey]; ok {
+			err = m.remove(nKey)
+		}
+		results[i] = &store.KeyResult{Err: err}
+	}
+	return results, nil
+}
+
+// Watch for changes on a key
+// 先推送key的当前值，之后每次修改推送最新值，key被删除或过期时推送空的KVPair
+func (m *Memory) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	watchCh := make(chan *store.KVPair)
+	nKey := normalize(key)
+	w := m.addWatcher(nKey, false)
+
+	go func() {
+		defer close(watchCh)
+		defer m.removeWatcher(w)
+
+		// deliver the original data before waiting for events,
+		// nothing is delivered if the key does not exist yet
+		pair, err := m.Get(nKey)
+		for {
+			if err == nil {
+				select {
+				case watchCh <- pair:
+				case <-stopCh:
+					return
+				case <-m.done:
+					return
+				}
+			}
+
+			select {
+			case <-stopCh:
+				return
+			case <-m.done:
+				return
+			case <-w.notifyCh:
+			}
+
+			pair, err = m.Get(nKey)
+			if err == store.ErrKeyNotFound {
+				pair, err = &store.KVPair{}, nil
+			}
+		}
+	}()
+
+	return watchCh, nil
+}
+
+// WatchTree watches for changes on child nodes under a given directory
+func (m *Memory) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	watchCh := make(chan []*store.KVPair)
+	nKey := normalize(directory)
+	w := m.addWatcher(nKey, true)
+
+	go func() {
+		defer close(watchCh)
+		defer m.removeWatcher(w)
+
+		for {
+			pairs, err := m.List(nKey)
+			if err == store.ErrKeyNotFound {
+				pairs = []*store.KVPair{}
+			}
+
+			select {
+			case watchCh <- pairs:
+			case <-stopCh:
+				return
+			case <-m.done:
+				return
+			}
+
+			select {
+			case <-stopCh:
+				return
+			case <-m.done:
+				return
+			case <-w.notifyCh:
+			}
+		}
+	}()
+
+	return watchCh, nil
+}
+
+// WatchEvents watches for changes on child nodes under a given directory,
+// the events are the diff between the contents before and after every change
+func (m *Memory) WatchEvents(directory string, stopCh <-chan struct{}) (<-chan *store.Event, error) {
+	eventCh := make(chan *store.Event)
+	nKey := normalize(directory)
+	w := m.addWatcher(nKey, true)
+	prev, _ := m.List(nKey)
+
+	go func() {
+		defer close(eventCh)
+		defer m.removeWatcher(w)
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-m.done:
+				return
+			case <-w.notifyCh:
+			}
+
+			pairs, _ := m.List(nKey)
+			for _, event := range store.DiffEvents(prev, pairs) {
+				select {
+				case eventCh <- event:
+				case <-stopCh:
+					return
+				case <-m.done:
+					return
+				}
+			}
+			prev = pairs
+		}
+	}()
+
+	return eventCh, nil
+}
+
+func (m *Memory) addWatcher(key string, tree bool) *watcher {
+	m.Lock()
+	defer m.Unlock()
+
+	w := &watcher{
+		key:      key,
+		tree:     tree,
+		notifyCh: make(chan struct{}, 1),
+	}
+	m.watchers[w] = struct{}{}
+	return w
+}
+
+func (m *Memory) removeWatcher(w *watcher) {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.watchers, w)
+}
+
+// Close the store, the ephemeral keys are removed and all the watches are stopped
+func (m *Memory) Close() {
+	m.closeOnce.Do(func() {
+		m.Lock()
+		for key, e := range m.data {
+			if e.ephemeral {
+				m.drop(key)
+			}
+		}
+		m.Unlock()
+		close(m.done)
+	})
+}
+
+// normalize the key for usage in memory, keeps the same form as consul
+func normalize(key string) string {
+	return strings.TrimPrefix(store.Normalize(key), "/")
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
@@ -0,0 +1,196 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore"
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/testutils"
+)
+
+// run all: go test -v github.com/beyondyyh/libs/kvstore/store/memory
+
+func makeMemoryClient(t *testing.T) store.Store {
+	kv, err := New(nil, nil)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	return kv
+}
+
+// go test -v -run TestRegister github.com/beyondyyh/libs/kvstore/store/memory
+func TestRegister(t *testing.T) {
+	Register()
+
+	assert := assert.New(t)
+	kv, err := kvstore.NewStore(store.MEMORY, nil, nil)
+	assert.NoError(err)
+	assert.NotNil(kv)
+
+	if _, ok := kv.(*Memory); !ok {
+		t.Fatal("Error registering and initializing memory")
+	}
+}
+
+// go test -v -run TestMemoryStore github.com/beyondyyh/libs/kvstore/store/memory
+func TestMemoryStore(t *testing.T) {
+	kv := makeMemoryClient(t)
+	defer kv.Close()
+	defer testutils.RunCleanup(t, kv)
+
+	testutils.RunTestCommon(t, kv)
+	testutils.RunTestAtomic(t, kv)
+	testutils.RunTestTxn(t, kv)
+	testutils.RunTestBatch(t, kv)
+	testutils.RunTestLock(t, kv)
+	testutils.RunTestWatch(t, kv)
+	testutils.RunTestWatchEvents(t, kv)
+}
+
+// go test -v -run TestMemoryTTL github.com/beyondyyh/libs/kvstore/store/memory
+func TestMemoryTTL(t *testing.T) {
+	assert := assert.New(t)
+	kv := makeMemoryClient(t)
+	defer kv.Close()
+
+	key := "testTTL"
+	err := kv.Put(key, []byte("bar"), &store.WriteOptions{TTL: 100 * time.Millisecond})
+	assert.NoError(err)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	events, err := kv.Watch(key, stopCh)
+	assert.NoError(err)
+
+	pair := <-events
+	assert.Equal([]byte("bar"), pair.Value)
+
+	// the key is removed once expired, an empty pair is delivered
+	select {
+	case pair = <-events:
+		assert.Equal("", pair.Key)
+	case <-time.After(time.Second):
+		t.Fatal("Timeout reached")
+	}
+	exists, err := kv.Exists(key)
+	assert.NoError(err)
+	assert.False(exists)
+
+	// LastIndex increases on every write
+	assert.NoError(kv.Put(key, []byte("foo"), nil))
+	first, err := kv.Get(key)
+	assert.NoError(err)
+	assert.NoError(kv.Put(key, []byte("foo"), nil))
+	second, err := kv.Get(key)
+	assert.NoError(err)
+	assert.True(second.LastIndex > first.LastIndex)
+}
+
+// go test -v -run TestMemoryLockRenew github.com/beyondyyh/libs/kvstore/store/memory
+func TestMemoryLockRenew(t *testing.T) {
+	assert := assert.New(t)
+	kv := makeMemoryClient(t)
+	defer kv.Close()
+
+	lock, err := kv.NewLock("testLockRenew", &store.LockOptions{TTL: 300 * time.Millisecond})
+	assert.NoError(err)
+	lockCh, err := lock.Lock(nil)
+	assert.NoError(err)
+
+	// the lock is kept alive beyond its ttl while held
+	select {
+	case <-lockCh:
+		t.Fatal("Lock lost while held")
+	case <-time.After(time.Second):
+	}
+	exists, err := kv.Exists("testLockRenew")
+	assert.NoError(err)
+	assert.True(exists)
+
+	// the lock is lost once the key is removed by someone else
+	assert.NoError(kv.Delete("testLockRenew"))
+	select {
+	case <-lockCh:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout reached")
+	}
+	assert.Equal(store.ErrLockNotHeld, lock.Unlock())
+}
+
+// go test -v -run TestMemoryEphemeral github.com/beyondyyh/libs/kvstore/store/memory
+func TestMemoryEphemeral(t *testing.T) {
+	assert := assert.New(t)
+	kv := makeMemoryClient(t)
+
+	assert.NoError(kv.Put("testEphemeral/key", []byte("foo"), &store.WriteOptions{Ephemeral: true, TTL: 100 * time.Millisecond}))
+	assert.NoError(kv.Put("testEphemeral/kept", []byte("foo"), nil))
+
+	// the key is kept alive beyond its ttl until Close
+	time.Sleep(300 * time.Millisecond)
+	pair, err := kv.Get("testEphemeral/key")
+	assert.NoError(err)
+	assert.Equal([]byte("foo"), pair.Value)
+
+	kv.Close()
+	_, err = kv.Get("testEphemeral/key")
+	assert.Equal(store.ErrKeyNotFound, err)
+	_, err = kv.Get("testEphemeral/kept")
+	assert.NoError(err)
+}
+
+// go test -v -run TestMemoryEphemeralWrites github.com/beyondyyh/libs/kvstore/store/memory
+func TestMemoryEphemeralWrites(t *testing.T) {
+	assert := assert.New(t)
+	kv := makeMemoryClient(t)
+
+	// every write honors Ephemeral, not only Put
+	options := &store.WriteOptions{Ephemeral: true, TTL: 100 * time.Millisecond}
+	_, _, err := kv.AtomicPut("testEphemeral/atomic", []byte("foo"), nil, options)
+	assert.NoError(err)
+	_, err = store.PutMany(kv, []*store.KVPair{{Key: "testEphemeral/many", Value: []byte("foo")}}, options)
+	assert.NoError(err)
+	_, err = kv.Txn([]*store.TxnOp{store.PutOp("testEphemeral/txn", []byte("foo"), options)})
+	assert.NoError(err)
+
+	keys := []string{"testEphemeral/atomic", "testEphemeral/many", "testEphemeral/txn"}
+	time.Sleep(300 * time.Millisecond)
+	for _, key := range keys {
+		_, err = kv.Get(key)
+		assert.NoError(err, key)
+	}
+
+	kv.Close()
+	for _, key := range keys {
+		_, err = kv.Get(key)
+		assert.Equal(store.ErrKeyNotFound, err, key)
+	}
+}
+
+// go test -v -run TestMemoryLockTinyTTL github.com/beyondyyh/libs/kvstore/store/memory
+func TestMemoryLockTinyTTL(t *testing.T) {
+	assert := assert.New(t)
+	kv := makeMemoryClient(t)
+	defer kv.Close()
+
+	// a ttl under 3ns used to make the renewal ticker panic
+	lock, err := kv.NewLock("testLockTinyTTL", &store.LockOptions{TTL: time.Nanosecond})
+	assert.NoError(err)
+	_, err = lock.Lock(nil)
+	assert.NoError(err)
+	lock.Unlock()
+
+	// a negative ttl is the default one
+	lock, err = kv.NewLock("testLockTinyTTL", &store.LockOptions{TTL: -time.Second})
+	assert.NoError(err)
+	lockCh, err := lock.Lock(nil)
+	assert.NoError(err)
+	select {
+	case <-lockCh:
+		t.Fatal("Lock lost while held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.NoError(lock.Unlock())
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"math/rand"
+	"time"
+)
+
+// DefaultPollingInterval is used when the interval of a PollingWatcher is not positive
+const DefaultPollingInterval = time.Second
+
+// PollingWatcher implements Watch and WatchTree for any Store by calling Get/List
+// periodically and comparing the LastIndex of the pairs with the last pushed ones.
+// It's meant for the backends which can't push notifications, the changes are delayed
+// by up to Interval+Jitter and the changes in between two polls are coalesced
+type PollingWatcher struct {
+	Store    Store
+	Interval time.Duration // delay between two polls
+	Jitter   time.Duration // random extra delay so that many watchers don't poll at once
+}
+
+var (
+	_ ErrorWatcher = (*PollingWatcher)(nil)
+	_ EventWatcher = (*PollingWatcher)(nil)
+)
+
+// NewPollingWatcher creates a PollingWatcher polling s every interval plus up to jitter
+func NewPollingWatcher(s Store, interval, jitter time.Duration) *PollingWatcher {
+	return &PollingWatcher{Store: s, Interval: interval, Jitter: jitter}
+}
+
+// Watch for changes on a key, the current value is pushed first if the key exists,
+// an empty KVPair is pushed once the key is deleted
+func (p *PollingWatcher) Watch(key string, stopCh <-chan struct{}) (<-chan *KVPair, error) {
+	watchCh, _, err := p.WatchWithErrors(key, stopCh)
+	return watchCh, err
+}
+
+// WatchWithErrors is Watch with the errors of Get reported on the error channel,
+// the errors are dropped if they are not read
+func (p *PollingWatcher) WatchWithErrors(key string, stopCh <-chan struct{}) (<-chan *KVPair, <-chan error, error) {
+	watchCh := make(chan *KVPair)
+	errCh := make(chan error, 1)
+
+	var (
+		exists    bool
+		lastIndex uint64
+	)
+	go p.poll(stopCh, errCh, func() bool {
+		pair, err := p.Store.Get(key)
+		if err != nil && err != ErrKeyNotFound {
+			report(errCh, err)
+			return true
+		}
+
+		switch {
+		case err == nil && (!exists || pair.LastIndex != lastIndex):
+			exists, lastIndex = true, pair.LastIndex
+		case err != nil && exists:
+			exists, lastIndex, pair = false, 0, &KVPair{}
+		default:
+			return true
+		}
+
+		select {
+		case watchCh <- pair:
+			return true
+		case <-stopCh:
+			return false
+		}
+	}, func() {
+		close(watchCh)
+	})
+
+	return watchCh, errCh, nil
+}
+
+// WatchTree watches for changes on child nodes under a given directory,
+// the current content, possibly empty, is pushed first
+func (p *PollingWatcher) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*KVPair, error) {
+	watchCh, _, err := p.WatchTreeWithErrors(directory, stopCh)
+	return watchCh, err
+}
+
+// WatchTreeWithErrors is WatchTree with the errors of List reported on the error channel,
+// the errors are dropped if they are not read
+func (p *PollingWatcher) WatchTreeWithErrors(directory string, stopCh <-chan struct{}) (<-chan []*KVPair, <-chan error, error) {
+	watchCh := make(chan []*KVPair)
+	errCh := make(chan error, 1)
+
+	var indexes map[string]uint64
+	go p.poll(stopCh, errCh, func() bool {
+		pairs, err := p.Store.List(directory)
+		if err != nil && err != ErrKeyNotFound {
+			report(errCh, err)
+			return true
+		}
+		if pairs == nil {
+			pairs = []*KVPair{}
+		}
+
+		current := Indexes(pairs)
+		if indexes != nil && SameIndexes(indexes, current) {
+			return true
+		}
+		indexes = current
+
+		select {
+		case watchCh <- pairs:
+			return true
+		case <-stopCh:
+			return false
+		}
+	}, func() {
+		close(watchCh)
+	})
+
+	return watchCh, errCh, nil
+}
+
+// WatchEvents watches for changes on child nodes under a given directory,
+// the events are the diff between consecutive List, see DiffEvents
+func (p *PollingWatcher) WatchEvents(directory string, stopCh <-chan struct{}) (<-chan *Event, error) {
+	eventCh := make(chan *Event)
+	errCh := make(chan error, 1)
+
+	// the current content is the base of the diff
+	prev, err := p.Store.List(directory)
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+
+	go p.poll(stopCh, errCh, func() bool {
+		pairs, err := p.Store.List(directory)
+		if err != nil && err != ErrKeyNotFound {
+			return true
+		}
+
+		events := DiffEvents(prev, pairs)
+		prev = pairs
+		for _, event := range events {
+			select {
+			case eventCh <- event:
+			case <-stopCh:
+				return false
+			}
+		}
+		return true
+	}, func() {
+		close(eventCh)
+	})
+
+	return eventCh, nil
+}
+
+// poll calls check until it returns false or stopCh is closed,
+// then done is called and errCh is closed
+func (p *PollingWatcher) poll(stopCh <-chan struct{}, errCh chan error, check func() bool, done func()) {
+	defer close(errCh)
+	defer done()
+
+	for check() {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(p.delay()):
+		}
+	}
+}
+
+func (p *PollingWatcher) delay() time.Duration {
+	d := p.Interval
+	if d <= 0 {
+		d = DefaultPollingInterval
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(p.Jitter)))
+	}
+	return d
+}
+
+// report sends err without blocking
+func report(errCh chan<- error, err error) {
+	select {
+	case errCh <- err:
+	default:
+	}
+}
+
+// Indexes returns the LastIndex of pairs by key
+func Indexes(pairs []*KVPair) map[string]uint64 {
+	indexes := make(map[string]uint64, len(pairs))
+	for _, pair := range pairs {
+		indexes[pair.Key] = pair.LastIndex
+	}
+	return indexes
+}
+
+// SameIndexes reports whether two results of Indexes hold the same keys at the same LastIndex,
+// the watches polling a directory use it to skip the listings which did not change
+func SameIndexes(a, b map[string]uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, index := range a {
+		if other, ok := b[key]; !ok || other != index {
+			return false
+		}
+	}
+	return true
+}
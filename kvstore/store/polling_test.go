@@ -0,0 +1,75 @@
+package store_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/store/memory"
+	"github.com/beyondyyh/libs/kvstore/testutils"
+)
+
+// pollOnly hides the Watch and WatchTree of the wrapped store
+type pollOnly struct {
+	store.Store
+	*store.PollingWatcher
+}
+
+func (p pollOnly) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	return p.PollingWatcher.Watch(key, stopCh)
+}
+
+func (p pollOnly) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	return p.PollingWatcher.WatchTree(directory, stopCh)
+}
+
+// go test -v -run TestPollingWatcher github.com/beyondyyh/libs/kvstore/store
+func TestPollingWatcher(t *testing.T) {
+	kv, _ := memory.New(nil, nil)
+	defer kv.Close()
+
+	p := pollOnly{kv, store.NewPollingWatcher(kv, 10*time.Millisecond, 5*time.Millisecond)}
+	testutils.RunTestWatch(t, p)
+	testutils.RunTestWatchEvents(t, p)
+	testutils.RunCleanup(t, kv)
+}
+
+// go test -v -run TestPollingWatcherDelete github.com/beyondyyh/libs/kvstore/store
+func TestPollingWatcherDelete(t *testing.T) {
+	assert := assert.New(t)
+	kv, _ := memory.New(nil, nil)
+	defer kv.Close()
+
+	p := store.NewPollingWatcher(kv, 10*time.Millisecond, 0)
+	stopCh := make(chan struct{})
+	events, errCh, err := p.WatchWithErrors("testPollingWatcher", stopCh)
+	assert.NoError(err)
+
+	assert.NoError(kv.Put("testPollingWatcher", []byte("hello"), nil))
+	pair := <-events
+	assert.Equal([]byte("hello"), pair.Value)
+
+	assert.NoError(kv.Delete("testPollingWatcher"))
+	assert.Equal(&store.KVPair{}, <-events)
+
+	close(stopCh)
+	_, ok := <-events
+	assert.False(ok)
+	_, ok = <-errCh
+	assert.False(ok)
+}
+
+// go test -v -run TestSameIndexes github.com/beyondyyh/libs/kvstore/store
+func TestSameIndexes(t *testing.T) {
+	assert := assert.New(t)
+
+	a := store.Indexes([]*store.KVPair{{Key: "a", LastIndex: 1}, {Key: "b", LastIndex: 2}})
+	assert.Equal(map[string]uint64{"a": 1, "b": 2}, a)
+	assert.True(store.SameIndexes(a, store.Indexes([]*store.KVPair{{Key: "b", LastIndex: 2}, {Key: "a", LastIndex: 1}})))
+	assert.False(store.SameIndexes(a, store.Indexes([]*store.KVPair{{Key: "a", LastIndex: 1}, {Key: "b", LastIndex: 3}})))
+	assert.False(store.SameIndexes(a, store.Indexes([]*store.KVPair{{Key: "a", LastIndex: 1}, {Key: "c", LastIndex: 2}})))
+	assert.False(store.SameIndexes(a, store.Indexes(nil)))
+	assert.True(store.SameIndexes(store.Indexes(nil), map[string]uint64{}))
+}
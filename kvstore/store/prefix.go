@@ -0,0 +1,285 @@
+package store
+
+import (
+	"strings"
+)
+
+// WithPrefix returns a view of s confined under prefix: the keys are prefixed on the way in
+// and stripped on the way out, so that the tenants sharing a backend can't see nor touch each
+// other's keys. The prefix is a directory, "app" and "/app/" are the same, and the keys outside
+// of it, such as "application/key", are out of reach. An empty prefix returns s.
+//
+// The optional interfaces ListPager, ErrorWatcher, EventWatcher, TreeDeleter and BatchStore are
+// implemented on top of the ones of s, ErrCallNotSupported is returned when s does not implement them
+// unless the store package has a fallback, such as ListPage
+func WithPrefix(s Store, prefix string) Store {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return s
+	}
+	return &prefixStore{s: s, prefix: prefix + "/"}
+}
+
+type prefixStore struct {
+	s      Store
+	prefix string
+}
+
+var (
+	_ ListPager    = (*prefixStore)(nil)
+	_ ErrorWatcher = (*prefixStore)(nil)
+	_ EventWatcher = (*prefixStore)(nil)
+	_ TreeDeleter  = (*prefixStore)(nil)
+	_ BatchStore   = (*prefixStore)(nil)
+)
+
+// key returns the key of the underlying store
+func (p *prefixStore) key(key string) string {
+	return p.prefix + strings.TrimLeft(key, "/")
+}
+
+// strip returns a copy of pair with the key relative to the prefix,
+// the empty pairs pushed by Watch on deletion are kept as is
+func (p *prefixStore) strip(pair *KVPair) *KVPair {
+	if pair == nil {
+		return nil
+	}
+	stripped := *pair
+	if pair.Key != "" {
+		stripped.Key = strings.TrimPrefix(strings.TrimLeft(pair.Key, "/"), p.prefix)
+	}
+	return &stripped
+}
+
+func (p *prefixStore) stripAll(pairs []*KVPair) []*KVPair {
+	if pairs == nil {
+		return nil
+	}
+	stripped := make([]*KVPair, len(pairs))
+	for i, pair := range pairs {
+		stripped[i] = p.strip(pair)
+	}
+	return stripped
+}
+
+// previous returns the previous pair with the key of the underlying store
+func (p *prefixStore) previous(key string, previous *KVPair) *KVPair {
+	if previous == nil {
+		return nil
+	}
+	prev := *previous
+	prev.Key = key
+	return &prev
+}
+
+func (p *prefixStore) Put(key string, value []byte, options *WriteOptions) error {
+	return p.s.Put(p.key(key), value, options)
+}
+
+func (p *prefixStore) Get(key string) (*KVPair, error) {
+	pair, err := p.s.Get(p.key(key))
+	if err != nil {
+		return nil, err
+	}
+	return p.strip(pair), nil
+}
+
+func (p *prefixStore) Delete(key string) error {
+	return p.s.Delete(p.key(key))
+}
+
+func (p *prefixStore) Exists(key string) (bool, error) {
+	return p.s.Exists(p.key(key))
+}
+
+func (p *prefixStore) Watch(key string, stopCh <-chan struct{}) (<-chan *KVPair, error) {
+	watchCh, err := p.s.Watch(p.key(key), stopCh)
+	if err != nil {
+		return nil, err
+	}
+	return p.stripWatch(watchCh, stopCh), nil
+}
+
+func (p *prefixStore) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*KVPair, error) {
+	watchCh, err := p.s.WatchTree(p.key(directory), stopCh)
+	if err != nil {
+		return nil, err
+	}
+	return p.stripWatchTree(watchCh, stopCh), nil
+}
+
+func (p *prefixStore) WatchWithErrors(key string, stopCh <-chan struct{}) (<-chan *KVPair, <-chan error, error) {
+	w, ok := p.s.(ErrorWatcher)
+	if !ok {
+		return nil, nil, ErrCallNotSupported
+	}
+	watchCh, errCh, err := w.WatchWithErrors(p.key(key), stopCh)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.stripWatch(watchCh, stopCh), errCh, nil
+}
+
+func (p *prefixStore) WatchTreeWithErrors(directory string, stopCh <-chan struct{}) (<-chan []*KVPair, <-chan error, error) {
+	w, ok := p.s.(ErrorWatcher)
+	if !ok {
+		return nil, nil, ErrCallNotSupported
+	}
+	watchCh, errCh, err := w.WatchTreeWithErrors(p.key(directory), stopCh)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.stripWatchTree(watchCh, stopCh), errCh, nil
+}
+
+func (p *prefixStore) WatchEvents(directory string, stopCh <-chan struct{}) (<-chan *Event, error) {
+	w, ok := p.s.(EventWatcher)
+	if !ok {
+		return nil, ErrCallNotSupported
+	}
+	eventCh, err := w.WatchEvents(p.key(directory), stopCh)
+	if err != nil {
+		return nil, err
+	}
+
+	strippedCh := make(chan *Event)
+	go func() {
+		defer close(strippedCh)
+		for event := range eventCh {
+			stripped := &Event{Type: event.Type, Pair: p.strip(event.Pair), PrevPair: p.strip(event.PrevPair)}
+			select {
+			case strippedCh <- stripped:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return strippedCh, nil
+}
+
+func (p *prefixStore) stripWatch(watchCh <-chan *KVPair, stopCh <-chan struct{}) <-chan *KVPair {
+	strippedCh := make(chan *KVPair)
+	go func() {
+		defer close(strippedCh)
+		for pair := range watchCh {
+			select {
+			case strippedCh <- p.strip(pair):
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return strippedCh
+}
+
+func (p *prefixStore) stripWatchTree(watchCh <-chan []*KVPair, stopCh <-chan struct{}) <-chan []*KVPair {
+	strippedCh := make(chan []*KVPair)
+	go func() {
+		defer close(strippedCh)
+		for pairs := range watchCh {
+			select {
+			case strippedCh <- p.stripAll(pairs):
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return strippedCh
+}
+
+func (p *prefixStore) NewLock(key string, options *LockOptions) (Locker, error) {
+	return p.s.NewLock(p.key(key), options)
+}
+
+func (p *prefixStore) List(directory string) ([]*KVPair, error) {
+	pairs, err := p.s.List(p.key(directory))
+	if err != nil {
+		return nil, err
+	}
+	return p.stripAll(pairs), nil
+}
+
+// ListPage lists a page of directory, the cursors are the ones of the underlying store
+func (p *prefixStore) ListPage(directory, cursor string, limit int) ([]*KVPair, string, error) {
+	pairs, next, err := ListPage(p.s, p.key(directory), cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return p.stripAll(pairs), next, nil
+}
+
+// DeleteTree deletes the keys under directory, an empty directory is the whole prefix
+func (p *prefixStore) DeleteTree(directory string) error {
+	return p.s.DeleteTree(p.key(directory))
+}
+
+func (p *prefixStore) DeleteTreeWithOptions(directory string, options *DeleteTreeOptions) (int, error) {
+	d, ok := p.s.(TreeDeleter)
+	if !ok {
+		return 0, ErrCallNotSupported
+	}
+	return d.DeleteTreeWithOptions(p.key(directory), options)
+}
+
+func (p *prefixStore) AtomicPut(key string, value []byte, previous *KVPair, options *WriteOptions) (bool, *KVPair, error) {
+	key = p.key(key)
+	ok, pair, err := p.s.AtomicPut(key, value, p.previous(key, previous), options)
+	return ok, p.strip(pair), err
+}
+
+func (p *prefixStore) AtomicDelete(key string, previous *KVPair) (bool, error) {
+	key = p.key(key)
+	return p.s.AtomicDelete(key, p.previous(key, previous))
+}
+
+func (p *prefixStore) Txn(ops []*TxnOp) ([]*KVPair, error) {
+	prefixed := make([]*TxnOp, len(ops))
+	for i, op := range ops {
+		o := *op
+		o.Key = p.key(op.Key)
+		prefixed[i] = &o
+	}
+	pairs, err := p.s.Txn(prefixed)
+	if err != nil {
+		return nil, err
+	}
+	return p.stripAll(pairs), nil
+}
+
+func (p *prefixStore) GetMany(keys []string) ([]*KeyResult, error) {
+	results, err := GetMany(p.s, p.keys(keys))
+	return p.stripResults(results), err
+}
+
+func (p *prefixStore) PutMany(pairs []*KVPair, options *WriteOptions) ([]*KeyResult, error) {
+	prefixed := make([]*KVPair, len(pairs))
+	for i, pair := range pairs {
+		prefixed[i] = &KVPair{Key: p.key(pair.Key), Value: pair.Value}
+	}
+	results, err := PutMany(p.s, prefixed, options)
+	return p.stripResults(results), err
+}
+
+func (p *prefixStore) DeleteMany(keys []string) ([]*KeyResult, error) {
+	return DeleteMany(p.s, p.keys(keys))
+}
+
+func (p *prefixStore) keys(keys []string) []string {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = p.key(key)
+	}
+	return prefixed
+}
+
+func (p *prefixStore) stripResults(results []*KeyResult) []*KeyResult {
+	for _, result := range results {
+		result.Pair = p.strip(result.Pair)
+	}
+	return results
+}
+
+// Close the underlying store
+func (p *prefixStore) Close() {
+	p.s.Close()
+}
@@ -0,0 +1,90 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/store/memory"
+	"github.com/beyondyyh/libs/kvstore/testutils"
+)
+
+// go test -v -run TestWithPrefix github.com/beyondyyh/libs/kvstore/store
+func TestWithPrefix(t *testing.T) {
+	kv, err := memory.New(nil, nil)
+	assert.NoError(t, err)
+	defer kv.Close()
+
+	prefixed := store.WithPrefix(kv, "/tenant/")
+	defer testutils.RunCleanup(t, prefixed)
+
+	testutils.RunTestCommon(t, prefixed)
+	testutils.RunTestAtomic(t, prefixed)
+	testutils.RunTestTxn(t, prefixed)
+	testutils.RunTestBatch(t, prefixed)
+	testutils.RunTestLock(t, prefixed)
+	testutils.RunTestWatch(t, prefixed)
+	testutils.RunTestWatchEvents(t, prefixed)
+
+	assert.Equal(t, kv, store.WithPrefix(kv, "/"))
+}
+
+// go test -v -run TestWithPrefixConfinement github.com/beyondyyh/libs/kvstore/store
+func TestWithPrefixConfinement(t *testing.T) {
+	assert := assert.New(t)
+	kv, err := memory.New(nil, nil)
+	assert.NoError(err)
+	defer kv.Close()
+
+	tenant := store.WithPrefix(kv, "tenant")
+	other := store.WithPrefix(kv, "tenantB")
+
+	assert.NoError(tenant.Put("/app/key", []byte("a"), nil))
+	assert.NoError(other.Put("app/key", []byte("b"), nil))
+	assert.NoError(kv.Put("tenantC", []byte("c"), nil))
+
+	// the keys are prefixed in the underlying store and stripped on the way out
+	pair, err := kv.Get("tenant/app/key")
+	assert.NoError(err)
+	assert.Equal([]byte("a"), pair.Value)
+	pair, err = tenant.Get("app/key")
+	assert.NoError(err)
+	assert.Equal("app/key", pair.Key)
+
+	pairs, err := tenant.List("")
+	assert.NoError(err)
+	if assert.Equal(1, len(pairs)) {
+		assert.Equal("app/key", pairs[0].Key)
+		assert.Equal([]byte("a"), pairs[0].Value)
+	}
+	pairs, _, err = store.ListPage(tenant, "app", "", 10)
+	assert.NoError(err)
+	if assert.Equal(1, len(pairs)) {
+		assert.Equal("app/key", pairs[0].Key)
+	}
+
+	// the CAS operations work with the stripped pairs
+	ok, pair, err := tenant.AtomicPut("app/key", []byte("a2"), pair, nil)
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal("app/key", pair.Key)
+	ok, err = tenant.AtomicDelete("app/key", pair)
+	assert.NoError(err)
+	assert.True(ok)
+
+	// deleting the whole prefix does not reach the keys sharing its first letters
+	assert.NoError(tenant.Put("app/key", []byte("a"), nil))
+	assert.NoError(tenant.DeleteTree(""))
+	_, err = tenant.Get("app/key")
+	assert.Equal(store.ErrKeyNotFound, err)
+	pair, err = other.Get("app/key")
+	assert.NoError(err)
+	assert.Equal([]byte("b"), pair.Value)
+	exists, err := kv.Exists("tenantC")
+	assert.NoError(err)
+	assert.True(exists)
+
+	_, err = store.WithPrefix(listOnly{kv}, "tenant").(store.EventWatcher).WatchEvents("", nil)
+	assert.Equal(store.ErrCallNotSupported, err)
+}
@@ -0,0 +1,173 @@
+package redis
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// GetMany reads keys by MGET, or in a pipeline on a cluster, see store.BatchStore
+func (r *Redis) GetMany(keys []string) ([]*store.KeyResult, error) {
+	return r.getMany(context.Background(), keys)
+}
+
+func (r *Redis) getMany(ctx context.Context, keys []string) ([]*store.KeyResult, error) {
+	if len(keys) == 0 {
+		return []*store.KeyResult{}, nil
+	}
+
+	nKeys := make([]string, len(keys))
+	for i, key := range keys {
+		nKeys[i] = normalize(key)
+	}
+	pairs, err := r.getMulti(ctx, nKeys...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*store.KeyResult, len(keys))
+	for i, pair := range pairs {
+		if pair == nil {
+			results[i] = &store.KeyResult{Err: store.ErrKeyNotFound}
+			continue
+		}
+		results[i] = &store.KeyResult{Pair: pair}
+	}
+	return results, nil
+}
+
+// PutMany writes pairs by running the lua script in a pipeline, see store.BatchStore.
+// The ephemeral pairs are written one by one since every key needs its own renewal
+func (r *Redis) PutMany(pairs []*store.KVPair, options *store.WriteOptions) ([]*store.KeyResult, error) {
+	return r.putMany(context.Background(), pairs, options)
+}
+
+func (r *Redis) putMany(ctx context.Context, pairs []*store.KVPair, options *store.WriteOptions) ([]*store.KeyResult, error) {
+	expirationAfter := noExpiration
+	if options != nil && options.TTL != 0 {
+		expirationAfter = options.TTL
+	}
+
+	results := make([]*store.KeyResult, len(pairs))
+	if options != nil && options.Ephemeral {
+		for i, pair := range pairs {
+			written, err := r.putEphemeral(ctx, pair.Key, pair.Value, expirationAfter)
+			results[i] = &store.KeyResult{Pair: written, Err: err}
+		}
+		return results, nil
+	}
+
+	keys := make([]string, len(pairs))
+	args := make([][]interface{}, len(pairs))
+	vals := make([]*store.KVPair, len(pairs))
+	for i, pair := range pairs {
+		// the script fills in the index
+		val := &store.KVPair{Key: pair.Key, Value: pair.Value}
+		data, err := r.codec.Encode(val)
+		if err != nil {
+			results[i] = &store.KeyResult{Err: err}
+			continue
+		}
+		keys[i] = normalize(pair.Key)
+		args[i] = []interface{}{"set", r.layout, data, val.Key, formatMs(expirationAfter)}
+		vals[i] = val
+	}
+
+	cmds, err := r.evalMany(ctx, keys, args)
+	if err != nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		index, err := cmd.Int64()
+		if err == nil {
+			err = scriptResult(index)
+		}
+		if err != nil {
+			results[i] = &store.KeyResult{Err: err}
+			continue
+		}
+		vals[i].LastIndex = uint64(index)
+		results[i] = &store.KeyResult{Pair: vals[i]}
+	}
+	return results, nil
+}
+
+// evalMany runs the lua script on keys in a pipeline, keys[i] is skipped if args[i] is nil.
+// The script is sent by EVALSHA first, then by EVAL to the nodes which don't know it yet
+func (r *Redis) evalMany(ctx context.Context, keys []string, args [][]interface{}) ([]*redis.Cmd, error) {
+	cmds := make([]*redis.Cmd, len(keys))
+	var pending []int
+	for i := range keys {
+		if args[i] != nil {
+			pending = append(pending, i)
+		}
+	}
+
+	for _, eval := range []bool{false, true} {
+		if len(pending) == 0 {
+			break
+		}
+		pipe := r.client.Pipeline()
+		for _, i := range pending {
+			if eval {
+				cmds[i] = r.script.Eval(ctx, pipe, []string{keys[i]}, args[i]...)
+			} else {
+				cmds[i] = r.script.EvalSha(ctx, pipe, []string{keys[i]}, args[i]...)
+			}
+		}
+		// the errors are checked command by command
+		pipe.Exec(ctx)
+
+		var noScript []int
+		for _, i := range pending {
+			err := cmds[i].Err()
+			if err == nil {
+				continue
+			}
+			if isNetworkError(err) {
+				return nil, err
+			}
+			if strings.HasPrefix(err.Error(), "NOSCRIPT") {
+				noScript = append(noScript, i)
+			}
+		}
+		pending = noScript
+	}
+	return cmds, nil
+}
+
+// DeleteMany deletes keys in a pipeline, see store.BatchStore
+func (r *Redis) DeleteMany(keys []string) ([]*store.KeyResult, error) {
+	return r.deleteMany(context.Background(), keys)
+}
+
+func (r *Redis) deleteMany(ctx context.Context, keys []string) ([]*store.KeyResult, error) {
+	if len(keys) == 0 {
+		return []*store.KeyResult{}, nil
+	}
+
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Del(ctx, normalize(key))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && isNetworkError(err) {
+		return nil, err
+	}
+
+	results := make([]*store.KeyResult, len(keys))
+	for i, cmd := range cmds {
+		n, err := cmd.Result()
+		if err == nil && n == 0 {
+			err = store.ErrKeyNotFound
+		}
+		results[i] = &store.KeyResult{Err: err}
+	}
+	return results, nil
+}
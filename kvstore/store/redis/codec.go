@@ -0,0 +1,339 @@
+package redis
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// Codec names, selected by store.Config.Codec, store.Config.CustomCodec takes any other Codec
+const (
+	// CodecJSON stores the whole KVPair as a json string, the default codec
+	CodecJSON = "json"
+	// CodecMsgpack stores the KVPair as a msgpack array [Key, Value, LastIndex]
+	CodecMsgpack = "msgpack"
+	// CodecRaw stores the value as is in the "value" field of a redis hash,
+	// the metadata are stored in the "key" and "index" fields
+	CodecRaw = "raw"
+)
+
+// Hash fields used by CodecRaw
+const (
+	hashFieldValue = "value"
+	hashFieldIndex = "index"
+	hashFieldKey   = "key"
+)
+
+var (
+	// ErrUnknownCodec is thrown when store.Config.Codec is not supported
+	ErrUnknownCodec = errors.New("redis: unknown codec")
+	// ErrMalformedData is thrown when the data stored at a key can't be decoded
+	ErrMalformedData = errors.New("redis: malformed data")
+)
+
+// Codec defines how a KVPair is stored at a redis key.
+// JSONCodec and MsgpackCodec are stored as strings, the lua script reads their LastIndex
+// from the data. Any other codec, RawCodec included, is stored like RawCodec in a hash:
+// the data is the "value" field and the metadata are kept by the backend in the other
+// fields, so Encode may drop Key and LastIndex and the script never decodes the data
+type Codec = store.Codec
+
+// Layouts of the data at a redis key, given to the lua script instead of the codec name
+const (
+	layoutJSON    = "json"
+	layoutMsgpack = "msgpack"
+	layoutHash    = "hash"
+)
+
+// layout returns the layout of the data written by codec, see Codec
+func layout(codec Codec) string {
+	switch codec.(type) {
+	case JSONCodec, *JSONCodec:
+		return layoutJSON
+	case MsgpackCodec, *MsgpackCodec:
+		return layoutMsgpack
+	}
+	return layoutHash
+}
+
+// NewCodec returns the codec with the given name, an empty name means CodecJSON
+func NewCodec(name string) (Codec, error) {
+	switch name {
+	case "", CodecJSON:
+		return JSONCodec{}, nil
+	case CodecMsgpack:
+		return MsgpackCodec{}, nil
+	case CodecRaw:
+		return RawCodec{}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+}
+
+// JSONCodec encodes the whole KVPair with encoding/json,
+// Value is base64 encoded
+type JSONCodec struct{}
+
+func (c JSONCodec) Name() string {
+	return CodecJSON
+}
+
+func (c JSONCodec) Encode(kv *store.KVPair) (string, error) {
+	b, err := json.Marshal(kv)
+	return string(b), err
+}
+
+func (c JSONCodec) Decode(data string, kv *store.KVPair) error {
+	return json.Unmarshal([]byte(data), kv)
+}
+
+// RawCodec stores the value as is so that it's readable by any client
+// with `HGET key value`, the metadata are kept by the backend in the other
+// fields of the hash
+type RawCodec struct{}
+
+func (c RawCodec) Name() string {
+	return CodecRaw
+}
+
+func (c RawCodec) Encode(kv *store.KVPair) (string, error) {
+	return string(kv.Value), nil
+}
+
+func (c RawCodec) Decode(data string, kv *store.KVPair) error {
+	kv.Value = []byte(data)
+	return nil
+}
+
+// MsgpackCodec encodes the KVPair as a msgpack array [Key, Value, LastIndex],
+// which is compact and can be decoded by any msgpack library
+type MsgpackCodec struct{}
+
+func (c MsgpackCodec) Name() string {
+	return CodecMsgpack
+}
+
+func (c MsgpackCodec) Encode(kv *store.KVPair) (string, error) {
+	b := make([]byte, 0, 1+5+len(kv.Key)+5+len(kv.Value)+9)
+	b = append(b, 0x93) // fixarray of 3 elements
+	b = appendString(b, kv.Key)
+	b = appendBinary(b, kv.Value)
+	b = appendUint(b, kv.LastIndex)
+	return string(b), nil
+}
+
+func (c MsgpackCodec) Decode(data string, kv *store.KVPair) error {
+	d := msgpackDecoder{b: []byte(data)}
+	if n, err := d.arrayLen(); err != nil || n != 3 {
+		return ErrMalformedData
+	}
+
+	key, err := d.bytes()
+	if err != nil {
+		return err
+	}
+	value, err := d.bytes()
+	if err != nil {
+		return err
+	}
+	index, err := d.uint()
+	if err != nil {
+		return err
+	}
+
+	kv.Key = string(key)
+	kv.Value = value
+	kv.LastIndex = index
+	return nil
+}
+
+func appendString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xda)
+		b = appendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xdb)
+		b = appendUint32(b, uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendBinary(b []byte, v []byte) []byte {
+	if v == nil {
+		return append(b, 0xc0)
+	}
+	switch n := len(v); {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xc5)
+		b = appendUint16(b, uint16(n))
+	default:
+		b = append(b, 0xc6)
+		b = appendUint32(b, uint32(n))
+	}
+	return append(b, v...)
+}
+
+func appendUint(b []byte, v uint64) []byte {
+	switch {
+	case v < 128:
+		return append(b, byte(v))
+	case v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return appendUint16(append(b, 0xcd), uint16(v))
+	case v <= math.MaxUint32:
+		return appendUint32(append(b, 0xce), uint32(v))
+	}
+	return appendUint64(append(b, 0xcf), v)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+// msgpackDecoder decodes the subset of msgpack written by MsgpackCodec,
+// it also accepts the encodings produced by other libraries (e.g. lua cmsgpack)
+type msgpackDecoder struct {
+	b []byte
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if len(d.b) < n {
+		return nil, ErrMalformedData
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v, nil
+}
+
+func (d *msgpackDecoder) length(size int) (int, error) {
+	v, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(v[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(v)), nil
+	}
+	return int(binary.BigEndian.Uint32(v)), nil
+}
+
+func (d *msgpackDecoder) arrayLen() (int, error) {
+	c, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case c[0]&0xf0 == 0x90:
+		return int(c[0] & 0x0f), nil
+	case c[0] == 0xdc:
+		return d.length(2)
+	case c[0] == 0xdd:
+		return d.length(4)
+	}
+	return 0, ErrMalformedData
+}
+
+// bytes decodes a str, bin or nil
+func (d *msgpackDecoder) bytes() ([]byte, error) {
+	c, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var n int
+	switch {
+	case c[0] == 0xc0:
+		return nil, nil
+	case c[0]&0xe0 == 0xa0:
+		n = int(c[0] & 0x1f)
+	case c[0] == 0xc4 || c[0] == 0xd9:
+		n, err = d.length(1)
+	case c[0] == 0xc5 || c[0] == 0xda:
+		n, err = d.length(2)
+	case c[0] == 0xc6 || c[0] == 0xdb:
+		n, err = d.length(4)
+	default:
+		return nil, ErrMalformedData
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, v...), nil
+}
+
+// uint decodes a non negative integer, lua may encode it as a float.
+// The signed encodings are sign-extended so that a negative number is rejected
+func (d *msgpackDecoder) uint() (uint64, error) {
+	c, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	switch {
+	case c[0] < 0x80:
+		return uint64(c[0]), nil
+	case c[0] >= 0xe0:
+		// negative fixint
+		return 0, ErrMalformedData
+	case c[0] >= 0xcc && c[0] <= 0xcf:
+		size = 1 << (c[0] - 0xcc)
+	case c[0] >= 0xd0 && c[0] <= 0xd3:
+		size = 1 << (c[0] - 0xd0)
+	case c[0] == 0xcb:
+		v, err := d.next(8)
+		if err != nil {
+			return 0, err
+		}
+		f := math.Float64frombits(binary.BigEndian.Uint64(v))
+		if !(f >= 0) {
+			return 0, ErrMalformedData
+		}
+		return uint64(f), nil
+	default:
+		return 0, ErrMalformedData
+	}
+
+	v, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, b := range v {
+		u = u<<8 | uint64(b)
+	}
+	if c[0] >= 0xd0 {
+		// sign-extend the int8/16/32/64
+		shift := uint(64 - 8*size)
+		if int64(u<<shift)>>shift < 0 {
+			return 0, ErrMalformedData
+		}
+	}
+	return u, nil
+}
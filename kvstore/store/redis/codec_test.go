@@ -0,0 +1,176 @@
+package redis
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+	"github.com/beyondyyh/libs/kvstore/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -run TestCodec github.com/beyondyyh/libs/kvstore/store/redis
+func TestCodec(t *testing.T) {
+	assert := assert.New(t)
+
+	pairs := []*store.KVPair{
+		{Key: "testCodec", Value: []byte("hello"), LastIndex: 1},
+		{Key: "testCodec/empty", Value: []byte{}, LastIndex: 0},
+		{Key: "testCodec/large", Value: make([]byte, 70000), LastIndex: 1<<40 + 7},
+	}
+
+	for _, name := range []string{CodecJSON, CodecMsgpack} {
+		codec, err := NewCodec(name)
+		assert.NoError(err)
+		assert.Equal(name, codec.Name())
+
+		for _, kv := range pairs {
+			data, err := codec.Encode(kv)
+			assert.NoError(err)
+
+			got := &store.KVPair{}
+			assert.NoError(codec.Decode(data, got))
+			assert.Equal(kv.Key, got.Key, name)
+			assert.Equal(kv.LastIndex, got.LastIndex, name)
+			assert.Equal(len(kv.Value), len(got.Value), name)
+			assert.Equal(string(kv.Value), string(got.Value), name)
+		}
+	}
+
+	// raw only keeps the value, the metadata are kept in the hash
+	codec, err := NewCodec(CodecRaw)
+	assert.NoError(err)
+	data, err := codec.Encode(pairs[0])
+	assert.NoError(err)
+	assert.Equal("hello", data)
+	got := &store.KVPair{}
+	assert.NoError(codec.Decode(data, got))
+	assert.Equal([]byte("hello"), got.Value)
+
+	// default codec
+	codec, err = NewCodec("")
+	assert.NoError(err)
+	assert.Equal(CodecJSON, codec.Name())
+
+	_, err = NewCodec("gob")
+	assert.True(errors.Is(err, ErrUnknownCodec))
+
+	_, err = newRedis([]string{client}, &store.Config{Codec: "gob"})
+	assert.True(errors.Is(err, ErrUnknownCodec))
+}
+
+// go test -v -run TestMsgpackMalformed github.com/beyondyyh/libs/kvstore/store/redis
+func TestMsgpackMalformed(t *testing.T) {
+	assert := assert.New(t)
+
+	codec := MsgpackCodec{}
+	data, err := codec.Encode(&store.KVPair{Key: "testCodec", Value: []byte("hello"), LastIndex: 300})
+	assert.NoError(err)
+
+	for _, bad := range []string{"", "\x92", data[:len(data)-1], "\x93\xc3"} {
+		assert.Equal(ErrMalformedData, codec.Decode(bad, &store.KVPair{}), "%q", bad)
+	}
+
+	// lua cmsgpack encodes large numbers as float64
+	kv := &store.KVPair{}
+	assert.NoError(codec.Decode("\x93\xa1k\xc0\xcb\x41\x00\x00\x00\x00\x00\x00\x00", kv))
+	assert.Equal("k", kv.Key)
+	assert.Nil(kv.Value)
+	assert.Equal(uint64(1<<17), kv.LastIndex)
+
+	// the signed integers are sign-extended, a negative index is malformed
+	for _, bad := range []string{"\x93\xa1k\xc0\xff", "\x93\xa1k\xc0\xd0\xff", "\x93\xa1k\xc0\xd1\x80\x00",
+		"\x93\xa1k\xc0\xd3\xff\xff\xff\xff\xff\xff\xff\xfe", "\x93\xa1k\xc0\xcb\xbf\xf0\x00\x00\x00\x00\x00\x00"} {
+		assert.Equal(ErrMalformedData, codec.Decode(bad, &store.KVPair{}), "%q", bad)
+	}
+	assert.NoError(codec.Decode("\x93\xa1k\xc0\xd1\x01\x00", kv))
+	assert.Equal(uint64(256), kv.LastIndex)
+	assert.NoError(codec.Decode("\x93\xa1k\xc0\xd2\x7f\xff\xff\xff", kv))
+	assert.Equal(uint64(math.MaxInt32), kv.LastIndex)
+}
+
+// go test -v -run TestDecodeHash github.com/beyondyyh/libs/kvstore/store/redis
+func TestDecodeHash(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &Redis{codec: RawCodec{}}
+	_, err := r.decodeHash(map[string]string{})
+	assert.Equal(store.ErrKeyNotFound, err)
+
+	kv, err := r.decodeHash(map[string]string{"value": "hello", "index": "42", "key": "testCodec"})
+	assert.NoError(err)
+	assert.Equal(&store.KVPair{Key: "testCodec", Value: []byte("hello"), LastIndex: 42}, kv)
+
+	_, err = r.decodeHash(map[string]string{"value": "hello", "index": "x"})
+	assert.Equal(ErrMalformedData, err)
+}
+
+// go test -v -run TestCodecIndexPlaceholder github.com/beyondyyh/libs/kvstore/store/redis
+func TestCodecIndexPlaceholder(t *testing.T) {
+	assert := assert.New(t)
+
+	// the lua script replaces the encoded LastIndex 0 with the new index, see withIndex in lua.go
+	kv := &store.KVPair{Key: "testCodec", Value: []byte("hello")}
+	data, err := JSONCodec{}.Encode(kv)
+	assert.NoError(err)
+	assert.True(strings.HasSuffix(data, `"LastIndex":0}`), data)
+
+	data, err = MsgpackCodec{}.Encode(kv)
+	assert.NoError(err)
+	assert.Equal(byte(0x00), data[len(data)-1])
+}
+
+// upperCodec is a codec of the caller, its data can't be read by the lua script
+type upperCodec struct{}
+
+func (c upperCodec) Name() string {
+	return "upper"
+}
+
+func (c upperCodec) Encode(kv *store.KVPair) (string, error) {
+	return strings.ToUpper(hex.EncodeToString(kv.Value)), nil
+}
+
+func (c upperCodec) Decode(data string, kv *store.KVPair) error {
+	value, err := hex.DecodeString(strings.ToLower(data))
+	if err != nil {
+		return ErrMalformedData
+	}
+	kv.Value = value
+	return nil
+}
+
+// go test -v -run TestCodecLayout github.com/beyondyyh/libs/kvstore/store/redis
+func TestCodecLayout(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(layoutJSON, layout(JSONCodec{}))
+	assert.Equal(layoutMsgpack, layout(MsgpackCodec{}))
+	assert.Equal(layoutHash, layout(RawCodec{}))
+	// the layout does not depend on the name
+	assert.Equal(layoutHash, layout(upperCodec{}))
+}
+
+// go test -v -run TestRedisCustomCodec github.com/beyondyyh/libs/kvstore/store/redis
+func TestRedisCustomCodec(t *testing.T) {
+	assert := assert.New(t)
+	kv, err := newRedis([]string{client}, &store.Config{Codec: "gob", CustomCodec: upperCodec{}})
+	assert.NoError(err)
+	defer testutils.RunCleanup(t, kv)
+
+	testutils.RunTestCommon(t, kv)
+	testutils.RunTestAtomic(t, kv)
+	testutils.RunTestTxn(t, kv)
+	testutils.RunTestBatch(t, kv)
+
+	// the value field holds the data of the codec
+	assert.NoError(kv.Put("testCustomCodec", []byte("hello"), nil))
+	data, err := kv.client.HGet(context.Background(), normalize("testCustomCodec"), hashFieldValue).Result()
+	assert.NoError(err)
+	assert.Equal("68656C6C6F", data)
+	assert.NoError(kv.Delete("testCustomCodec"))
+}
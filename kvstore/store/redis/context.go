@@ -0,0 +1,81 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// redisContext implements store.ContextStore, every redis call
+// is issued with the ctx of the caller
+type redisContext struct {
+	*Redis
+}
+
+// ContextStore returns the context-aware variant of the store
+func (r *Redis) ContextStore() store.ContextStore {
+	return redisContext{r}
+}
+
+// Put a value at the specified key
+func (c redisContext) Put(ctx context.Context, key string, value []byte, options *store.WriteOptions) error {
+	return c.put(ctx, key, value, options)
+}
+
+// Get a value given its key
+func (c redisContext) Get(ctx context.Context, key string) (*store.KVPair, error) {
+	return c.get(ctx, normalize(key))
+}
+
+// Delete the key at the specified key
+func (c redisContext) Delete(ctx context.Context, key string) error {
+	return c.del(ctx, normalize(key))
+}
+
+// Verify if a key exists in the store
+func (c redisContext) Exists(ctx context.Context, key string) (bool, error) {
+	return c.exists(ctx, key)
+}
+
+// Watch for changes on a key until ctx is done
+func (c redisContext) Watch(ctx context.Context, key string) (<-chan *store.KVPair, error) {
+	watchCh, _, err := c.watch(ctx, key, ctx.Done())
+	return watchCh, err
+}
+
+// WatchTree watches for changes on child nodes under a given directory until ctx is done
+func (c redisContext) WatchTree(ctx context.Context, directory string) (<-chan []*store.KVPair, error) {
+	watchCh, _, err := c.watchTree(ctx, directory, ctx.Done())
+	return watchCh, err
+}
+
+// List the content of a given prefix
+func (c redisContext) List(ctx context.Context, directory string) ([]*store.KVPair, error) {
+	return c.list(ctx, normalize(directory))
+}
+
+// DeleteTree deletes a range keys under a given directory
+func (c redisContext) DeleteTree(ctx context.Context, directory string) error {
+	_, err := c.deleteTree(ctx, directory, nil)
+	return err
+}
+
+// AtomicPut is a CAS operation on a single value
+func (c redisContext) AtomicPut(ctx context.Context, key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	return c.atomicPut(ctx, key, value, previous, options)
+}
+
+// AtomicDelete deletes a single value only if it's not modified since previous
+func (c redisContext) AtomicDelete(ctx context.Context, key string, previous *store.KVPair) (bool, error) {
+	return c.atomicDelete(ctx, key, previous)
+}
+
+// Txn applies ops atomically with the lua script
+func (c redisContext) Txn(ctx context.Context, ops []*store.TxnOp) ([]*store.KVPair, error) {
+	return c.txn(ctx, ops)
+}
+
+// NewLock creates a lock for a given key, no redis call is issued
+func (c redisContext) NewLock(ctx context.Context, key string, options *store.LockOptions) (store.Locker, error) {
+	return c.Redis.NewLock(key, options)
+}
@@ -0,0 +1,62 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// releaseTimeout bounds the deletion of an ephemeral key on Close
+const releaseTimeout = 5 * time.Second
+
+// ErrClosed is thrown when an ephemeral key is put after Close
+var ErrClosed = errors.New("redis: store closed")
+
+// putEphemeral writes the key with ttl, defaultLockTTL if not positive, and refreshes the ttl
+// every store.RenewInterval(ttl) until Close, or until the key is modified or deleted by someone else
+func (r *Redis) putEphemeral(ctx context.Context, key string, value []byte, ttl time.Duration) (*store.KVPair, error) {
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+
+	r.closeMu.Lock()
+	defer r.closeMu.Unlock()
+	if r.closed {
+		return nil, ErrClosed
+	}
+
+	val := &store.KVPair{Key: key, Value: value}
+	if err := r.setTTL(ctx, key, val, ttl); err != nil {
+		return nil, err
+	}
+	r.wg.Add(1)
+	go r.keepAlive(normalize(key), val.LastIndex, ttl)
+	return val, nil
+}
+
+// keepAlive refreshes the ttl of key while it's at index,
+// the key is deleted on Close instead of waiting for its expiration
+func (r *Redis) keepAlive(key string, index uint64, ttl time.Duration) {
+	defer r.wg.Done()
+
+	heartbeat := time.NewTicker(store.RenewInterval(ttl))
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+			r.eval(ctx, key, "cad", index)
+			cancel()
+			return
+		case <-heartbeat.C:
+			err := r.renew(context.Background(), key, index, ttl)
+			// 其它错误继续重试，直到key过期
+			if err == store.ErrKeyNotFound || err == store.ErrKeyModified {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// lockRetryInterval is how long we wait before retrying to acquire a held lock
+const lockRetryInterval = 500 * time.Millisecond
+
+// redisLock implements store.Locker with SET NX PX,
+// the ttl is renewed periodically while the lock is held
+// and the lock is released by a lua script only if we still own it
+type redisLock struct {
+	mu    sync.Mutex
+	redis *Redis
+	key   string
+	value []byte
+	ttl   time.Duration
+
+	last     *store.KVPair
+	unlockCh chan struct{}
+}
+
+// NewLock creates a lock for a given key
+func (r *Redis) NewLock(key string, options *store.LockOptions) (store.Locker, error) {
+	ttl := defaultLockTTL
+	var value []byte
+	if options != nil {
+		if options.TTL > 0 {
+			ttl = options.TTL
+		}
+		value = options.Value
+	}
+
+	return &redisLock{
+		redis: r,
+		key:   key,
+		value: value,
+		ttl:   ttl,
+	}, nil
+}
+
+// Lock attempts to acquire the lock and blocks while doing so,
+// the returned channel is closed if the lock is lost or released
+func (l *redisLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	l.mu.Lock()
+	held := l.last != nil
+	l.mu.Unlock()
+	if held {
+		return nil, store.ErrCannotLock
+	}
+
+	retry := time.NewTicker(lockRetryInterval)
+	defer retry.Stop()
+
+	for {
+		pair := &store.KVPair{
+			Key:   l.key,
+			Value: l.value,
+		}
+		err := l.redis.setNX(context.Background(), normalize(l.key), pair, l.ttl)
+		if err == nil {
+			return l.hold(pair), nil
+		}
+		if err != store.ErrKeyExists {
+			return nil, err
+		}
+
+		select {
+		case <-stopCh:
+			return nil, nil
+		case <-retry.C:
+		}
+	}
+}
+
+// hold records the acquired lock and starts renewing its ttl
+func (l *redisLock) hold(pair *store.KVPair) <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.last = pair
+	l.unlockCh = make(chan struct{})
+	lostCh := make(chan struct{})
+	go l.renewLoop(pair, lostCh, l.unlockCh)
+	return lostCh
+}
+
+// renewLoop refreshes the ttl of the lock until it's released or lost, or the store is closed
+func (l *redisLock) renewLoop(pair *store.KVPair, lostCh, unlockCh chan struct{}) {
+	defer close(lostCh)
+
+	heartbeat := time.NewTicker(store.RenewInterval(l.ttl))
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-unlockCh:
+			return
+		case <-l.redis.done:
+			return
+		case <-heartbeat.C:
+			err := l.redis.renew(context.Background(), normalize(l.key), pair.LastIndex, l.ttl)
+			// 其它错误继续重试，直到锁过期
+			if err == store.ErrKeyNotFound || err == store.ErrKeyModified {
+				return
+			}
+		}
+	}
+}
+
+// Unlock releases the lock, the key is deleted only if we still own it
+func (l *redisLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.last == nil {
+		return store.ErrLockNotHeld
+	}
+	pair := l.last
+	close(l.unlockCh)
+	l.last, l.unlockCh = nil, nil
+
+	if _, err := l.redis.AtomicDelete(l.key, pair); err != nil {
+		if err == store.ErrKeyNotFound || err == store.ErrKeyModified {
+			return store.ErrLockNotHeld
+		}
+		return err
+	}
+	return nil
+}
+
+// renew resets the ttl of key if it's not modified since index
+func (r *Redis) renew(ctx context.Context, key string, index uint64, ttl time.Duration) error {
+	_, err := r.eval(ctx, key, "renew", index, formatMs(ttl))
+	return err
+}
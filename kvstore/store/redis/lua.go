@@ -4,6 +4,221 @@ func luaScript() string {
 	return luaScriptStr
 }
 
+// luaScriptStr dispatches on ARGV[1], ARGV[2] is the layout of the data, see Codec and KEYS[1] is the normalized key
+//
+//	set:   ARGV[3] data encoded with LastIndex 0, ARGV[4] KVPair.Key, ARGV[5] ttl in milliseconds
+//	setnx: same as set, the key is written only if it does not exist
+//	cas:   same as set, ARGV[6] previous LastIndex
+//	cad:   ARGV[3] previous LastIndex
+//	renew: ARGV[3] previous LastIndex, ARGV[4] ttl in milliseconds
+//	deltree: no KEYS, ARGV[3] SCAN pattern, ARGV[4] SCAN cursor, ARGV[5] SCAN count,
+//	         ARGV[6] the keys whose LastIndex is greater are kept, 0 to delete all.
+//	         Returns {next cursor, number of deleted keys}, it runs on a single node
+//	txn:   KEYS are the keys of the operations, every operation has 4 ARGV from ARGV[3]:
+//	       put, data encoded with LastIndex 0, KVPair.Key, ttl in milliseconds
+//	       del, unused, unused, unused
+//	       check, expected LastIndex or 0 if the key must not exist, unused, unused
+//	       The checks run before the writes. Returns {1, new LastIndex of every operation, 0 if not a put}
+//	       or {error, position of the failed check}
+//
+// The writes return the new LastIndex of the key, the other commands return 1 on success.
+// Errors are 0 if the key is modified, -1 if the key does not exist, -2 if the key exists.
+//
+// LastIndex is a per-key revision: it's increased by every write, and a new key starts
+// from the server time in microseconds so that a deleted then recreated key never reuses
+// an index of its previous life.
 const luaScriptStr = `
+-- TIME is not deterministic, replicate the effects instead of the script (redis < 5)
+pcall(redis.replicate_commands)
 
+local layout = ARGV[2]
+
+-- index returns the LastIndex stored at key, nil if the key does not exist
+local function index(key)
+	if layout == 'hash' then
+		local idx = redis.call('HGET', key, 'index')
+		if not idx then
+			return nil
+		end
+		return tonumber(idx)
+	end
+
+	local val = redis.call('GET', key)
+	if not val then
+		return nil
+	end
+	if layout == 'msgpack' then
+		return cmsgpack.unpack(val)[3]
+	end
+	return cjson.decode(val)['LastIndex']
+end
+
+-- nextIndex returns the revision following cur
+local function nextIndex(cur)
+	local t = redis.call('TIME')
+	local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+	if cur and cur >= now then
+		return cur + 1
+	end
+	return now
+end
+
+-- withIndex replaces the LastIndex 0 encoded by the client with idx
+local function withIndex(data, idx)
+	if layout == 'msgpack' then
+		-- the trailing 0x00 is the positive fixint 0
+		return string.sub(data, 1, -2) .. cmsgpack.pack(idx)
+	end
+	local suffix = '"LastIndex":0}'
+	if string.sub(data, -string.len(suffix)) ~= suffix then
+		return redis.error_reply('unexpected json encoding')
+	end
+	return string.sub(data, 1, -3) .. string.format('%d', idx) .. '}'
+end
+
+-- write stores data at key and returns its new index,
+-- data is the value field for the hash layout
+local function write(key, data, pairKey, ttl)
+	local idx = nextIndex(index(key))
+	if layout == 'hash' then
+		redis.call('HSET', key, 'value', data, 'index', string.format('%d', idx), 'key', pairKey)
+		if tonumber(ttl) > 0 then
+			redis.call('PEXPIRE', key, ttl)
+		else
+			redis.call('PERSIST', key)
+		end
+		return idx
+	end
+
+	data = withIndex(data, idx)
+	if type(data) == 'table' then
+		return data
+	end
+	if tonumber(ttl) > 0 then
+		redis.call('SET', key, data, 'PX', ttl)
+	else
+		redis.call('SET', key, data)
+	end
+	return idx
+end
+
+local function set(key)
+	return write(key, ARGV[3], ARGV[4], ARGV[5])
+end
+
+local function setnx(key)
+	if redis.call('EXISTS', key) == 1 then
+		return -2
+	end
+	return set(key)
+end
+
+local function cas(key, prev)
+	local cur = index(key)
+	if not cur then
+		return -1
+	end
+	if cur ~= tonumber(prev) then
+		return 0
+	end
+	return set(key)
+end
+
+local function cad(key, prev)
+	local cur = index(key)
+	if not cur then
+		return -1
+	end
+	if cur ~= tonumber(prev) then
+		return 0
+	end
+	redis.call('DEL', key)
+	return 1
+end
+
+local function renew(key, prev, ttl)
+	local cur = index(key)
+	if not cur then
+		return -1
+	end
+	if cur ~= tonumber(prev) then
+		return 0
+	end
+	redis.call('PEXPIRE', key, ttl)
+	return 1
+end
+
+-- deltree deletes a batch of the keys matching pattern atomically, the whole tree
+-- is not: the caller runs it once per SCAN cursor. The keys which are not
+-- written by the backend (e.g. wrong type or undecodable) are deleted as well
+local function deltree(pattern, cursor, count, maxIndex)
+	local res = redis.call('SCAN', cursor, 'MATCH', pattern, 'COUNT', count)
+	local deleted = 0
+	maxIndex = tonumber(maxIndex)
+	for _, key in ipairs(res[2]) do
+		local keep = false
+		if maxIndex > 0 then
+			local ok, cur = pcall(index, key)
+			keep = ok and type(cur) == 'number' and cur > maxIndex
+		end
+		if not keep then
+			deleted = deleted + redis.call('DEL', key)
+		end
+	end
+	return {res[1], deleted}
+end
+
+-- txn checks every key first so that nothing is written if a check fails
+local function txn()
+	for i, key in ipairs(KEYS) do
+		local arg = 3 + (i - 1) * 4
+		if ARGV[arg] == 'check' then
+			local expected = tonumber(ARGV[arg + 1])
+			local cur = index(key)
+			if expected == 0 then
+				if cur then
+					return {-2, i - 1}
+				end
+			elseif not cur then
+				return {-1, i - 1}
+			elseif cur ~= expected then
+				return {0, i - 1}
+			end
+		end
+	end
+
+	local res = {1}
+	for i, key in ipairs(KEYS) do
+		local arg = 3 + (i - 1) * 4
+		local idx = 0
+		if ARGV[arg] == 'put' then
+			idx = write(key, ARGV[arg + 1], ARGV[arg + 2], ARGV[arg + 3])
+			if type(idx) == 'table' then
+				return idx
+			end
+		elseif ARGV[arg] == 'del' then
+			redis.call('DEL', key)
+		end
+		res[i + 1] = idx
+	end
+	return res
+end
+
+local cmd = ARGV[1]
+if cmd == 'set' then
+	return set(KEYS[1])
+elseif cmd == 'setnx' then
+	return setnx(KEYS[1])
+elseif cmd == 'cas' then
+	return cas(KEYS[1], ARGV[6])
+elseif cmd == 'cad' then
+	return cad(KEYS[1], ARGV[3])
+elseif cmd == 'renew' then
+	return renew(KEYS[1], ARGV[3], ARGV[4])
+elseif cmd == 'deltree' then
+	return deltree(ARGV[3], ARGV[4], ARGV[5], ARGV[6])
+elseif cmd == 'txn' then
+	return txn()
+end
+return redis.error_reply('unknown command ' .. tostring(cmd))
 `
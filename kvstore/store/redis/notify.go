@@ -0,0 +1,146 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// notifyCheckTimeout bounds the check of the keyspace notifications by newRedis
+	notifyCheckTimeout = 5 * time.Second
+
+	// defaultPollInterval is how often the watches poll in polling mode
+	// if store.Config.ResyncInterval is not set
+	defaultPollInterval = time.Second
+
+	// notifyFlags are the classes of notify-keyspace-events needed by the watches
+	// 默认情况下，Redis 并不会开启Keyspace Notification，我们可以通过修改redis.conf的 notify-keyspace-events 参数
+	// 或者使用CONFIG SET命令来开启该功能，设置参数如下：
+	// K     Keyspace events, published with __keyspace@<db>__ prefix.
+	// E     Keyevent events, published with __keyevent@<db>__ prefix.
+	// g     Generic commands (non-type specific) like DEL, EXPIRE, RENAME, ...
+	// $     String commands
+	// l     List commands
+	// s     Set commands
+	// h     Hash commands
+	// z     Sorted set commands
+	// x     Expired events (events generated every time a key expires)
+	// e     Evicted events (events generated when a key is evicted for maxmemory)
+	// A     Alias for g$lshzxe, so that the "AKE" string means all the events.
+	notifyFlags = "Kg$hxe"
+	// notifyAliasFlags are the classes included by A
+	notifyAliasFlags = "g$lshzxe"
+)
+
+// ErrNotificationsUnavailable is thrown by Watch and WatchTree when the keyspace
+// notifications are disabled and can't be enabled, unless store.Config.PollingFallback is set.
+// The actual error is a *NotificationsError
+var ErrNotificationsUnavailable = errors.New("redis: keyspace notifications unavailable")
+
+// NotificationsError describes why the keyspace notifications of a node are unavailable
+type NotificationsError struct {
+	Addr  string // address of the node
+	Flags string // current notify-keyspace-events of the node
+	Err   error  // error of CONFIG SET, e.g. the command is disabled by a managed redis
+}
+
+func (e *NotificationsError) Error() string {
+	return fmt.Sprintf("%v: node %s has notify-keyspace-events %q: %v", ErrNotificationsUnavailable, e.Addr, e.Flags, e.Err)
+}
+
+func (e *NotificationsError) Unwrap() error {
+	return e.Err
+}
+
+func (e *NotificationsError) Is(target error) bool {
+	return target == ErrNotificationsUnavailable
+}
+
+// checkNotifications verifies that the keyspace notifications needed by the watches are enabled
+// on every node and enables them otherwise. The result is kept unless the nodes are unreachable
+func (r *Redis) checkNotifications(ctx context.Context) error {
+	r.notifyMu.Lock()
+	defer r.notifyMu.Unlock()
+
+	if r.notifyChecked {
+		return r.notifyErr
+	}
+
+	var (
+		mu        sync.Mutex
+		notifyErr error
+	)
+	err := r.forEachNode(ctx, func(ctx context.Context, client *redis.Client) error {
+		if err := enableNotifications(ctx, client); err != nil {
+			var nerr *NotificationsError
+			if !errors.As(err, &nerr) {
+				return err
+			}
+			mu.Lock()
+			notifyErr = err
+			mu.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.notifyChecked, r.notifyErr = true, notifyErr
+	return notifyErr
+}
+
+func enableNotifications(ctx context.Context, client *redis.Client) error {
+	res, err := client.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		if isNetworkError(err) {
+			return err
+		}
+		return &NotificationsError{Addr: client.Options().Addr, Err: err}
+	}
+
+	var flags string
+	if len(res) == 2 {
+		flags, _ = res[1].(string)
+	}
+	missing := missingFlags(flags)
+	if missing == "" {
+		return nil
+	}
+
+	if err := client.ConfigSet(ctx, "notify-keyspace-events", flags+missing).Err(); err != nil {
+		if isNetworkError(err) {
+			return err
+		}
+		return &NotificationsError{Addr: client.Options().Addr, Flags: flags, Err: err}
+	}
+	return nil
+}
+
+// missingFlags returns the classes of notifyFlags which are not enabled by flags
+func missingFlags(flags string) string {
+	var missing []byte
+	for i := 0; i < len(notifyFlags); i++ {
+		c := notifyFlags[i]
+		if strings.IndexByte(flags, c) >= 0 {
+			continue
+		}
+		if strings.IndexByte(flags, 'A') >= 0 && strings.IndexByte(notifyAliasFlags, c) >= 0 {
+			continue
+		}
+		missing = append(missing, c)
+	}
+	return string(missing)
+}
+
+// isNetworkError reports whether err is not an error reply of the server
+func isNetworkError(err error) bool {
+	var rerr redis.Error
+	return !errors.As(err, &rerr)
+}
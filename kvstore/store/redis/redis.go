@@ -2,11 +2,14 @@ package redis
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -16,32 +19,87 @@ import (
 )
 
 var (
-	ErrMultipleEndpointsUnsupported = errors.New("redis: does not support multiple endpoints")
-	ErrTLSUnsupported               = errors.New("redis: does not support tls")
+	ErrDBIndexUnsupported = errors.New("redis: cluster does not support selecting a database")
 )
 
 func Register() {
 	kvstore.AddStore(store.REDIS, New)
 }
 
+// New creates a redis store, the kind of client depends on the options:
+// - options.MasterName is set: a failover client through the sentinels given by endpoints
+// - multiple endpoints: a cluster client with endpoints as the seed nodes
+// - otherwise: a standalone client
+// options.TLS and options.Username (redis 6 ACL) are applied to every kind of client
 func New(endpoints []string, options *store.Config) (store.Store, error) {
-	var password string
-	if len(endpoints) > 1 {
-		return nil, ErrMultipleEndpointsUnsupported
-	}
-	if options != nil && options.TLS != nil {
-		return nil, ErrTLSUnsupported
-	}
-	if options != nil && options.Password != "" {
-		password = options.Password
-	}
+	return newRedis(endpoints, options)
+}
+
+// newClient creates the redis client according to endpoints and options
+func newClient(endpoints []string, options *store.Config) (redis.UniversalClient, error) {
+	const (
+		readTimeout  = 30 * time.Second
+		writeTimeout = 30 * time.Second
+	)
 
-	dbIndex := 0
+	var (
+		username    string
+		password    string
+		masterName  string
+		dbIndex     int
+		tlsConfig   *tls.Config
+		dialTimeout = 5 * time.Second
+	)
 	if options != nil {
+		username = options.Username
+		password = options.Password
+		masterName = options.MasterName
 		dbIndex, _ = strconv.Atoi(options.Bucket)
+		tlsConfig = options.TLS
+		if options.ConnectionTimeout != 0 {
+			dialTimeout = options.ConnectionTimeout
+		}
+	}
+
+	if masterName != "" {
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    masterName,
+			SentinelAddrs: endpoints,
+			DialTimeout:   dialTimeout,
+			ReadTimeout:   readTimeout,
+			WriteTimeout:  writeTimeout,
+			Username:      username,
+			Password:      password,
+			TLSConfig:     tlsConfig,
+			DB:            dbIndex,
+		}), nil
+	}
+
+	if len(endpoints) > 1 {
+		if dbIndex != 0 {
+			return nil, ErrDBIndexUnsupported
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        endpoints,
+			DialTimeout:  dialTimeout,
+			ReadTimeout:  readTimeout,
+			WriteTimeout: writeTimeout,
+			Username:     username,
+			Password:     password,
+			TLSConfig:    tlsConfig,
+		}), nil
 	}
 
-	return newRedis(endpoints, password, dbIndex)
+	return redis.NewClient(&redis.Options{
+		Addr:         endpoints[0],
+		DialTimeout:  dialTimeout,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		Username:     username,
+		Password:     password,
+		TLSConfig:    tlsConfig,
+		DB:           dbIndex,
+	}), nil
 }
 
 // newRedis new redis client
@@ -52,366 +110,718 @@ func New(endpoints []string, options *store.Config) (store.Store, error) {
 // 1. 类似审计或者监控的场景.
 // 2. 通过expire来实现不可靠的定时器.
 // 3. 借助expire来实现不可靠的注册发现.
-func newRedis(endpoints []string, password string, dbIndex int) (*Redis, error) {
-	// TODO: use *redis.ClusterClient
-	client := redis.NewClient(&redis.Options{
-		Addr:         endpoints[0],
-		DialTimeout:  5 * time.Second,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		Password:     password,
-		DB:           dbIndex,
-	})
-
-	// Listen to Keyspace envents
-	// 默认情况下，Redis 并不会开启Keyspace Notification，我们可以通过修改redis.conf的 notify-keyspace-events 参数
-	// 或者使用CONFIG SET命令来开启该功能，设置参数如下：
-	// K     Keyspace events, published with __keyspace@<db>__ prefix.
-	// E     Keyevent events, published with __keyevent@<db>__ prefix.
-	// g     Generic commands (non-type specific) like DEL, EXPIRE, RENAME, ... String commands
-	// l     List commands
-	// s     Set commands
-	// h     Hash commands
-	// z     Sorted set commands
-	// x     Expired events (events generated every time a key expires)
-	// e     Evicted events (events generated when a key is evicted for maxmemory)
-	// A     Alias for glshzxe, so that the "AKE" string means all the events.
-	client.ConfigSet(context.Background(), "nofity-keyspace-envents", "KEA")
+func newRedis(endpoints []string, options *store.Config) (*Redis, error) {
+	var (
+		codecName       string
+		customCodec     Codec
+		pollingFallback bool
+	)
+	scanCount := defaultScanCount
+	resyncInterval := defaultResyncInterval
+	pollInterval := defaultPollInterval
+	if options != nil {
+		codecName = options.Codec
+		customCodec = options.CustomCodec
+		pollingFallback = options.PollingFallback
+		if options.ScanCount > 0 {
+			scanCount = options.ScanCount
+		}
+		if options.ResyncInterval > 0 {
+			resyncInterval = options.ResyncInterval
+			pollInterval = options.ResyncInterval
+		}
+	}
+	codec := customCodec
+	if codec == nil {
+		var err error
+		if codec, err = NewCodec(codecName); err != nil {
+			return nil, err
+		}
+	}
 
-	return &Redis{
-		client: client,
-		script: redis.NewScript(luaScript()),
-		codec:  defaultCodec{},
-	}, nil
-}
+	client, err := newClient(endpoints, options)
+	if err != nil {
+		return nil, err
+	}
 
-type defaultCodec struct{}
+	r := &Redis{
+		client:          client,
+		script:          redis.NewScript(luaScript()),
+		codec:           codec,
+		layout:          layout(codec),
+		scanCount:       int64(scanCount),
+		resyncInterval:  resyncInterval,
+		pollInterval:    pollInterval,
+		pollingFallback: pollingFallback,
+		done:            make(chan struct{}),
+	}
 
-func (c defaultCodec) encode(kv *store.KVPair) (string, error) {
-	b, err := json.Marshal(kv)
-	return string(b), err
-}
+	// Listen to Keyspace envents, the check is retried by the first watch if the server is unreachable
+	ctx, cancel := context.WithTimeout(context.Background(), notifyCheckTimeout)
+	defer cancel()
+	r.checkNotifications(ctx)
 
-func (c defaultCodec) decode(b string, kv *store.KVPair) error {
-	return json.Unmarshal([]byte(b), kv)
+	return r, nil
 }
 
 // Redis implements store.Store interface with redis backend
 type Redis struct {
-	client *redis.Client
+	client redis.UniversalClient
 	script *redis.Script
-	codec  defaultCodec
+	codec  Codec
+	layout string // see Codec
+
+	scanCount      int64
+	resyncInterval time.Duration
+
+	// keyspace notifications, see notify.go
+	notifyMu        sync.Mutex
+	notifyChecked   bool
+	notifyErr       error
+	pollingFallback bool
+	pollInterval    time.Duration
+
+	// ephemeral keys, see ephemeral.go
+	closeMu sync.Mutex
+	closed  bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// forEachNode calls fn on every master of a cluster concurrently,
+// or once on the client itself otherwise.
+// 集群模式下 keyspace notifications 和 SCAN 都只作用于单个节点
+func (r *Redis) forEachNode(ctx context.Context, fn func(ctx context.Context, client *redis.Client) error) error {
+	switch client := r.client.(type) {
+	case *redis.ClusterClient:
+		return client.ForEachMaster(ctx, fn)
+	case *redis.Client:
+		return fn(ctx, client)
+	}
+	return fmt.Errorf("redis: unsupported client %T", r.client)
+}
+
+// isCluster reports whether keys may spread over several nodes,
+// multi-key commands like MGET/DEL fail with CROSSSLOT in that case
+func (r *Redis) isCluster() bool {
+	_, ok := r.client.(*redis.ClusterClient)
+	return ok
 }
 
 const (
 	noExpiration   = time.Duration(0)
 	defaultLockTTL = 60 * time.Second
+
+	// defaultScanCount is the COUNT hint of SCAN if store.Config.ScanCount is not set
+	defaultScanCount = 1000
+	// mgetChunkSize bounds the number of keys read by a single MGET
+	mgetChunkSize = 500
 )
 
 // Put a value at the specified key
 func (r *Redis) Put(key string, value []byte, options *store.WriteOptions) error {
+	return r.put(context.Background(), key, value, options)
+}
+
+func (r *Redis) put(ctx context.Context, key string, value []byte, options *store.WriteOptions) error {
 	expirationAfter := noExpiration
 	if options != nil && options.TTL != 0 {
 		expirationAfter = options.TTL
 	}
+	if options != nil && options.Ephemeral {
+		_, err := r.putEphemeral(ctx, key, value, expirationAfter)
+		return err
+	}
 
-	return r.setTTL(key, &store.KVPair{
-		Key:       key,
-		Value:     value,
-		LastIndex: sequenceNum(),
+	return r.setTTL(ctx, key, &store.KVPair{
+		Key:   key,
+		Value: value,
 	}, expirationAfter)
 }
 
-func (r *Redis) setTTL(key string, val *store.KVPair, ttl time.Duration) error {
-	valstr, err := r.codec.encode(val)
+func (r *Redis) setTTL(ctx context.Context, key string, val *store.KVPair, ttl time.Duration) error {
+	return r.write(ctx, "set", normalize(key), val, ttl)
+}
+
+// write stores val at key through the lua script so that every codec
+// is written the same way, extra args are appended after the ttl.
+// val.LastIndex is set to the new index of the key computed by the script
+func (r *Redis) write(ctx context.Context, cmd, key string, val *store.KVPair, ttl time.Duration, extra ...interface{}) error {
+	// the script fills in the index
+	val.LastIndex = 0
+	data, err := r.codec.Encode(val)
 	if err != nil {
 		return err
 	}
 
-	return r.client.Set(context.Background(), normalize(key), valstr, ttl).Err()
+	args := append([]interface{}{data, val.Key, formatMs(ttl)}, extra...)
+	index, err := r.eval(ctx, key, cmd, args...)
+	if err != nil {
+		return err
+	}
+	val.LastIndex = uint64(index)
+	return nil
+}
+
+// eval runs cmd of the lua script on key, see lua.go for the args of every cmd
+func (r *Redis) eval(ctx context.Context, key, cmd string, args ...interface{}) (int64, error) {
+	args = append([]interface{}{cmd, r.layout}, args...)
+	res, err := r.script.Run(ctx, r.client, []string{key}, args...).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return res, scriptResult(res)
 }
 
 // Get a value given its key
 func (r *Redis) Get(key string) (*store.KVPair, error) {
-	return r.get(normalize(key))
+	return r.get(context.Background(), normalize(key))
 }
 
-func (r *Redis) get(key string) (*store.KVPair, error) {
-	reply, err := r.client.Get(context.Background(), key).Bytes()
+func (r *Redis) get(ctx context.Context, key string) (*store.KVPair, error) {
+	if r.layout == layoutHash {
+		fields, err := r.client.HGetAll(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		return r.decodeHash(fields)
+	}
+
+	reply, err := r.client.Get(ctx, key).Result()
 	if err != nil {
 		if err == redis.Nil {
 			return nil, store.ErrKeyNotFound
 		}
 		return nil, err
 	}
+	return r.decode(reply)
+}
+
+func (r *Redis) decode(data string) (*store.KVPair, error) {
+	val := &store.KVPair{}
+	if err := r.codec.Decode(data, val); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
 
-	val := store.KVPair{}
-	if err := r.codec.decode(string(reply), &val); err != nil {
+// decodeHash decodes the fields of a hash written with CodecRaw or a custom codec,
+// an empty hash means the key does not exist
+func (r *Redis) decodeHash(fields map[string]string) (*store.KVPair, error) {
+	if len(fields) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+
+	val, err := r.decode(fields[hashFieldValue])
+	if err != nil {
 		return nil, err
 	}
-	return &val, nil
+	val.Key = fields[hashFieldKey]
+	if val.LastIndex, err = strconv.ParseUint(fields[hashFieldIndex], 10, 64); err != nil {
+		return nil, ErrMalformedData
+	}
+	return val, nil
 }
 
 // Delete the key at the specified key
 func (r *Redis) Delete(key string) error {
-	return r.client.Del(context.Background(), normalize(key)).Err()
+	return r.del(context.Background(), normalize(key))
 }
 
 // Verify if a key exists in the store
 func (r *Redis) Exists(key string) (bool, error) {
-	i, err := r.client.Exists(context.Background(), normalize(key)).Result()
+	return r.exists(context.Background(), key)
+}
+
+func (r *Redis) exists(ctx context.Context, key string) (bool, error) {
+	i, err := r.client.Exists(ctx, normalize(key)).Result()
 	if err != nil {
 		return false, err
 	}
 	return i == 1, nil
 }
 
-type getter func() (interface{}, error)
-
-type pusher func(interface{})
+// List the content of a given prefix
+func (r *Redis) List(directory string) ([]*store.KVPair, error) {
+	return r.list(context.Background(), normalize(directory))
+}
 
-// Watch for changes on a key
-// glitch: 使用 notify-then-retrieve 来检索*store.KVPair，有时响应可能不及时
-func (r *Redis) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
-	watchCh := make(chan *store.KVPair)
-	nKey := normalize(key)
+func (r *Redis) list(ctx context.Context, directory string) ([]*store.KVPair, error) {
+	var allKeys []string
+	regex := scanRegex(directory) // for all keys with $directory
+	allKeys, err := r.keys(ctx, regex)
+	if err != nil {
+		return nil, err
+	}
+	// keys过多时使用 ListPage/store.ListStream 分页
+	return r.mget(ctx, directory, allKeys...)
+}
 
-	get := getter(func() (interface{}, error) {
-		pair, err := r.get(nKey)
+// keys 利用redis scan把所有命令查出，集群模式下需要扫描每个master节点
+func (r *Redis) keys(ctx context.Context, regex string) ([]string, error) {
+	var (
+		mu      sync.Mutex
+		allKeys []string
+	)
+	err := r.forEachNode(ctx, func(ctx context.Context, client *redis.Client) error {
+		keys, err := scanKeys(ctx, client, regex, r.scanCount)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		return pair, err
+		mu.Lock()
+		allKeys = append(allKeys, keys...)
+		mu.Unlock()
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	if len(allKeys) == 0 {
+		return nil, store.ErrKeyNotFound
+	}
+	return allKeys, nil
+}
 
-	push := pusher(func(v interface{}) {
-		if val, ok := v.(*store.KVPair); ok {
-			watchCh <- val
+// scanKeys scans all the keys matching regex on a single node
+func scanKeys(ctx context.Context, client *redis.Client, regex string, count int64) ([]string, error) {
+	const (
+		startCursor = 0
+		endCursor   = 0
+	)
+
+	var allKeys []string
+
+	keys, nextCursor, err := client.Scan(ctx, startCursor, regex, count).Result()
+	if err != nil {
+		return nil, err
+	}
+	allKeys = append(allKeys, keys...)
+	for nextCursor != endCursor {
+		keys, nextCursor, err = client.Scan(ctx, nextCursor, regex, count).Result()
+		if err != nil {
+			return nil, err
 		}
-	})
+		allKeys = append(allKeys, keys...)
+	}
+	return allKeys, nil
+}
 
-	sub, err := newSubscribe(r.client, regexWatch(nKey, false))
+// mget values from given keys
+func (r *Redis) mget(ctx context.Context, direcroty string, keys ...string) ([]*store.KVPair, error) {
+	replies, err := r.getMulti(ctx, keys...)
 	if err != nil {
 		return nil, err
 	}
 
-	go func(sub *subscribe, shopCh <-chan struct{}, get getter, push pusher) {
-		defer sub.Close()
+	pairs := []*store.KVPair{}
+	for _, kv := range replies {
+		// the key is gone since it's scanned
+		if kv == nil {
+			continue
+		}
+		if normalize(kv.Key) != direcroty {
+			pairs = append(pairs, kv)
+		}
+	}
+	return pairs, nil
+}
+
+// getMulti returns the values of keys like MGET, missing keys are nil.
+// 集群模式以及hash layout下使用pipeline逐个读取，避免CROSSSLOT错误
+func (r *Redis) getMulti(ctx context.Context, keys ...string) ([]*store.KVPair, error) {
+	if r.layout == layoutHash {
+		return r.getMultiHash(ctx, keys...)
+	}
 
-		msgCh := sub.Receive(stopCh)
-		if err := watchLoop(msgCh, stopCh, get, push); err != nil {
-			log.Printf("watchLoop in Watch err:%v\n", err)
+	replies := make([]interface{}, len(keys))
+	if !r.isCluster() {
+		// 分批MGET，避免单个命令阻塞redis过久
+		for start := 0; start < len(keys); start += mgetChunkSize {
+			end := start + mgetChunkSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			chunk, err := r.client.MGet(ctx, keys[start:end]...).Result()
+			if err != nil {
+				return nil, err
+			}
+			copy(replies[start:], chunk)
 		}
-	}(sub, stopCh, get, push)
+	} else {
+		pipe := r.client.Pipeline()
+		cmds := make([]*redis.StringCmd, len(keys))
+		for i, key := range keys {
+			cmds[i] = pipe.Get(ctx, key)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, err
+		}
+		for i, cmd := range cmds {
+			if val, err := cmd.Result(); err == nil {
+				replies[i] = val
+			}
+		}
+	}
 
-	return watchCh, nil
+	pairs := make([]*store.KVPair, len(keys))
+	for i, reply := range replies {
+		data, ok := reply.(string)
+		// empty reply
+		if !ok || data == "" {
+			continue
+		}
+		kv, err := r.decode(data)
+		if err != nil {
+			return nil, err
+		}
+		pairs[i] = kv
+	}
+	return pairs, nil
 }
 
-func regexWatch(key string, withChildren bool) string {
-	var regex string
-	if withChildren {
-		// keys with $key prefix
-		regex = fmt.Sprintf("__keyspace*:%s*", key)
-	} else {
-		// keys with $key
-		regex = fmt.Sprintf("__keyspace*:%s", key)
+// getMultiHash reads the hashes written with CodecRaw or a custom codec in a pipeline
+func (r *Redis) getMultiHash(ctx context.Context, keys ...string) ([]*store.KVPair, error) {
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HGetAll(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
 	}
-	return regex
+
+	pairs := make([]*store.KVPair, len(keys))
+	for i, cmd := range cmds {
+		kv, err := r.decodeHash(cmd.Val())
+		if err == store.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pairs[i] = kv
+	}
+	return pairs, nil
 }
 
-func watchLoop(msgCh chan *redis.Message, stopCh <-chan struct{}, get getter, push pusher) error {
-	// deliver the original data before we setup an events
-	pair, err := get()
+// ListPage returns about limit pairs under directory starting at cursor, see store.ListPager.
+// The cursor is made of the index of the node and its SCAN cursor, it's invalidated
+// by a change of the cluster topology
+func (r *Redis) ListPage(directory, cursor string, limit int) ([]*store.KVPair, string, error) {
+	return r.listPage(context.Background(), normalize(directory), cursor, limit)
+}
+
+func (r *Redis) listPage(ctx context.Context, directory, cursor string, limit int) ([]*store.KVPair, string, error) {
+	if limit <= 0 {
+		limit = store.DefaultPageLimit
+	}
+	node, scan, err := parseCursor(cursor)
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	nodes, err := r.nodes(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	if node >= len(nodes) {
+		return nil, "", store.ErrInvalidCursor
 	}
-	push(pair)
 
-	for m := range msgCh {
-		pair, err := get()
-		if err != nil && err != store.ErrKeyNotFound {
-			return err
+	var (
+		regex = scanRegex(directory)
+		keys  []string
+	)
+	for len(keys) < limit && node < len(nodes) {
+		count := int64(limit - len(keys))
+		if count > r.scanCount {
+			count = r.scanCount
 		}
-		// 查看已过期或删除的key时，返回空并且清空KV
-		if err == store.ErrKeyNotFound && (m.Payload == "expire" || m.Payload == "del") {
-			push(&store.KVPair{})
-		} else {
-			push(pair)
+		batch, next, err := nodes[node].Scan(ctx, scan, regex, count).Result()
+		if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, batch...)
+		if scan = next; scan == 0 {
+			node++
 		}
 	}
-	return nil
+
+	pairs := []*store.KVPair{}
+	if len(keys) > 0 {
+		if pairs, err = r.mget(ctx, directory, keys...); err != nil {
+			return nil, "", err
+		}
+	}
+	if node == len(nodes) {
+		return pairs, "", nil
+	}
+	return pairs, formatCursor(node, scan), nil
 }
 
-type subscribe struct {
-	pubsub  *redis.PubSub
-	closeCh chan struct{}
+// nodes returns the clients of every node sorted by address,
+// so that the cursors of ListPage are stable between the calls
+func (r *Redis) nodes(ctx context.Context) ([]*redis.Client, error) {
+	var (
+		mu    sync.Mutex
+		nodes []*redis.Client
+	)
+	err := r.forEachNode(ctx, func(ctx context.Context, client *redis.Client) error {
+		mu.Lock()
+		nodes = append(nodes, client)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Options().Addr < nodes[j].Options().Addr })
+	return nodes, nil
 }
 
-func newSubscribe(client *redis.Client, regex string) (*subscribe, error) {
-	ch := client.PSubscribe(context.Background(), regex)
-	return &subscribe{
-		pubsub:  ch,
-		closeCh: make(chan struct{}),
-	}, nil
+func formatCursor(node int, scan uint64) string {
+	return fmt.Sprintf("%d:%d", node, scan)
 }
 
-func (s *subscribe) Close() error {
-	close(s.closeCh)
-	return s.pubsub.Close()
+func parseCursor(cursor string) (int, uint64, error) {
+	if cursor == "" {
+		return 0, 0, nil
+	}
+	i := strings.IndexByte(cursor, ':')
+	if i < 0 {
+		return 0, 0, store.ErrInvalidCursor
+	}
+	node, err := strconv.Atoi(cursor[:i])
+	if err != nil || node < 0 {
+		return 0, 0, store.ErrInvalidCursor
+	}
+	scan, err := strconv.ParseUint(cursor[i+1:], 10, 64)
+	if err != nil {
+		return 0, 0, store.ErrInvalidCursor
+	}
+	return node, scan, nil
 }
 
-func (s *subscribe) Receive(stopCh <-chan struct{}) chan *redis.Message {
-	msgCh := make(chan *redis.Message)
-	go s.receiveLoop(msgCh, stopCh)
-	return msgCh
+// DeleteTree deletes a range keys under a given directory,
+// the keys are scanned and deleted in batches by a lua script on every node
+// so that no extra round trip is needed between the scan and the deletion.
+// It's atomic per batch only: a key written while the tree is deleted may be
+// kept or deleted, and the keys of the batches already deleted stay deleted on error
+func (r *Redis) DeleteTree(directory string) error {
+	_, err := r.deleteTree(context.Background(), directory, nil)
+	return err
 }
 
-func (s *subscribe) receiveLoop(msgCh chan *redis.Message, stopCh <-chan struct{}) {
-	defer close(msgCh)
+// DeleteTreeWithOptions deletes a range keys under a given directory and returns their number,
+// in batches, atomic per batch, see DeleteTree
+func (r *Redis) DeleteTreeWithOptions(directory string, options *store.DeleteTreeOptions) (int, error) {
+	return r.deleteTree(context.Background(), directory, options)
+}
 
-	for {
-		select {
-		case <-s.closeCh:
-			return
-		case <-stopCh:
-			return
-		default:
-			msg, err := s.pubsub.ReceiveMessage(context.Background())
+func (r *Redis) deleteTree(ctx context.Context, directory string, options *store.DeleteTreeOptions) (int, error) {
+	regex := scanRegex(normalize(directory)) // for all keys with $directory
+	deleted := int64(0)
+	err := r.forEachNode(ctx, func(ctx context.Context, client *redis.Client) error {
+		// LastIndex of the keys written from now on is greater than the server time, see lua.go
+		maxIndex := int64(0)
+		if options != nil && options.KeepNewer {
+			now, err := client.Time(ctx).Result()
+			if err != nil {
+				return err
+			}
+			maxIndex = now.UnixMicro()
+		}
+
+		cursor := "0"
+		for {
+			res, err := r.script.Run(ctx, client, nil,
+				"deltree", r.layout, regex, cursor, r.scanCount, maxIndex).Slice()
 			if err != nil {
-				return
+				return err
+			}
+			if len(res) != 2 {
+				return fmt.Errorf("redis: unexpected deltree result %v", res)
 			}
-			if msg != nil {
-				msgCh <- msg
+			cursor, _ = res[0].(string)
+			n, _ := res[1].(int64)
+			atomic.AddInt64(&deleted, n)
+			if cursor == "0" || cursor == "" {
+				return nil
 			}
 		}
-	}
+	})
+	return int(deleted), err
 }
 
-// WatchTree watches for changes on child nodes under a given directory
-func (r *Redis) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
-	watchCh := make(chan []*store.KVPair)
-	nKey := normalize(directory)
+// del deletes keys, one by one in a pipeline on a cluster
+func (r *Redis) del(ctx context.Context, keys ...string) error {
+	if !r.isCluster() {
+		return r.client.Del(ctx, keys...).Err()
+	}
 
-	get := getter(func() (interface{}, error) {
-		pair, err := r.list(nKey)
-		if err != nil {
-			return nil, err
-		}
-		return pair, nil
-	})
+	pipe := r.client.Pipeline()
+	for _, key := range keys {
+		pipe.Del(ctx, key)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
 
-	push := pusher(func(v interface{}) {
-		if _, ok := v.([]*store.KVPair); !ok {
-			return
-		}
-		watchCh <- v.([]*store.KVPair)
-	})
+// results of the lua script, the writes return the new index on success
+const (
+	scriptKeyExists   = -2
+	scriptKeyNotFound = -1
+	scriptKeyModified = 0
+	scriptOK          = 1
+)
 
-	sub, err := newSubscribe(r.client, regexWatch(nKey, true))
-	if err != nil {
-		return nil, err
+// AtomicPut is a CAS operation on a single value,
+// pass previous = nil to create a new key. The ephemeral keys are not supported
+func (r *Redis) AtomicPut(key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	return r.atomicPut(context.Background(), key, value, previous, options)
+}
+
+func (r *Redis) atomicPut(ctx context.Context, key string, value []byte, previous *store.KVPair, options *store.WriteOptions) (bool, *store.KVPair, error) {
+	if options != nil && options.Ephemeral {
+		return false, nil, store.ErrCallNotSupported
+	}
+	expirationAfter := noExpiration
+	if options != nil && options.TTL != 0 {
+		expirationAfter = options.TTL
 	}
 
-	go func(sub *subscribe, stopCh <-chan struct{}, get getter, push pusher) {
-		defer sub.Close()
+	newKV := &store.KVPair{
+		Key:   key,
+		Value: value,
+	}
+	nKey := normalize(key)
 
-		msgCh := sub.Receive(stopCh)
-		if err := watchLoop(msgCh, stopCh, get, push); err != nil {
-			log.Printf("watchLoop in WatchTree err:%v\n", err)
+	// previous == nil 则仅在key不存在时写入
+	if previous == nil {
+		if err := r.setNX(ctx, nKey, newKV, expirationAfter); err != nil {
+			return false, nil, err
 		}
-	}(sub, stopCh, get, push)
+		return true, newKV, nil
+	}
 
-	return watchCh, nil
+	if err := r.cas(ctx, nKey, previous, newKV, expirationAfter); err != nil {
+		return false, nil, err
+	}
+	return true, newKV, nil
 }
 
-// List the content of a given prefix
-func (r *Redis) List(directory string) ([]*store.KVPair, error) {
-	return r.list(normalize(directory))
+func (r *Redis) setNX(ctx context.Context, key string, val *store.KVPair, ttl time.Duration) error {
+	return r.write(ctx, "setnx", key, val, ttl)
 }
 
-func (r *Redis) list(directory string) ([]*store.KVPair, error) {
-	var allKeys []string
-	regex := scanRegex(directory) // for all keys with $directory
-	allKeys, err := r.keys(regex)
-	if err != nil {
-		return nil, err
-	}
-	// TODO: 需要处理#keys过多的情况
-	return r.mget(directory, allKeys...)
+func (r *Redis) cas(ctx context.Context, key string, old, new *store.KVPair, ttl time.Duration) error {
+	return r.write(ctx, "cas", key, new, ttl, old.LastIndex)
 }
 
-// keys 利用redis scan把所有命令查出
-func (r *Redis) keys(regex string) ([]string, error) {
-	const (
-		startCursor  = 0
-		endCursor    = 0
-		defaultCount = 10
-	)
-
-	var allKeys []string
+// AtomicDelete deletes a single value only if it's not modified since previous
+func (r *Redis) AtomicDelete(key string, previous *store.KVPair) (bool, error) {
+	return r.atomicDelete(context.Background(), key, previous)
+}
 
-	keys, nextCursor, err := r.client.Scan(context.Background(), startCursor, regex, defaultCount).Result()
-	if err != nil {
-		return nil, err
+func (r *Redis) atomicDelete(ctx context.Context, key string, previous *store.KVPair) (bool, error) {
+	if previous == nil {
+		return false, store.ErrPreviousNotSpecified
 	}
-	allKeys = append(allKeys, keys...)
-	for nextCursor != endCursor {
-		keys, nextCursor, err = r.client.Scan(context.Background(), nextCursor, regex, defaultCount).Result()
-		if err != nil {
-			return nil, err
-		}
-		allKeys = append(allKeys, keys...)
-	}
-	if len(allKeys) == 0 {
-		return nil, store.ErrKeyNotFound
+
+	if _, err := r.eval(ctx, normalize(key), "cad", previous.LastIndex); err != nil {
+		return false, err
 	}
-	return allKeys, nil
+	return true, nil
 }
 
-// mget values from given keys
-func (r *Redis) mget(direcroty string, keys ...string) ([]*store.KVPair, error) {
-	replies, err := r.client.MGet(context.Background(), keys...).Result()
-	if err != nil {
-		return nil, err
+// Txn applies ops atomically with the lua script, see store.Store.
+// On a cluster the keys of a transaction must be in the same slot, e.g. share a {hash tag}.
+// TxnPut does not support the ephemeral keys
+func (r *Redis) Txn(ops []*store.TxnOp) ([]*store.KVPair, error) {
+	return r.txn(context.Background(), ops)
+}
+
+func (r *Redis) txn(ctx context.Context, ops []*store.TxnOp) ([]*store.KVPair, error) {
+	if len(ops) == 0 {
+		return []*store.KVPair{}, nil
 	}
 
-	pairs := []*store.KVPair{}
-	for _, reply := range replies {
-		var sreply string
-		if _, ok := reply.(string); ok {
-			sreply = reply.(string)
-		}
-		// empty reply
-		if sreply == "" {
-			continue
+	keys := make([]string, len(ops))
+	args := []interface{}{"txn", r.layout}
+	pairs := make([]*store.KVPair, len(ops))
+	for i, op := range ops {
+		keys[i] = normalize(op.Key)
+		switch op.Type {
+		case store.TxnPut:
+			if op.Options != nil && op.Options.Ephemeral {
+				return nil, &store.TxnError{Op: i, Err: store.ErrCallNotSupported}
+			}
+			expirationAfter := noExpiration
+			if op.Options != nil && op.Options.TTL != 0 {
+				expirationAfter = op.Options.TTL
+			}
+			// the script fills in the index
+			pair := &store.KVPair{Key: op.Key, Value: op.Value}
+			data, err := r.codec.Encode(pair)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, "put", data, op.Key, formatMs(expirationAfter))
+			pairs[i] = pair
+		case store.TxnDelete:
+			args = append(args, "del", "", "", "")
+		case store.TxnCheckIndex:
+			args = append(args, "check", op.Index, "", "")
+		default:
+			return nil, &store.TxnError{Op: i, Err: store.ErrInvalidTxnOp}
 		}
+	}
 
-		newkv := &store.KVPair{}
-		if err := r.codec.decode(sreply, newkv); err != nil {
-			return nil, err
-		}
-		if normalize(newkv.Key) != direcroty {
-			pairs = append(pairs, newkv)
+	res, err := r.script.Run(ctx, r.client, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 2 && res[0] != scriptOK {
+		return nil, &store.TxnError{Op: int(res[1]), Err: scriptResult(res[0])}
+	}
+	if len(res) != len(ops)+1 || res[0] != scriptOK {
+		return nil, fmt.Errorf("redis: unexpected txn result %v", res)
+	}
+	for i, pair := range pairs {
+		if pair != nil {
+			pair.LastIndex = uint64(res[i+1])
 		}
 	}
 	return pairs, nil
 }
 
-// DeleteTree deletes a range keys under a given directory
-// glitch: 先列出所有keys然后再删除，两次网络io，maybe不是原子性的
-func (r *Redis) DeleteTree(directory string) error {
-	var allKeys []string
-	regex := scanRegex(normalize(directory)) // for all keys with $directory
-	allKeys, err := r.keys(regex)
-	if err != nil {
-		return err
+func scriptResult(res int64) error {
+	switch {
+	case res >= scriptOK:
+		return nil
+	case res == scriptKeyNotFound:
+		return store.ErrKeyNotFound
+	case res == scriptKeyModified:
+		return store.ErrKeyModified
+	case res == scriptKeyExists:
+		return store.ErrKeyExists
 	}
-	return r.client.Del(context.Background(), allKeys...).Err()
+	return fmt.Errorf("redis: unexpected script result %d", res)
 }
 
-// Close the store connection
+// Close the store, the ephemeral keys still owned by the store are deleted, the watches
+// and the renewals of the locks are stopped, then the connections are closed
 func (r *Redis) Close() {
-	return
+	r.closeMu.Lock()
+	if r.closed {
+		r.closeMu.Unlock()
+		return
+	}
+	r.closed = true
+	close(r.done)
+	r.closeMu.Unlock()
+
+	r.wg.Wait()
+	r.client.Close()
 }
 
 func scanRegex(directory string) string {
@@ -422,11 +832,11 @@ func normalize(key string) string {
 	return store.Normalize(key)
 }
 
-func formatSec(dur time.Duration) string {
-	return fmt.Sprintf("%d", int(dur/time.Second))
-}
-
-func sequenceNum() uint64 {
-	// TODO: use uuid if we concerns collision probability of this number
-	return uint64(time.Now().Nanosecond())
+// formatMs rounds dur up to the millisecond, since "0" stands for no expiration
+// a ttl under 1ms must not be truncated
+func formatMs(dur time.Duration) string {
+	if dur > 0 {
+		dur += time.Millisecond - 1
+	}
+	return fmt.Sprintf("%d", int64(dur/time.Millisecond))
 }
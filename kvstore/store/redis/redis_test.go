@@ -2,7 +2,13 @@ package redis
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
 
 	"github.com/beyondyyh/libs/kvstore"
 	"github.com/beyondyyh/libs/kvstore/store"
@@ -17,7 +23,7 @@ var (
 // run all: go test -v github.com/beyondyyh/libs/kvstore/store/redis
 
 func makeRedisClient(t *testing.T) store.Store {
-	kv, err := newRedis([]string{client}, "", 0)
+	kv, err := newRedis([]string{client}, nil)
 	if err != nil {
 		t.Fatalf("cannot create store: %v", err)
 	}
@@ -48,5 +54,231 @@ func TestRedisStore(t *testing.T) {
 	defer testutils.RunCleanup(t, kv)
 
 	testutils.RunTestCommon(t, kv)
+	testutils.RunTestAtomic(t, kv)
+	testutils.RunTestTxn(t, kv)
+	testutils.RunTestBatch(t, kv)
+	testutils.RunTestLock(t, kv)
 	testutils.RunTestWatch(t, kv)
+	testutils.RunTestWatchEvents(t, kv)
+}
+
+// go test -v -run TestRedisDeleteTree github.com/beyondyyh/libs/kvstore/store/redis
+func TestRedisDeleteTree(t *testing.T) {
+	assert := assert.New(t)
+	kv := makeRedisClient(t).(*Redis)
+
+	// an empty directory is not an error
+	n, err := kv.DeleteTreeWithOptions("testRedisDeleteTree", nil)
+	assert.NoError(err)
+	assert.Equal(0, n)
+	assert.NoError(kv.DeleteTree("testRedisDeleteTree"))
+
+	for i := 0; i < 30; i++ {
+		assert.NoError(kv.Put(fmt.Sprintf("testRedisDeleteTree/key%d", i), []byte("value"), nil))
+	}
+	// a key not written by the backend is deleted as well
+	assert.NoError(kv.client.Set(context.Background(), normalize("testRedisDeleteTree/foreign"), "value", 0).Err())
+
+	n, err = kv.DeleteTreeWithOptions("testRedisDeleteTree", &store.DeleteTreeOptions{KeepNewer: true})
+	assert.NoError(err)
+	assert.Equal(31, n)
+
+	_, err = kv.List("testRedisDeleteTree")
+	assert.Equal(store.ErrKeyNotFound, err)
+}
+
+// go test -v -run TestRedisWatchResync github.com/beyondyyh/libs/kvstore/store/redis
+func TestRedisWatchResync(t *testing.T) {
+	assert := assert.New(t)
+	kv, err := newRedis([]string{client}, &store.Config{ResyncInterval: 100 * time.Millisecond})
+	assert.NoError(err)
+	defer kv.Delete("testRedisWatchResync")
+
+	// the changes are delivered by the periodic resync without keyspace events
+	ctx := context.Background()
+	assert.NoError(kv.client.ConfigSet(ctx, "notify-keyspace-events", "").Err())
+	defer kv.client.ConfigSet(ctx, "notify-keyspace-events", "KEA")
+
+	stopCh := make(chan struct{})
+	events, errCh, err := kv.WatchWithErrors("testRedisWatchResync", stopCh)
+	assert.NoError(err)
+
+	assert.NoError(kv.Put("testRedisWatchResync", []byte("hello"), nil))
+	select {
+	case pair := <-events:
+		assert.Equal([]byte("hello"), pair.Value)
+	case <-time.After(2 * time.Second):
+		t.Fatal("resync timeout")
+	}
+
+	assert.NoError(kv.Delete("testRedisWatchResync"))
+	select {
+	case pair := <-events:
+		assert.Equal(&store.KVPair{}, pair)
+	case <-time.After(2 * time.Second):
+		t.Fatal("resync timeout")
+	}
+
+	// both channels are closed once stopped
+	close(stopCh)
+	for range events {
+	}
+	for range errCh {
+	}
+}
+
+// go test -v -run TestRedisWatchPolling github.com/beyondyyh/libs/kvstore/store/redis
+func TestRedisWatchPolling(t *testing.T) {
+	assert := assert.New(t)
+	kv, err := newRedis([]string{client}, &store.Config{ResyncInterval: 100 * time.Millisecond})
+	assert.NoError(err)
+	defer kv.Delete("testRedisWatchPolling")
+
+	// e.g. a managed redis without CONFIG
+	kv.notifyChecked = true
+	kv.notifyErr = &NotificationsError{Addr: client, Err: errors.New("ERR unknown command 'CONFIG'")}
+
+	_, err = kv.Watch("testRedisWatchPolling", nil)
+	assert.True(errors.Is(err, ErrNotificationsUnavailable))
+
+	kv.pollingFallback = true
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	events, err := kv.Watch("testRedisWatchPolling", stopCh)
+	assert.NoError(err)
+
+	assert.NoError(kv.Put("testRedisWatchPolling", []byte("hello"), nil))
+	select {
+	case pair := <-events:
+		assert.Equal([]byte("hello"), pair.Value)
+	case <-time.After(2 * time.Second):
+		t.Fatal("polling timeout")
+	}
+}
+
+// go test -v -run TestNotifyFlags github.com/beyondyyh/libs/kvstore/store/redis
+func TestNotifyFlags(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("Kg$hxe", missingFlags(""))
+	assert.Equal("", missingFlags("KEA"))
+	assert.Equal("", missingFlags("AK"))
+	assert.Equal("g$hxe", missingFlags("KE"))
+	assert.Equal("Khe", missingFlags("Eg$x"))
+
+	err := error(&NotificationsError{Addr: client, Flags: "", Err: errors.New("ERR unknown command 'CONFIG'")})
+	assert.True(errors.Is(err, ErrNotificationsUnavailable))
+	assert.Contains(err.Error(), client)
+}
+
+// go test -v -run TestNewClient github.com/beyondyyh/libs/kvstore/store/redis
+func TestNewClient(t *testing.T) {
+	assert := assert.New(t)
+
+	// standalone
+	c, err := newClient([]string{client}, nil)
+	assert.NoError(err)
+	assert.IsType(&redis.Client{}, c)
+	c.Close()
+
+	// tls with redis 6 ACL user
+	tlsConfig := &tls.Config{ServerName: "redis.example.com"}
+	c, err = newClient([]string{client}, &store.Config{TLS: tlsConfig, Username: "app", Password: "secret"})
+	assert.NoError(err)
+	if assert.IsType(&redis.Client{}, c) {
+		opts := c.(*redis.Client).Options()
+		assert.Equal(tlsConfig, opts.TLSConfig)
+		assert.Equal("app", opts.Username)
+		assert.Equal("secret", opts.Password)
+	}
+	c.Close()
+
+	// cluster
+	c, err = newClient([]string{"localhost:7000", "localhost:7001"}, nil)
+	assert.NoError(err)
+	assert.IsType(&redis.ClusterClient{}, c)
+	c.Close()
+
+	// cluster can't select a database
+	_, err = newClient([]string{"localhost:7000", "localhost:7001"}, &store.Config{Bucket: "1"})
+	assert.Equal(ErrDBIndexUnsupported, err)
+
+	// sentinel
+	c, err = newClient([]string{"localhost:26379", "localhost:26380"}, &store.Config{MasterName: "mymaster"})
+	assert.NoError(err)
+	assert.IsType(&redis.Client{}, c)
+	c.Close()
+}
+
+// go test -v -run TestParseCursor github.com/beyondyyh/libs/kvstore/store/redis
+func TestParseCursor(t *testing.T) {
+	assert := assert.New(t)
+
+	node, scan, err := parseCursor("")
+	assert.NoError(err)
+	assert.Equal(0, node)
+	assert.Equal(uint64(0), scan)
+
+	node, scan, err = parseCursor(formatCursor(2, 1234))
+	assert.NoError(err)
+	assert.Equal(2, node)
+	assert.Equal(uint64(1234), scan)
+
+	for _, cursor := range []string{"12", "a:1", "-1:0", "1:b", "testListPage/key09"} {
+		_, _, err = parseCursor(cursor)
+		assert.Equal(store.ErrInvalidCursor, err, cursor)
+	}
+}
+
+// go test -v -run TestFormatMs github.com/beyondyyh/libs/kvstore/store/redis
+func TestFormatMs(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("0", formatMs(noExpiration))
+	// the ttls under 1ms are rounded up instead of becoming no expiration
+	assert.Equal("1", formatMs(time.Nanosecond))
+	assert.Equal("1", formatMs(time.Millisecond))
+	assert.Equal("2", formatMs(time.Millisecond+time.Microsecond))
+	assert.Equal("1500", formatMs(1500*time.Millisecond))
+}
+
+// go test -v -run TestRedisEphemeral github.com/beyondyyh/libs/kvstore/store/redis
+func TestRedisEphemeral(t *testing.T) {
+	assert := assert.New(t)
+	kv := makeRedisClient(t)
+	other := makeRedisClient(t)
+	defer other.Close()
+
+	assert.NoError(kv.Put("testRedisEphemeral", []byte("foo"), &store.WriteOptions{Ephemeral: true, TTL: 300 * time.Millisecond}))
+
+	// the ttl is refreshed by the store beyond its value
+	time.Sleep(time.Second)
+	pair, err := other.Get("testRedisEphemeral")
+	assert.NoError(err)
+	assert.Equal([]byte("foo"), pair.Value)
+
+	// a tiny ttl is renewed every millisecond instead of making the ticker panic
+	assert.NoError(kv.Put("testRedisEphemeral/tiny", []byte("foo"), &store.WriteOptions{Ephemeral: true, TTL: time.Nanosecond}))
+
+	// the key is deleted on Close without waiting for its expiration
+	kv.Close()
+	_, err = other.Get("testRedisEphemeral")
+	assert.Equal(store.ErrKeyNotFound, err)
+	assert.Equal(ErrClosed, kv.Put("testRedisEphemeral", []byte("foo"), &store.WriteOptions{Ephemeral: true}))
+}
+
+// go test -v -run TestRedisClose github.com/beyondyyh/libs/kvstore/store/redis
+func TestRedisClose(t *testing.T) {
+	assert := assert.New(t)
+	kv, err := newRedis([]string{client}, nil)
+	assert.NoError(err)
+
+	// the connections are closed along with the store, Close may be called twice
+	kv.Close()
+	kv.Close()
+	err = kv.client.Ping(context.Background()).Err()
+	if assert.Error(err) {
+		assert.Equal("redis: client is closed", err.Error())
+	}
+	assert.Equal(ErrClosed, kv.Put("testRedisClose", []byte("foo"), &store.WriteOptions{Ephemeral: true}))
 }
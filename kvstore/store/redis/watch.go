@@ -0,0 +1,541 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+const (
+	// defaultResyncInterval is how often a watch compares the LastIndex of the watched keys
+	// with the last pushed ones if store.Config.ResyncInterval is not set,
+	// it bounds the delay of the changes whose keyspace events are lost
+	defaultResyncInterval = 30 * time.Second
+
+	// pubsubPingInterval is how long a subscription may be idle before it's pinged,
+	// a subscription which doesn't answer the ping until the next interval is dropped
+	pubsubPingInterval = 10 * time.Second
+
+	// resubscribe backoff bounds
+	minResubscribeBackoff = 100 * time.Millisecond
+	maxResubscribeBackoff = 10 * time.Second
+)
+
+// ErrSubscriptionDropped is sent on the error channel of a watch
+// when the keyspace subscription is lost, the watch resubscribes
+var ErrSubscriptionDropped = errors.New("redis: keyspace subscription dropped")
+
+// Watch for changes on a key.
+// The keyspace events trigger a read of the key, the key is also read periodically
+// and after every resubscription so that the changes whose events are lost are delivered.
+// An empty KVPair is pushed once the key is deleted or expired
+func (r *Redis) Watch(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, error) {
+	watchCh, _, err := r.watch(context.Background(), key, stopCh)
+	return watchCh, err
+}
+
+// WatchWithErrors is Watch with the errors of the watch reported on the error channel,
+// the watch keeps retrying until stopCh is closed
+func (r *Redis) WatchWithErrors(key string, stopCh <-chan struct{}) (<-chan *store.KVPair, <-chan error, error) {
+	return r.watch(context.Background(), key, stopCh)
+}
+
+// watch uses ctx for the redis calls and stops once stopCh is closed
+func (r *Redis) watch(ctx context.Context, key string, stopCh <-chan struct{}) (<-chan *store.KVPair, <-chan error, error) {
+	if p, err := r.pollingWatcher(ctx); err != nil || p != nil {
+		if err != nil {
+			return nil, nil, err
+		}
+		return p.WatchWithErrors(key, stopCh)
+	}
+
+	watchCh := make(chan *store.KVPair)
+	nKey := normalize(key)
+
+	var (
+		exists    bool
+		lastIndex uint64
+	)
+	// refresh pushes the key if its LastIndex changed
+	refresh := func() error {
+		pair, err := r.get(ctx, nKey)
+		if err != nil && err != store.ErrKeyNotFound {
+			return err
+		}
+
+		switch {
+		case err == nil && (!exists || pair.LastIndex != lastIndex):
+			exists, lastIndex = true, pair.LastIndex
+			return sendPair(watchCh, pair, stopCh)
+		case err != nil && exists:
+			// 查看已过期或删除的key时，返回空并且清空KV
+			exists, lastIndex = false, 0
+			return sendPair(watchCh, &store.KVPair{}, stopCh)
+		}
+		return nil
+	}
+
+	w, err := r.newWatcher(ctx, regexWatch(nKey, false), stopCh, refresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	go func() {
+		defer close(watchCh)
+		w.run()
+	}()
+
+	return watchCh, w.errCh, nil
+}
+
+// WatchTree watches for changes on child nodes under a given directory,
+// the directory is listed like Watch reads the key
+func (r *Redis) WatchTree(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, error) {
+	watchCh, _, err := r.watchTree(context.Background(), directory, stopCh)
+	return watchCh, err
+}
+
+// WatchTreeWithErrors is WatchTree with the errors of the watch reported on the error channel,
+// the watch keeps retrying until stopCh is closed
+func (r *Redis) WatchTreeWithErrors(directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, <-chan error, error) {
+	return r.watchTree(context.Background(), directory, stopCh)
+}
+
+// watchTree uses ctx for the redis calls and stops once stopCh is closed
+func (r *Redis) watchTree(ctx context.Context, directory string, stopCh <-chan struct{}) (<-chan []*store.KVPair, <-chan error, error) {
+	if p, err := r.pollingWatcher(ctx); err != nil || p != nil {
+		if err != nil {
+			return nil, nil, err
+		}
+		return p.WatchTreeWithErrors(directory, stopCh)
+	}
+
+	watchCh := make(chan []*store.KVPair)
+	nKey := normalize(directory)
+
+	var (
+		synced  bool
+		indexes map[string]uint64
+	)
+	// refresh pushes the directory if the LastIndex of any key changed
+	refresh := func() error {
+		pairs, err := r.list(ctx, nKey)
+		if err != nil && err != store.ErrKeyNotFound {
+			return err
+		}
+		if pairs == nil {
+			pairs = []*store.KVPair{}
+		}
+
+		current := store.Indexes(pairs)
+		if synced && store.SameIndexes(indexes, current) {
+			return nil
+		}
+		synced, indexes = true, current
+		return sendPairs(watchCh, pairs, stopCh)
+	}
+
+	w, err := r.newWatcher(ctx, regexWatch(nKey, true), stopCh, refresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	go func() {
+		defer close(watchCh)
+		w.run()
+	}()
+
+	return watchCh, w.errCh, nil
+}
+
+// WatchEvents watches for changes on child nodes under a given directory.
+// The keyspace events are mapped to store.Event: set/hset to store.EventPut,
+// del/evicted to store.EventDelete and expired to store.EventExpire.
+// The directory is listed periodically and after every resubscription,
+// the changes whose keyspace events are lost are reported from the diff
+func (r *Redis) WatchEvents(directory string, stopCh <-chan struct{}) (<-chan *store.Event, error) {
+	return r.watchEvents(context.Background(), directory, stopCh)
+}
+
+func (r *Redis) watchEvents(ctx context.Context, directory string, stopCh <-chan struct{}) (<-chan *store.Event, error) {
+	if p, err := r.pollingWatcher(ctx); err != nil || p != nil {
+		if err != nil {
+			return nil, err
+		}
+		return p.WatchEvents(directory, stopCh)
+	}
+
+	eventCh := make(chan *store.Event)
+	nKey := normalize(directory)
+
+	var (
+		synced bool
+		known  = map[string]*store.KVPair{} // keyed by the normalized key
+	)
+	emit := func(event *store.Event) error {
+		select {
+		case eventCh <- event:
+			return nil
+		case <-stopCh:
+			return errStopped
+		}
+	}
+
+	// refresh reports the diff between the known pairs and the directory
+	refresh := func() error {
+		pairs, err := r.list(ctx, nKey)
+		if err != nil && err != store.ErrKeyNotFound {
+			return err
+		}
+
+		var events []*store.Event
+		if synced {
+			prev := make([]*store.KVPair, 0, len(known))
+			for _, pair := range known {
+				prev = append(prev, pair)
+			}
+			events = store.DiffEvents(prev, pairs)
+		}
+		synced, known = true, make(map[string]*store.KVPair, len(pairs))
+		for _, pair := range pairs {
+			known[normalize(pair.Key)] = pair
+		}
+
+		for _, event := range events {
+			if err := emit(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// handle maps a keyspace event of a single key
+	handle := func(msg *redis.Message) error {
+		key := keyspaceKey(msg.Channel)
+		if key == "" || key == nKey {
+			return nil
+		}
+		prev := known[key]
+
+		switch msg.Payload {
+		case "set", "hset", "rename_to":
+			pair, err := r.get(ctx, key)
+			if err == store.ErrKeyNotFound {
+				// removed meanwhile, its own event follows
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if prev != nil && prev.LastIndex == pair.LastIndex {
+				return nil
+			}
+			known[key] = pair
+			return emit(&store.Event{Type: store.EventPut, Pair: pair, PrevPair: prev})
+		case "del", "evicted", "rename_from", "expired":
+			delete(known, key)
+			pair := &store.KVPair{Key: key}
+			if prev != nil {
+				pair.Key = prev.Key
+			}
+			typ := store.EventDelete
+			if msg.Payload == "expired" {
+				typ = store.EventExpire
+			}
+			return emit(&store.Event{Type: typ, Pair: pair, PrevPair: prev})
+		}
+		return nil
+	}
+
+	w, err := r.newWatcher(ctx, regexWatch(nKey, true), stopCh, refresh)
+	if err != nil {
+		return nil, err
+	}
+	w.handle = handle
+
+	// the current content is the base of the diff, the changes made
+	// once WatchEvents returns are reported since we're subscribed
+	if err := refresh(); err != nil {
+		w.sub.Close()
+		return nil, err
+	}
+
+	go func() {
+		defer close(eventCh)
+		w.run()
+	}()
+
+	return eventCh, nil
+}
+
+// keyspaceKey returns the key of a keyspace channel like __keyspace@0__:key
+func keyspaceKey(channel string) string {
+	if i := strings.IndexByte(channel, ':'); i >= 0 {
+		return channel[i+1:]
+	}
+	return ""
+}
+
+// errStopped is returned by the senders once the watch is stopped
+var errStopped = errors.New("redis: watch stopped")
+
+func sendPair(ch chan<- *store.KVPair, pair *store.KVPair, stopCh <-chan struct{}) error {
+	select {
+	case ch <- pair:
+		return nil
+	case <-stopCh:
+		return errStopped
+	}
+}
+
+func sendPairs(ch chan<- []*store.KVPair, pairs []*store.KVPair, stopCh <-chan struct{}) error {
+	select {
+	case ch <- pairs:
+		return nil
+	case <-stopCh:
+		return errStopped
+	}
+}
+
+func regexWatch(key string, withChildren bool) string {
+	var regex string
+	if withChildren {
+		// keys with $key prefix
+		regex = fmt.Sprintf("__keyspace*:%s*", key)
+	} else {
+		// keys with $key
+		regex = fmt.Sprintf("__keyspace*:%s", key)
+	}
+	return regex
+}
+
+// watcher calls refresh on every keyspace event matching regex, periodically
+// and after every (re)subscription, until stopCh is closed.
+// The events are passed to handle instead if it's set.
+// A dropped subscription is resubscribed with backoff
+type watcher struct {
+	r       *Redis
+	ctx     context.Context
+	regex   string
+	stopCh  <-chan struct{}
+	refresh func() error
+	handle  func(msg *redis.Message) error
+	errCh   chan error
+	sub     *subscribe
+}
+
+// newWatcher subscribes to regex, the first subscription must succeed
+func (r *Redis) newWatcher(ctx context.Context, regex string, stopCh <-chan struct{}, refresh func() error) (*watcher, error) {
+	sub, err := newSubscribe(ctx, r, regex)
+	if err != nil {
+		return nil, err
+	}
+	return &watcher{
+		r:       r,
+		ctx:     ctx,
+		regex:   regex,
+		stopCh:  stopCh,
+		refresh: refresh,
+		errCh:   make(chan error, 1),
+		sub:     sub,
+	}, nil
+}
+
+// pollingWatcher returns nil if the keyspace notifications are available, or the
+// watcher polling the store if they are unavailable and store.Config.PollingFallback is set
+func (r *Redis) pollingWatcher(ctx context.Context) (*store.PollingWatcher, error) {
+	err := r.checkNotifications(ctx)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, ErrNotificationsUnavailable) || !r.pollingFallback {
+		return nil, err
+	}
+	return store.NewPollingWatcher(r, r.pollInterval, r.pollInterval/10), nil
+}
+
+// run blocks until stopCh is closed or the store is closed, then the error channel is closed
+func (w *watcher) run() {
+	defer close(w.errCh)
+
+	backoff := minResubscribeBackoff
+	for {
+		if w.sub != nil {
+			start := time.Now()
+			err := w.loop(w.sub)
+			w.sub.Close()
+			w.sub = nil
+			if err == errStopped {
+				return
+			}
+			w.report(err)
+			// the backoff grows only while the watch keeps failing
+			if time.Since(start) > maxResubscribeBackoff {
+				backoff = minResubscribeBackoff
+			}
+		}
+
+		select {
+		case <-w.stopCh:
+			return
+		case <-w.r.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxResubscribeBackoff {
+			backoff = maxResubscribeBackoff
+		}
+
+		sub, err := newSubscribe(w.ctx, w.r, w.regex)
+		if err != nil {
+			w.report(err)
+			continue
+		}
+		w.sub = sub
+	}
+}
+
+// loop handles the events of sub until it's dropped or the watch is stopped
+func (w *watcher) loop(sub *subscribe) error {
+	// the events missed before subscribing are caught up here
+	if err := w.refresh(); err != nil {
+		return err
+	}
+
+	msgCh, errCh := sub.Receive()
+	resync := time.NewTicker(w.r.resyncInterval)
+	defer resync.Stop()
+
+	for {
+		select {
+		case <-w.stopCh:
+			return errStopped
+		case <-w.r.done:
+			return errStopped
+		case err := <-errCh:
+			return fmt.Errorf("%w: %v", ErrSubscriptionDropped, err)
+		case msg := <-msgCh:
+			if w.handle != nil {
+				if err := w.handle(msg); err != nil {
+					return err
+				}
+				continue
+			}
+		case <-resync.C:
+		}
+		if err := w.refresh(); err != nil {
+			return err
+		}
+	}
+}
+
+// report sends err on the error channel without blocking, the errors are dropped
+// if the caller does not read them
+func (w *watcher) report(err error) {
+	select {
+	case w.errCh <- err:
+	default:
+	}
+}
+
+// subscribe listens to keyspace events on every node
+type subscribe struct {
+	pubsubs []*redis.PubSub
+	closeCh chan struct{}
+}
+
+func newSubscribe(ctx context.Context, r *Redis, regex string) (*subscribe, error) {
+	var (
+		mu      sync.Mutex
+		pubsubs []*redis.PubSub
+	)
+	err := r.forEachNode(ctx, func(ctx context.Context, client *redis.Client) error {
+		pubsub := client.PSubscribe(ctx, regex)
+		// wait for the confirmation so that no event is missed
+		if _, err := pubsub.Receive(ctx); err != nil {
+			pubsub.Close()
+			return err
+		}
+		mu.Lock()
+		pubsubs = append(pubsubs, pubsub)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		for _, pubsub := range pubsubs {
+			pubsub.Close()
+		}
+		return nil, err
+	}
+
+	return &subscribe{
+		pubsubs: pubsubs,
+		closeCh: make(chan struct{}),
+	}, nil
+}
+
+func (s *subscribe) Close() error {
+	close(s.closeCh)
+	var err error
+	for _, pubsub := range s.pubsubs {
+		if e := pubsub.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Receive merges the messages of every node into one channel,
+// the first error of a node is sent on the error channel
+func (s *subscribe) Receive() (<-chan *redis.Message, <-chan error) {
+	msgCh := make(chan *redis.Message)
+	errCh := make(chan error, len(s.pubsubs))
+	for _, pubsub := range s.pubsubs {
+		go s.receiveLoop(pubsub, msgCh, errCh)
+	}
+	return msgCh, errCh
+}
+
+// receiveLoop pings the idle subscription so that a dead
+// connection (e.g. after a failover) is detected
+func (s *subscribe) receiveLoop(pubsub *redis.PubSub, msgCh chan<- *redis.Message, errCh chan<- error) {
+	ctx := context.Background()
+	pinged := false
+	for {
+		msg, err := pubsub.ReceiveTimeout(ctx, pubsubPingInterval)
+		if err != nil {
+			if isTimeout(err) && !pinged {
+				if err = pubsub.Ping(ctx); err == nil {
+					pinged = true
+					continue
+				}
+			}
+			errCh <- err
+			return
+		}
+		pinged = false
+
+		m, ok := msg.(*redis.Message)
+		if !ok {
+			continue
+		}
+		select {
+		case msgCh <- m:
+		case <-s.closeCh:
+			return
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
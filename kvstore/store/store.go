@@ -14,6 +14,12 @@ const (
 	CONSUL Backend = "consul"
 	// Redis backend
 	REDIS Backend = "redis"
+	// Memory backend
+	MEMORY Backend = "memory"
+	// File backend
+	FILE Backend = "file"
+	// Directory backend
+	DIR Backend = "dir"
 )
 
 var (
@@ -25,6 +31,8 @@ var (
 	ErrNotReachable = errors.New("Api not reachable")
 	// ErrCannotLock is thrown when there is an error acquiring a lock on a key
 	ErrCannotLock = errors.New("Error acquiring the lock")
+	// ErrLockNotHeld is thrown when releasing a lock which is not held
+	ErrLockNotHeld = errors.New("Lock not held")
 	// ErrKeyModified is thrown during an atomic operation if the index does not match the one in the store
 	ErrKeyModified = errors.New("Unable to complete atomic operation, key modified")
 	// ErrKeyNotFound is thrown when the key is not found in the store during a Get operation
@@ -44,6 +52,30 @@ type Config struct {
 	PersistConnection bool
 	Username          string
 	Password          string
+	// MasterName is the sentinel master name, redis only
+	MasterName string
+	// Codec is the value codec, redis only: json (default), msgpack or raw
+	Codec string
+	// CustomCodec is a value codec of the caller, it overrides Codec, redis only
+	CustomCodec Codec
+	// ScanCount is the COUNT hint of SCAN used to list the keys, redis only
+	ScanCount int
+	// ResyncInterval is how often a watch reads the watched keys
+	// regardless of the keyspace events for redis, the poll interval for dir
+	ResyncInterval time.Duration
+	// PollingFallback makes the watches poll every ResyncInterval (1s by default)
+	// when keyspace notifications are unavailable, redis only
+	PollingFallback bool
+}
+
+// Codec defines how a KVPair is encoded by the backends storing it as a blob, see redis.Codec
+type Codec interface {
+	// Name of the codec
+	Name() string
+	// Encode kv into the data stored at the key
+	Encode(kv *KVPair) (string, error)
+	// Decode the data stored at the key into kv
+	Decode(data string, kv *KVPair) error
 }
 
 // type ClientTLSConfig struct {
@@ -81,6 +113,23 @@ type Store interface {
 	// DeleteTree deletes a range keys under a given directory
 	DeleteTree(directory string) error
 
+	// AtomicPut is a CAS operation on a single value,
+	// pass previous = nil to create a new key
+	AtomicPut(key string, value []byte, previous *KVPair, options *WriteOptions) (bool, *KVPair, error)
+
+	// AtomicDelete deletes a single value only if it's not modified since previous
+	AtomicDelete(key string, previous *KVPair) (bool, error)
+
+	// Txn applies ops in order, all of them or none. It returns a pair per op,
+	// the pair written by a TxnPut and nil for the other operations.
+	// A TxnCheckIndex should precede the writes of its key in the transaction.
+	// ErrCallNotSupported is thrown by the backends without transactions
+	Txn(ops []*TxnOp) ([]*KVPair, error)
+
+	// NewLock creates a lock for a given key,
+	// the returned Locker is not held until its Lock method is called
+	NewLock(key string, options *LockOptions) (Locker, error)
+
 	// Close the store connection
 	Close()
 }
@@ -96,4 +145,62 @@ type KVPair struct {
 type WriteOptions struct {
 	IsDir bool
 	TTL   time.Duration
+	// Ephemeral ties the key to the store: the store keeps it alive until Close and
+	// the key is removed once the process dies. TTL is how long the key survives the
+	// process, a default of the backend is used if 0. The writes which can't honor it
+	// return ErrCallNotSupported, wrapped in a TxnError for Txn
+	Ephemeral bool
+}
+
+// ErrorWatcher is implemented by the backends which report the errors of a watch
+// instead of stopping it, the error channel is closed along with the watch channel
+type ErrorWatcher interface {
+	// WatchWithErrors watches for changes on a key until stopCh is closed
+	WatchWithErrors(key string, stopCh <-chan struct{}) (<-chan *KVPair, <-chan error, error)
+
+	// WatchTreeWithErrors watches for changes on child nodes under a given directory until stopCh is closed
+	WatchTreeWithErrors(directory string, stopCh <-chan struct{}) (<-chan []*KVPair, <-chan error, error)
+}
+
+// DeleteTreeOptions contains optional request parameters of TreeDeleter
+type DeleteTreeOptions struct {
+	KeepNewer bool // Optional, leave alone the keys written after the deletion started
+}
+
+// TreeDeleter is implemented by the backends which can report
+// how many keys are removed by DeleteTree
+type TreeDeleter interface {
+	// DeleteTreeWithOptions deletes the keys under directory and returns their number,
+	// an empty directory is not an error
+	DeleteTreeWithOptions(directory string, options *DeleteTreeOptions) (int, error)
+}
+
+// LockOptions contains optional request parameters
+type LockOptions struct {
+	Value []byte        // Optional, value to associate with the lock
+	TTL   time.Duration // Optional, expiration ttl associated with the lock
+}
+
+// minRenewInterval bounds the renewals of the tiny ttls
+const minRenewInterval = time.Millisecond
+
+// RenewInterval returns how often a key with ttl is renewed by the backends keeping it alive,
+// a third of ttl but minRenewInterval at least
+func RenewInterval(ttl time.Duration) time.Duration {
+	if interval := ttl / 3; interval > minRenewInterval {
+		return interval
+	}
+	return minRenewInterval
+}
+
+// Locker provides locking mechanism on top of the store.
+// Similar to `sync.Locker` except it may return errors.
+type Locker interface {
+	// Lock attempts to acquire the lock and blocks while doing so.
+	// It returns a channel that is closed if the lock is lost or released,
+	// a nil channel is returned if stopCh is closed before acquiring the lock
+	Lock(stopCh <-chan struct{}) (<-chan struct{}, error)
+
+	// Unlock releases the lock, ErrLockNotHeld is thrown if it's not held
+	Unlock() error
 }
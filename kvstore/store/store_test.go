@@ -0,0 +1,21 @@
+package store_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beyondyyh/libs/kvstore/store"
+)
+
+// go test -v -run TestRenewInterval github.com/beyondyyh/libs/kvstore/store
+func TestRenewInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(20*time.Second, store.RenewInterval(time.Minute))
+	// the tiny and negative ttls don't make a ticker panic
+	for _, ttl := range []time.Duration{3 * time.Millisecond, 2 * time.Nanosecond, 0, -time.Second} {
+		assert.Equal(time.Millisecond, store.RenewInterval(ttl), ttl)
+	}
+}
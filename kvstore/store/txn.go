@@ -0,0 +1,88 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidTxnOp is thrown when an operation of a transaction has an unknown type
+var ErrInvalidTxnOp = errors.New("Invalid transaction operation")
+
+// TxnOpType is the kind of an operation of a transaction
+type TxnOpType int
+
+const (
+	// TxnPut writes a value at a key
+	TxnPut TxnOpType = iota + 1
+	// TxnDelete deletes a key, a missing key is not an error
+	TxnDelete
+	// TxnCheckIndex rolls the transaction back if the key is modified
+	TxnCheckIndex
+)
+
+func (t TxnOpType) String() string {
+	switch t {
+	case TxnPut:
+		return "put"
+	case TxnDelete:
+		return "delete"
+	case TxnCheckIndex:
+		return "check-index"
+	}
+	return "unknown"
+}
+
+// TxnOp is an operation of a transaction, see Store.Txn
+type TxnOp struct {
+	Type    TxnOpType
+	Key     string
+	Value   []byte        // TxnPut only
+	Options *WriteOptions // TxnPut only
+	// Index is the LastIndex the key must have, 0 if the key must not exist. TxnCheckIndex only
+	Index uint64
+}
+
+// PutOp returns an operation writing value at key
+func PutOp(key string, value []byte, options *WriteOptions) *TxnOp {
+	return &TxnOp{Type: TxnPut, Key: key, Value: value, Options: options}
+}
+
+// DeleteOp returns an operation deleting key
+func DeleteOp(key string) *TxnOp {
+	return &TxnOp{Type: TxnDelete, Key: key}
+}
+
+// CheckIndexOp returns an operation checking that key is not modified since index,
+// pass index = 0 to check that the key does not exist
+func CheckIndexOp(key string, index uint64) *TxnOp {
+	return &TxnOp{Type: TxnCheckIndex, Key: key, Index: index}
+}
+
+// TxnError is thrown when a transaction is rolled back because of one of its operations,
+// Err is ErrKeyNotFound, ErrKeyModified or ErrKeyExists for a failed TxnCheckIndex
+type TxnError struct {
+	Op  int // position of the operation in the transaction
+	Err error
+}
+
+func (e *TxnError) Error() string {
+	return fmt.Sprintf("Transaction rolled back by operation %d: %v", e.Op, e.Err)
+}
+
+func (e *TxnError) Unwrap() error {
+	return e.Err
+}
+
+// CheckIndex tells if a key whose current LastIndex is index, 0 if missing,
+// passes a TxnCheckIndex of the expected index
+func CheckIndex(index, expected uint64) error {
+	switch {
+	case expected == 0 && index != 0:
+		return ErrKeyExists
+	case expected != 0 && index == 0:
+		return ErrKeyNotFound
+	case index != expected:
+		return ErrKeyModified
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package testutils
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -19,6 +21,9 @@ func RunTestCommon(t *testing.T, kv store.Store) {
 		t.Run("List", func(t *testing.T) {
 			testList(t, kv)
 		})
+		t.Run("ListPage", func(t *testing.T) {
+			testListPage(t, kv)
+		})
 		t.Run("DeleteTree", func(t *testing.T) {
 			testDeleteTree(t, kv)
 		})
@@ -34,6 +39,48 @@ func RunTestWatch(t *testing.T, kv store.Store) {
 	})
 }
 
+// RunTestWatchEvents tests the typed events of the backends implementing store.EventWatcher
+func RunTestWatchEvents(t *testing.T, kv store.Store) {
+	t.Run("WatchEvents", func(t *testing.T) {
+		w, ok := kv.(store.EventWatcher)
+		if !ok {
+			t.Skip("store.EventWatcher not implemented")
+		}
+		testWatchEvents(t, kv, w)
+	})
+}
+
+// RunTestAtomic tests the Atomic operations by the K/V
+// backends
+func RunTestAtomic(t *testing.T, kv store.Store) {
+	t.Run("Atomic", func(t *testing.T) {
+		t.Run("AtomicPut", func(t *testing.T) {
+			testAtomicPut(t, kv)
+		})
+		t.Run("AtomicPutCreate", func(t *testing.T) {
+			testAtomicPutCreate(t, kv)
+		})
+		t.Run("AtomicDelete", func(t *testing.T) {
+			testAtomicDelete(t, kv)
+		})
+		t.Run("AtomicPutEphemeral", func(t *testing.T) {
+			testAtomicPutEphemeral(t, kv)
+		})
+	})
+}
+
+// RunTestLock tests the KV pair Lock/Unlock APIs
+func RunTestLock(t *testing.T, kv store.Store) {
+	t.Run("Lock", func(t *testing.T) {
+		t.Run("LockUnlock", func(t *testing.T) {
+			testLockUnlock(t, kv)
+		})
+		t.Run("LockExclusive", func(t *testing.T) {
+			testLockExclusive(t, kv)
+		})
+	})
+}
+
 func testPutGetDeleteExists(t *testing.T, kv store.Store) {
 	assert := assert.New(t)
 
@@ -123,6 +170,50 @@ func testList(t *testing.T, kv store.Store) {
 	assert.Nil(pairs)
 }
 
+func testListPage(t *testing.T, kv store.Store) {
+	assert := assert.New(t)
+	prefix := "testListPage"
+
+	const total = 25
+	for i := 0; i < total; i++ {
+		err := kv.Put(fmt.Sprintf("%s/key%02d", prefix, i), []byte(fmt.Sprintf("value%02d", i)), nil)
+		assert.NoError(err)
+	}
+
+	// Page through the directory, every key is seen exactly once
+	seen := map[string]bool{}
+	cursor := ""
+	for pages := 0; pages < 2*total; pages++ {
+		pairs, next, err := store.ListPage(kv, prefix, cursor, 7)
+		assert.NoError(err)
+		for _, pair := range pairs {
+			assert.False(seen[pair.Key], pair.Key)
+			seen[pair.Key] = true
+			assert.Equal("value"+pair.Key[len(pair.Key)-2:], string(pair.Value))
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(total, len(seen))
+
+	// Stream the directory
+	pairsCh, errCh := store.ListStream(kv, prefix, 10, nil)
+	streamed := 0
+	for pairs := range pairsCh {
+		streamed += len(pairs)
+	}
+	assert.NoError(<-errCh)
+	assert.Equal(total, streamed)
+
+	// An empty directory is not an error
+	pairs, next, err := store.ListPage(kv, "not_exist_key", "", 10)
+	assert.NoError(err)
+	assert.Empty(pairs)
+	assert.Equal("", next)
+}
+
 func testDeleteTree(t *testing.T, kv store.Store) {
 	assert := assert.New(t)
 	prefix := "testDeleteTree"
@@ -188,7 +279,9 @@ func testWatch(t *testing.T, kv store.Store) {
 	assert.NoError(err)
 	assert.NotNil(events)
 
-	// 异步更新 loop
+	// 异步更新 loop，测试结束时停止
+	doneCh := make(chan struct{})
+	defer close(doneCh)
 	go func() {
 		timeout := time.After(4 * time.Second)
 		tick := time.Tick(1000 * time.Millisecond)
@@ -196,6 +289,8 @@ func testWatch(t *testing.T, kv store.Store) {
 			select {
 			case <-timeout:
 				return
+			case <-doneCh:
+				return
 			case <-tick:
 				err := kv.Put(key, newValue, nil)
 				if assert.NoError(err) {
@@ -291,15 +386,477 @@ func testWatchTree(t *testing.T, kv store.Store) {
 	}
 }
 
+func testWatchEvents(t *testing.T, kv store.Store, w store.EventWatcher) {
+	assert := assert.New(t)
+	dir := "testWatchEvents"
+	node1 := "testWatchEvents/node1"
+	node2 := "testWatchEvents/node2"
+
+	err := kv.Put(node1, []byte("node1"), nil)
+	assert.NoError(err)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	events, err := w.WatchEvents(dir, stopCh)
+	assert.NoError(err)
+
+	next := func() *store.Event {
+		select {
+		case event := <-events:
+			t.Logf("event:%s pair:%+v", event.Type, *event.Pair)
+			return event
+		case <-time.After(4 * time.Second):
+			t.Fatal("Timeout reached")
+		}
+		return nil
+	}
+
+	// the current content is not reported, only the changes
+	err = kv.Put(node2, []byte("node2"), nil)
+	assert.NoError(err)
+	event := next()
+	assert.Equal(store.EventPut, event.Type)
+	assert.True(strings.HasSuffix(event.Pair.Key, node2))
+	assert.Equal([]byte("node2"), event.Pair.Value)
+	assert.Nil(event.PrevPair)
+
+	err = kv.Put(node1, []byte("NODE1"), nil)
+	assert.NoError(err)
+	event = next()
+	assert.Equal(store.EventPut, event.Type)
+	assert.True(strings.HasSuffix(event.Pair.Key, node1))
+	assert.Equal([]byte("NODE1"), event.Pair.Value)
+	if assert.NotNil(event.PrevPair) {
+		assert.Equal([]byte("node1"), event.PrevPair.Value)
+	}
+
+	err = kv.Delete(node2)
+	assert.NoError(err)
+	event = next()
+	assert.Equal(store.EventDelete, event.Type)
+	assert.True(strings.HasSuffix(event.Pair.Key, node2))
+	if assert.NotNil(event.PrevPair) {
+		assert.Equal([]byte("node2"), event.PrevPair.Value)
+	}
+}
+
+// RunTestTxn tests the transactions, skipped for the backends returning ErrCallNotSupported
+func RunTestTxn(t *testing.T, kv store.Store) {
+	t.Run("Txn", func(t *testing.T) {
+		if _, err := kv.Txn(nil); err == store.ErrCallNotSupported {
+			t.Skip("transactions not supported")
+		}
+		testTxn(t, kv)
+	})
+}
+
+func testTxn(t *testing.T, kv store.Store) {
+	assert := assert.New(t)
+	config := "testTxn/config"
+	version := "testTxn/version"
+
+	// Create both keys, checking they don't exist yet
+	pairs, err := kv.Txn([]*store.TxnOp{
+		store.CheckIndexOp(config, 0),
+		store.PutOp(config, []byte("v1"), nil),
+		store.PutOp(version, []byte("1"), nil),
+	})
+	assert.NoError(err)
+	if assert.Len(pairs, 3) {
+		assert.Nil(pairs[0])
+		if assert.NotNil(pairs[1]) {
+			assert.Equal([]byte("v1"), pairs[1].Value)
+			assert.NotEqual(0, pairs[1].LastIndex)
+		}
+	}
+
+	pair, err := kv.Get(config)
+	assert.NoError(err)
+	if assert.NotNil(pair) {
+		assert.Equal([]byte("v1"), pair.Value)
+		assert.Equal(pairs[1].LastIndex, pair.LastIndex)
+	}
+
+	// A failed check rolls the whole transaction back
+	pairs, err = kv.Txn([]*store.TxnOp{
+		store.PutOp(version, []byte("2"), nil),
+		store.CheckIndexOp(config, pair.LastIndex+6744),
+		store.PutOp(config, []byte("v2"), nil),
+	})
+	assert.Nil(pairs)
+	assert.True(errors.Is(err, store.ErrKeyModified), fmt.Sprintf("unexpected error %v", err))
+	var txnErr *store.TxnError
+	if assert.True(errors.As(err, &txnErr)) {
+		assert.Equal(1, txnErr.Op)
+	}
+	versionPair, err := kv.Get(version)
+	assert.NoError(err)
+	if assert.NotNil(versionPair) {
+		assert.Equal([]byte("1"), versionPair.Value)
+	}
+
+	_, err = kv.Txn([]*store.TxnOp{store.CheckIndexOp(config, 0)})
+	assert.True(errors.Is(err, store.ErrKeyExists), fmt.Sprintf("unexpected error %v", err))
+	_, err = kv.Txn([]*store.TxnOp{store.CheckIndexOp("testTxn/missing", 6744)})
+	assert.True(errors.Is(err, store.ErrKeyNotFound), fmt.Sprintf("unexpected error %v", err))
+
+	// Update and delete together
+	_, err = kv.Txn([]*store.TxnOp{
+		store.CheckIndexOp(config, pair.LastIndex),
+		store.PutOp(config, []byte("v2"), nil),
+		store.DeleteOp(version),
+		store.DeleteOp("testTxn/missing"),
+	})
+	assert.NoError(err)
+
+	pair, err = kv.Get(config)
+	assert.NoError(err)
+	if assert.NotNil(pair) {
+		assert.Equal([]byte("v2"), pair.Value)
+	}
+	_, err = kv.Get(version)
+	assert.Equal(store.ErrKeyNotFound, err)
+
+	// An ephemeral put is written or rolls the transaction back
+	ephemeral := "testTxn/ephemeral"
+	_, err = kv.Txn([]*store.TxnOp{
+		store.PutOp(config, []byte("v3"), nil),
+		store.PutOp(ephemeral, []byte("foo"), &store.WriteOptions{Ephemeral: true}),
+	})
+	if errors.Is(err, store.ErrCallNotSupported) {
+		pair, err = kv.Get(config)
+		assert.NoError(err)
+		if assert.NotNil(pair) {
+			assert.Equal([]byte("v2"), pair.Value)
+		}
+		_, err = kv.Get(ephemeral)
+		assert.Equal(store.ErrKeyNotFound, err)
+		return
+	}
+	assert.NoError(err)
+	pair, err = kv.Get(ephemeral)
+	assert.NoError(err)
+	if assert.NotNil(pair) {
+		assert.Equal([]byte("foo"), pair.Value)
+	}
+	assert.NoError(kv.Delete(ephemeral))
+}
+
+// RunTestBatch tests GetMany, PutMany and DeleteMany,
+// natively or by the fallbacks of the store package
+func RunTestBatch(t *testing.T, kv store.Store) {
+	t.Run("Batch", func(t *testing.T) {
+		testBatch(t, kv)
+	})
+	t.Run("BatchEphemeral", func(t *testing.T) {
+		testBatchEphemeral(t, kv)
+	})
+}
+
+func testBatch(t *testing.T, kv store.Store) {
+	assert := assert.New(t)
+	keys := []string{"testBatch/a", "testBatch/b", "testBatch/c"}
+	missing := "testBatch/missing"
+
+	pairs := make([]*store.KVPair, len(keys))
+	for i, key := range keys {
+		pairs[i] = &store.KVPair{Key: key, Value: []byte("value" + key)}
+	}
+	results, err := store.PutMany(kv, pairs, nil)
+	assert.NoError(err)
+	if assert.Len(results, len(keys)) {
+		for i, result := range results {
+			assert.NoError(result.Err)
+			if assert.NotNil(result.Pair) {
+				assert.Equal(pairs[i].Value, result.Pair.Value)
+			}
+		}
+	}
+	written := results
+
+	// The results are in the order of the keys
+	results, err = store.GetMany(kv, []string{keys[2], missing, keys[0]})
+	assert.NoError(err)
+	if assert.Len(results, 3) {
+		for i, j := range map[int]int{0: 2, 2: 0} {
+			assert.NoError(results[i].Err)
+			if assert.NotNil(results[i].Pair) {
+				assert.Equal(pairs[j].Value, results[i].Pair.Value)
+				if written[j].Pair != nil && written[j].Pair.LastIndex != 0 {
+					assert.Equal(written[j].Pair.LastIndex, results[i].Pair.LastIndex)
+				}
+			}
+		}
+		assert.Equal(store.ErrKeyNotFound, results[1].Err)
+		assert.Nil(results[1].Pair)
+	}
+
+	results, err = store.DeleteMany(kv, []string{keys[0], missing, keys[1]})
+	assert.NoError(err)
+	if assert.Len(results, 3) {
+		assert.NoError(results[0].Err)
+		assert.Equal(store.ErrKeyNotFound, results[1].Err)
+		assert.NoError(results[2].Err)
+	}
+
+	for i, key := range keys {
+		_, err := kv.Get(key)
+		if i < 2 {
+			assert.Equal(store.ErrKeyNotFound, err)
+		} else {
+			assert.NoError(err)
+		}
+	}
+
+	results, err = store.GetMany(kv, nil)
+	assert.NoError(err)
+	assert.Empty(results)
+}
+
+func testAtomicPut(t *testing.T, kv store.Store) {
+	assert := assert.New(t)
+	key := "testAtomicPut"
+	value := []byte("world")
+
+	// Put the key
+	err := kv.Put(key, value, nil)
+	assert.NoError(err)
+
+	// Get should return the value and an incremented index
+	pair, err := kv.Get(key)
+	assert.NoError(err)
+	if assert.NotNil(pair) {
+		assert.NotNil(pair.Value)
+	}
+	assert.Equal(pair.Value, value)
+	assert.NotEqual(pair.LastIndex, 0)
+
+	// This CAS should fail: previous exists
+	success, _, err := kv.AtomicPut(key, []byte("WORLD"), nil, nil)
+	assert.Equal(store.ErrKeyExists, err)
+	assert.False(success)
+
+	// This CAS should succeed
+	success, _, err = kv.AtomicPut(key, []byte("WORLD"), pair, nil)
+	assert.NoError(err)
+	assert.True(success)
+
+	// This CAS should fail, key has wrong index
+	pair.LastIndex = 6744
+	success, _, err = kv.AtomicPut(key, []byte("WORLDWORLD"), pair, nil)
+	assert.Equal(store.ErrKeyModified, err)
+	assert.False(success)
+}
+
+func testAtomicPutEphemeral(t *testing.T, kv store.Store) {
+	assert := assert.New(t)
+	key := "testAtomicPutEphemeral"
+	value := []byte("ephemeral")
+
+	// The backends which can't honor Ephemeral must not write the key
+	success, pair, err := kv.AtomicPut(key, value, nil, &store.WriteOptions{Ephemeral: true})
+	if err == store.ErrCallNotSupported {
+		assert.False(success)
+		exists, err := kv.Exists(key)
+		assert.NoError(err)
+		assert.False(exists)
+		return
+	}
+	assert.NoError(err)
+	assert.True(success)
+	if assert.NotNil(pair) {
+		assert.Equal(value, pair.Value)
+	}
+
+	pair, err = kv.Get(key)
+	assert.NoError(err)
+	if assert.NotNil(pair) {
+		assert.Equal(value, pair.Value)
+	}
+	assert.NoError(kv.Delete(key))
+}
+
+func testAtomicPutCreate(t *testing.T, kv store.Store) {
+	assert := assert.New(t)
+	// Use a key in a new directory to ensure Stores will create directories
+	// that don't yet exist
+	key := "testAtomicPutCreate/create"
+	value := []byte("putcreate")
+
+	// AtomicPut the key, previous = nil indicates create
+	success, _, err := kv.AtomicPut(key, value, nil, nil)
+	assert.NoError(err)
+	assert.True(success)
+
+	// Get should return the value and an incremented index
+	pair, err := kv.Get(key)
+	assert.NoError(err)
+	if assert.NotNil(pair) {
+		assert.NotNil(pair.Value)
+	}
+	assert.Equal(pair.Value, value)
+
+	// Attempting to create again should fail
+	success, _, err = kv.AtomicPut(key, value, nil, nil)
+	assert.Equal(store.ErrKeyExists, err)
+	assert.False(success)
+
+	// This CAS should succeed, since it has the value from Get()
+	success, _, err = kv.AtomicPut(key, []byte("PUTCREATE"), pair, nil)
+	assert.NoError(err)
+	assert.True(success)
+}
+
+func testAtomicDelete(t *testing.T, kv store.Store) {
+	assert := assert.New(t)
+	key := "testAtomicDelete"
+	value := []byte("world")
+
+	// Put the key
+	err := kv.Put(key, value, nil)
+	assert.NoError(err)
+
+	// Get should return the value and an incremented index
+	pair, err := kv.Get(key)
+	assert.NoError(err)
+	if assert.NotNil(pair) {
+		assert.NotNil(pair.Value)
+	}
+	assert.Equal(pair.Value, value)
+	assert.NotEqual(pair.LastIndex, 0)
+
+	// Previous must be specified
+	success, err := kv.AtomicDelete(key, nil)
+	assert.Equal(store.ErrPreviousNotSpecified, err)
+	assert.False(success)
+
+	tempIndex := pair.LastIndex
+
+	// AtomicDelete should fail
+	pair.LastIndex = 6744
+	success, err = kv.AtomicDelete(key, pair)
+	assert.Equal(store.ErrKeyModified, err)
+	assert.False(success)
+
+	// AtomicDelete should succeed
+	pair.LastIndex = tempIndex
+	success, err = kv.AtomicDelete(key, pair)
+	assert.NoError(err)
+	assert.True(success)
+
+	// Delete a non-existent key; should fail
+	success, err = kv.AtomicDelete(key, pair)
+	assert.Equal(store.ErrKeyNotFound, err)
+	assert.False(success)
+}
+
+func testLockUnlock(t *testing.T, kv store.Store) {
+	assert := assert.New(t)
+	key := "testLockUnlock"
+	value := []byte("bar")
+
+	// We should be able to create a new lock on key
+	lock, err := kv.NewLock(key, &store.LockOptions{Value: value})
+	assert.NoError(err)
+	assert.NotNil(lock)
+
+	for i := 0; i < 2; i++ {
+		// Lock should successfully succeed or block
+		lockCh, err := lock.Lock(nil)
+		assert.NoError(err)
+		assert.NotNil(lockCh)
+
+		// Locking a held lock should fail
+		_, err = lock.Lock(nil)
+		assert.Equal(store.ErrCannotLock, err)
+
+		// Get should work
+		pair, err := kv.Get(key)
+		assert.NoError(err)
+		if assert.NotNil(pair) {
+			assert.Equal(value, pair.Value)
+		}
+
+		// Unlock should succeed
+		err = lock.Unlock()
+		assert.NoError(err)
+
+		// The lock channel is closed once released
+		select {
+		case <-lockCh:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timeout reached")
+		}
+	}
+
+	// Unlock a lock which is not held should fail
+	err = lock.Unlock()
+	assert.Equal(store.ErrLockNotHeld, err)
+}
+
+func testLockExclusive(t *testing.T, kv store.Store) {
+	assert := assert.New(t)
+	key := "testLockExclusive"
+
+	lock1, err := kv.NewLock(key, &store.LockOptions{Value: []byte("lock1")})
+	assert.NoError(err)
+	lock2, err := kv.NewLock(key, &store.LockOptions{Value: []byte("lock2")})
+	assert.NoError(err)
+
+	_, err = lock1.Lock(nil)
+	assert.NoError(err)
+
+	// lock2 should block while lock1 is held
+	acquired := make(chan struct{})
+	go func() {
+		lockCh, err := lock2.Lock(nil)
+		assert.NoError(err)
+		assert.NotNil(lockCh)
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Lock acquired while held by another locker")
+	case <-time.After(time.Second):
+	}
+
+	// lock2 should be acquired once lock1 is released
+	assert.NoError(lock1.Unlock())
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout reached")
+	}
+
+	// A stopped Lock returns a nil channel
+	stopCh := make(chan struct{})
+	close(stopCh)
+	lockCh, err := lock1.Lock(stopCh)
+	assert.NoError(err)
+	assert.Nil(lockCh)
+
+	assert.NoError(lock2.Unlock())
+}
+
 // RunCleanup cleans up keys introduced by the tests
 func RunCleanup(t *testing.T, kv store.Store) {
 	assert := assert.New(t)
 	for _, key := range []string{
 		"testPutGetDeleteExists",
 		"testList",
+		"testListPage",
 		"testWatch",
 		"testWatchTree",
+		"testWatchEvents",
 		"testDeleteTree",
+		"testAtomicPut",
+		"testAtomicPutCreate",
+		"testAtomicDelete",
+		"testLockUnlock",
+		"testLockExclusive",
+		"testTxn",
+		"testBatch",
 	} {
 		err := kv.DeleteTree(key)
 		// assert.True(err == nil, fmt.Sprintf("failed to delete tree key %s: %v", key, err))
@@ -308,3 +865,42 @@ func RunCleanup(t *testing.T, kv store.Store) {
 		assert.True(err == nil || err == store.ErrKeyNotFound, fmt.Sprintf("failed to delete key %s: %v", key, err))
 	}
 }
+
+func testBatchEphemeral(t *testing.T, kv store.Store) {
+	assert := assert.New(t)
+	keys := []string{"testBatchEphemeral/a", "testBatchEphemeral/b"}
+
+	pairs := make([]*store.KVPair, len(keys))
+	for i, key := range keys {
+		pairs[i] = &store.KVPair{Key: key, Value: []byte("value" + key)}
+	}
+
+	// Every key is written as ephemeral, or not written if the backend can't honor it
+	results, err := store.PutMany(kv, pairs, &store.WriteOptions{Ephemeral: true})
+	if err == store.ErrCallNotSupported {
+		results = make([]*store.KeyResult, len(keys))
+		for i := range keys {
+			results[i] = &store.KeyResult{Err: err}
+		}
+	} else {
+		assert.NoError(err)
+	}
+	if !assert.Len(results, len(keys)) {
+		return
+	}
+	for i, result := range results {
+		if result.Err == store.ErrCallNotSupported {
+			exists, err := kv.Exists(keys[i])
+			assert.NoError(err)
+			assert.False(exists, keys[i])
+			continue
+		}
+		assert.NoError(result.Err)
+		pair, err := kv.Get(keys[i])
+		assert.NoError(err)
+		if assert.NotNil(pair) {
+			assert.Equal(pairs[i].Value, pair.Value)
+		}
+		assert.NoError(kv.Delete(keys[i]))
+	}
+}
@@ -0,0 +1,27 @@
+package openssl
+
+import (
+	"crypto/aes"
+)
+
+// AesGCMEncrypt
+// Aes算法，GCM应用模式加密，key长度为16、24或32字节
+func AesGCMEncrypt(src, key, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return GCMEncrypt(block, src, additionalData)
+}
+
+// AesGCMDecrypt
+// Aes算法，GCM应用模式解密
+func AesGCMDecrypt(src, key, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return GCMDecrypt(block, src, additionalData)
+}
@@ -0,0 +1,40 @@
+package openssl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test -v -run Test_AesGCMEncryptAndDecrypt
+func Test_AesGCMEncryptAndDecrypt(t *testing.T) {
+	src := []byte("123456")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	ad := []byte("secret/key")
+
+	dst, err := AesGCMEncrypt(src, key, ad)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(dst), string(src))
+
+	// the nonce is random, the same plaintext is never encrypted twice the same way
+	other, err := AesGCMEncrypt(src, key, ad)
+	assert.NoError(t, err)
+	assert.NotEqual(t, dst, other)
+
+	plainText, err := AesGCMDecrypt(dst, key, ad)
+	assert.NoError(t, err)
+	assert.Equal(t, src, plainText)
+
+	// the ciphertext is authenticated along with the additional data
+	_, err = AesGCMDecrypt(dst, key, []byte("other/key"))
+	assert.Error(t, err)
+	dst[len(dst)-1] ^= 1
+	_, err = AesGCMDecrypt(dst, key, ad)
+	assert.Error(t, err)
+	_, err = AesGCMDecrypt(dst[:4], key, ad)
+	assert.Equal(t, ErrCiphertextTooShort, err)
+
+	// the key must be a valid aes key
+	_, err = AesGCMEncrypt(src, []byte("12345"), ad)
+	assert.Error(t, err)
+}
@@ -0,0 +1,41 @@
+package openssl
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// ErrCiphertextTooShort is returned when the ciphertext is shorter than the nonce
+var ErrCiphertextTooShort = errors.New("openssl: ciphertext too short")
+
+// GCMEncrypt
+// AEAD GCM模式加密，随机生成的nonce置于密文之前，additionalData参与认证但不加密
+func GCMEncrypt(block cipher.Block, src, additionalData []byte) ([]byte, error) {
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(src)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, src, additionalData), nil
+}
+
+// GCMDecrypt
+// AEAD GCM模式解密，src为GCMEncrypt的输出，密文或additionalData被篡改时返回错误
+func GCMDecrypt(block cipher.Block, src, additionalData []byte) ([]byte, error) {
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(src) < aead.NonceSize() {
+		return nil, ErrCiphertextTooShort
+	}
+	nonce, ciphertext := src[:aead.NonceSize()], src[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}